@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"time"
 
+	"github.com/ceyhunalp/calypso_experiments/util"
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/calypso"
 	"github.com/dedis/cothority/darc"
@@ -83,6 +84,21 @@ func (byzd *ByzcoinData) SpawnDarc(spawnDarc darc.Darc, wait int) (*byzcoin.AddT
 	return byzd.Cl.AddTransactionAndWait(ctx, wait)
 }
 
+// ProofBlocks is the number of block intervals WaitForInstance waits for
+// an instance.
+const ProofBlocks = 10
+
+// WaitForInstance waits for the instance to be on byzcoin and returns its
+// verified proof, see util.WaitForInstance.
+func (byzd *ByzcoinData) WaitForInstance(id byzcoin.InstanceID) (*byzcoin.Proof, error) {
+	proof, err := util.WaitForInstance(byzd.Cl, id, ProofBlocks*byzd.GMsg.BlockInterval)
+	if err != nil {
+		log.Errorf("WaitForInstance error: %v", err)
+		return nil, err
+	}
+	return proof, nil
+}
+
 func SetupDarcs(numParticipant int) ([]darc.Signer, darc.Signer, []*darc.Darc, error) {
 	//var writer darc.Signer
 	var reader darc.Signer
@@ -12,7 +12,6 @@ import (
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 	"os"
-	"time"
 )
 
 func runCalypsoLottery(r *onet.Roster, calypsoClient *calypso.Client, byzd *lottery.ByzcoinData, ltsReply *calypso.CreateLTSReply, numParticipant int) error {
@@ -29,7 +28,11 @@ func runCalypsoLottery(r *onet.Roster, calypsoClient *calypso.Client, byzd *lott
 		}
 	}
 
-	time.Sleep(2 * time.Second)
+	for i := 0; i < numParticipant; i++ {
+		if _, err := byzd.WaitForInstance(byzcoin.NewInstanceID(writeDarcList[i].GetBaseID())); err != nil {
+			return err
+		}
+	}
 
 	lotteryData := make([]*lottery.LotteryData, numParticipant)
 	writeTxnData := make([]*calypso.Write, numParticipant)
@@ -59,15 +62,11 @@ func runCalypsoLottery(r *onet.Roster, calypsoClient *calypso.Client, byzd *lott
 
 	writeProofList := make([]byzcoin.Proof, numParticipant)
 	for i := 0; i < numParticipant; i++ {
-		wrProofResponse, err := byzd.Cl.GetProof(writeTxnList[i].InstanceID.Slice())
+		proof, err := byzd.WaitForInstance(writeTxnList[i].InstanceID)
 		if err != nil {
-			log.Errorf("GetProof(Write) failed: %v", err)
 			return err
 		}
-		if !wrProofResponse.Proof.InclusionProof.Match() {
-			return errors.New("Write inclusion proof does not match")
-		}
-		writeProofList[i] = wrProofResponse.Proof
+		writeProofList[i] = *proof
 	}
 
 	readTxnList := make([]*calypso.ReadReply, numParticipant)
@@ -87,15 +86,11 @@ func runCalypsoLottery(r *onet.Roster, calypsoClient *calypso.Client, byzd *lott
 
 	readProofList := make([]byzcoin.Proof, numParticipant)
 	for i := 0; i < numParticipant; i++ {
-		rProofResponse, err := byzd.Cl.GetProof(readTxnList[i].InstanceID.Slice())
+		proof, err := byzd.WaitForInstance(readTxnList[i].InstanceID)
 		if err != nil {
-			log.Errorf("GetProof(Read) failed: %v", err)
 			return err
 		}
-		if !rProofResponse.Proof.InclusionProof.Match() {
-			return errors.New("Read inclusion proof does not match")
-		}
-		readProofList[i] = rProofResponse.Proof
+		readProofList[i] = *proof
 	}
 
 	decodedSecretList := make([][]byte, numParticipant)
@@ -387,6 +387,9 @@ func (s *SimulationService) runMultipleLottery(config *onet.SimulationConfig, by
 
 	///////////////////////////////////////////////////////////////////////
 
+	// The proofs are polled without the backoff and the verification of
+	// WaitForInstance, so that the timings stay comparable with the
+	// earlier runs.
 	writeProofReady := false
 	writeProofList := make([]byzcoin.Proof, numTransactions)
 	for writeProofReady == false {
@@ -25,7 +25,7 @@ import (
 	cli "gopkg.in/urfave/cli.v1"
 	// Import your service:
 	_ "github.com/ceyhunalp/calypso_experiments/fully_centralized/service"
-	_ "github.com/ceyhunalp/calypso_experiments/semi_centralized/service"
+	semicentralized "github.com/ceyhunalp/calypso_experiments/semi_centralized"
 	_ "github.com/ceyhunalp/calypso_experiments/tournament_lottery/service"
 	// Here you can import any other needed service for your conode.
 	// For example, if your service needs cosi available in the server
@@ -74,6 +74,37 @@ func main() {
 			Value: path.Join(cfgpath.GetConfigPath("cothority_template"), app.DefaultServerConfig),
 			Usage: "Configuration file of the server",
 		},
+		cli.StringFlag{
+			Name:   "blobstore",
+			Value:  semicentralized.BlobBolt,
+			EnvVar: "SC_BLOBSTORE",
+			Usage:  "where the semi-centralized service stores data: bolt, fs or s3",
+		},
+		cli.StringFlag{
+			Name:   "blobstore-dir",
+			EnvVar: "SC_BLOBSTORE_DIR",
+			Usage:  "directory of the fs blob store",
+		},
+		cli.StringFlag{
+			Name:   "s3-endpoint",
+			EnvVar: "SC_S3_ENDPOINT",
+			Usage:  "URL of the S3 compatible API of the s3 blob store",
+		},
+		cli.StringFlag{
+			Name:   "s3-region",
+			EnvVar: "SC_S3_REGION",
+			Usage:  "region of the s3 blob store",
+		},
+		cli.StringFlag{
+			Name:   "s3-bucket",
+			EnvVar: "SC_S3_BUCKET",
+			Usage:  "bucket of the s3 blob store",
+		},
+		cli.StringFlag{
+			Name:   "s3-prefix",
+			EnvVar: "SC_S3_PREFIX",
+			Usage:  "prefix of the objects of the s3 blob store",
+		},
 	}
 	cliApp.Before = func(c *cli.Context) error {
 		log.SetDebugVisible(c.Int("debug"))
@@ -84,6 +115,13 @@ func main() {
 }
 
 func runServer(c *cli.Context) error {
+	// The keys of the s3 blob store are only taken from the environment.
+	semicentralized.Blobs.Backend = c.GlobalString("blobstore")
+	semicentralized.Blobs.Dir = c.GlobalString("blobstore-dir")
+	semicentralized.Blobs.S3.Endpoint = c.GlobalString("s3-endpoint")
+	semicentralized.Blobs.S3.Region = c.GlobalString("s3-region")
+	semicentralized.Blobs.S3.Bucket = c.GlobalString("s3-bucket")
+	semicentralized.Blobs.S3.Prefix = c.GlobalString("s3-prefix")
 	app.RunServer(c.GlobalString("config"))
 	return nil
 }
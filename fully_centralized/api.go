@@ -1,28 +1,60 @@
 package centralized
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
+	"io"
+	"time"
 
 	fc "github.com/ceyhunalp/calypso_experiments/fully_centralized/service"
 	"github.com/ceyhunalp/calypso_experiments/util"
 	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/darc/expression"
 	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/util/random"
 	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
 )
 
 func CreateWriteTxn(roster *onet.Roster, wd *util.WriteData) (*util.WriteData, error) {
-	cl := fc.NewClient()
+	return createWriteTxn(fc.NewClient(), roster, wd, nil)
+}
+
+// CreatePolicyWriteTxn stores a write whose read access is controlled by
+// policy instead of the single reader, e.g. one created by fc.AnyOfPolicy
+// or fc.ThresholdPolicy.
+func CreatePolicyWriteTxn(roster *onet.Roster, wd *util.WriteData, policy expression.Expr) (*util.WriteData, error) {
+	return createWriteTxn(fc.NewClient(), roster, wd, policy)
+}
+
+// CreateReplicatedWriteTxn stores the write on every member of the roster
+// and succeeds if at least quorum of them stored it. The write data has to
+// be created with util.CreateReplicatedWriteData using the keys of the
+// roster.
+func CreateReplicatedWriteTxn(roster *onet.Roster, wd *util.WriteData, quorum int) (*util.WriteData, error) {
+	return createWriteTxn(fc.NewReplicatedClient(quorum), roster, wd, nil)
+}
+
+func createWriteTxn(cl *fc.Client, roster *onet.Roster, wd *util.WriteData, policy expression.Expr) (*util.WriteData, error) {
 	defer cl.Close()
-	wr := fc.WriteRequest{
-		EncData:  wd.Data,
-		DataHash: wd.DataHash,
-		K:        wd.K,
-		C:        wd.C,
-		Reader:   wd.Reader,
-		//EncReader: wd.EncReader,
+	wr, err := newWriteRequest(wd, policy)
+	if err != nil {
+		return wd, err
+	}
+	if wd.Chunked {
+		wr.EncData = nil
+	}
+	if err = signWrite(wr, wd.WriterSk); err != nil {
+		return wd, err
+	}
+	var reply *fc.WriteReply
+	if wd.Chunked {
+		reply, err = cl.WriteChunked(roster, wr, wd.Data, wd.WriterSk)
+	} else {
+		reply, err = cl.Write(roster, wr)
 	}
-	reply, err := cl.Write(roster, &wr)
 	if err != nil {
 		wd.StoredKey = ""
 	} else {
@@ -31,24 +63,487 @@ func CreateWriteTxn(roster *onet.Roster, wd *util.WriteData) (*util.WriteData, e
 	return wd, err
 }
 
-func CreateReadTxn(roster *onet.Roster, wID string, sk kyber.Scalar) (kyber.Point, kyber.Point, error) {
+// newWriteRequest returns the write request that stores wd, which still has
+// to be signed with signWrite.
+func newWriteRequest(wd *util.WriteData, policy expression.Expr) (*fc.WriteRequest, error) {
+	wr := &fc.WriteRequest{
+		EncData:   wd.Data,
+		DataHash:  wd.DataHash,
+		K:         wd.K,
+		C:         wd.C,
+		Reader:    wd.Reader,
+		Replicas:  wd.Replicas,
+		Owner:     wd.Owner,
+		Policy:    policy,
+		TTL:       int64(wd.TTL / time.Second),
+		ServerKey: wd.ServerKey,
+		Ubar:      wd.Ubar,
+		E:         wd.E,
+		F:         wd.F,
+		//EncReader: wd.EncReader,
+	}
+	if wd.WriterSk != nil && wr.Owner == nil {
+		wr.Owner = cothority.Suite.Point().Mul(wd.WriterSk, nil)
+	}
+	return wr, nil
+}
+
+// signWrite signs wr with the key of the writer, if there is one. It has to
+// be called once wr is complete, as the signature covers all of it.
+func signWrite(wr *fc.WriteRequest, sk kyber.Scalar) error {
+	if sk == nil {
+		return nil
+	}
+	wr.Timestamp = time.Now().Unix()
+	wr.Sig = nil
+	digest, err := fc.WriteDigest(wr)
+	if err != nil {
+		return err
+	}
+	wr.Sig, err = util.SignWrite(sk, wr.Timestamp, digest)
+	return err
+}
+
+// CreateWriteBatchTxn stores all wds in one request. If quorum is not 0,
+// the writes are stored on the whole roster as in CreateReplicatedWriteTxn.
+// The StoredKey of every stored write is set, and the returned slice holds
+// the error of every write that could not be stored.
+func CreateWriteBatchTxn(roster *onet.Roster, wds []*util.WriteData, quorum int) ([]error, error) {
+	cl := fc.NewReplicatedClient(quorum)
+	defer cl.Close()
+	req := &fc.WriteBatchRequest{Writes: make([]*fc.WriteRequest, len(wds))}
+	for i, wd := range wds {
+		wr, err := newWriteRequest(wd, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err = signWrite(wr, wd.WriterSk); err != nil {
+			return nil, err
+		}
+		req.Writes[i] = wr
+	}
+	reply, err := cl.WriteBatch(roster, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.WriteIDs) != len(wds) || len(reply.Errors) != len(wds) {
+		return nil, errors.New("Wrong number of replies in batch")
+	}
+	errs := make([]error, len(wds))
+	for i, wd := range wds {
+		wd.StoredKey = ""
+		if reply.Errors[i] != "" {
+			errs[i] = errors.New(reply.Errors[i])
+			continue
+		}
+		wd.StoredKey = reply.WriteIDs[i]
+	}
+	return errs, nil
+}
+
+// CreateReadTxn asks for the key of the stored write wd to be re-encrypted
+// to sk. The reply is verified against the ciphertext in wd.
+func CreateReadTxn(roster *onet.Roster, wd *util.WriteData, sk kyber.Scalar) (kyber.Point, kyber.Point, error) {
+	return createReadTxn(fc.NewClient(), roster, wd, sk)
+}
+
+// CreateReplicatedReadTxn asks the members of the roster in turn to
+// re-encrypt the key of a replicated write, until one of them answers.
+func CreateReplicatedReadTxn(roster *onet.Roster, wd *util.WriteData, sk kyber.Scalar, quorum int) (kyber.Point, kyber.Point, error) {
+	return createReadTxn(fc.NewReplicatedClient(quorum), roster, wd, sk)
+}
+
+// CreatePolicyReadTxn reads a write that has a policy. The key is
+// re-encrypted to the public key of sk and the request is co-signed with
+// all the keys in cosigners.
+func CreatePolicyReadTxn(roster *onet.Roster, wd *util.WriteData, sk kyber.Scalar, cosigners []kyber.Scalar) (kyber.Point, kyber.Point, error) {
 	cl := fc.NewClient()
 	defer cl.Close()
-	widBytes, err := hex.DecodeString(wID)
+	rr, msg, err := newReadRequest(wd.StoredKey, cothority.Suite.Point().Mul(sk, nil))
 	if err != nil {
 		return nil, nil, err
 	}
-	sig, err := schnorr.Sign(cothority.Suite, sk, widBytes)
+	rr.Sig, err = schnorr.Sign(cothority.Suite, sk, msg)
 	if err != nil {
 		return nil, nil, err
 	}
-	rr := fc.ReadRequest{
-		WriteID: wID,
-		Sig:     sig,
+	for _, cs := range cosigners {
+		csSig, err := schnorr.Sign(cothority.Suite, cs, msg)
+		if err != nil {
+			return nil, nil, err
+		}
+		rr.Signatures = append(rr.Signatures, &fc.PolicySignature{
+			Public: cothority.Suite.Point().Mul(cs, nil),
+			Sig:    csSig,
+		})
 	}
-	reply, err := cl.Read(roster, &rr)
+	reply, err := cl.Read(roster, rr)
 	if err != nil {
 		return nil, nil, err
 	}
+	if err = verifyReadReply(reply, wd, rr.Reader); err != nil {
+		return nil, nil, err
+	}
 	return reply.K, reply.C, nil
 }
+
+// verifyReadReply checks the proof that the key was correctly re-encrypted
+// to reader. The proof is checked against the ciphertext the writer
+// encrypted to the server, as stored in wd, and not against the one the
+// server holds now, which is only trusted once its re-encryptions from the
+// former are verified.
+func verifyReadReply(reply *fc.ReadReply, wd *util.WriteData, reader kyber.Point) error {
+	if reply.WriteKey == nil {
+		return errors.New("Missing server key in reply")
+	}
+	k, c := writeCiphertext(wd, reply.WriteKey)
+	if k == nil || c == nil {
+		return errors.New("Write was not encrypted to the server key of the reply")
+	}
+	serverKey, k, c, err := util.VerifyRewraps(reply.WriteKey, k, c, reply.Rewraps)
+	if err != nil {
+		return err
+	}
+	return util.VerifyReencryption(serverKey, k, c, reader, reply.K, reply.C, reply.Proof)
+}
+
+// writeCiphertext returns the ciphertext of wd that is encrypted to
+// serverKey, or nil if there is none.
+func writeCiphertext(wd *util.WriteData, serverKey kyber.Point) (kyber.Point, kyber.Point) {
+	if wd.ServerKey != nil && wd.ServerKey.Equal(serverKey) {
+		return wd.K, wd.C
+	}
+	for _, rk := range wd.Replicas {
+		if rk != nil && rk.Server != nil && rk.Server.Equal(serverKey) {
+			return rk.K, rk.C
+		}
+	}
+	return nil, nil
+}
+
+// CreateReadDataTxn reads the write like CreateReadTxn, but also fetches
+// the encrypted data from the server, so that the reader does not need to
+// get it from the writer. It returns the decrypted data.
+func CreateReadDataTxn(roster *onet.Roster, wd *util.WriteData, sk kyber.Scalar) ([]byte, error) {
+	reply, err := readDataTxn(roster, wd, sk, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(reply.EncData)) != reply.Size {
+		return nil, errors.New("Data is too large for one read, download it in chunks")
+	}
+	if !util.VerifyDataHash(reply.EncData, reply.DataHash) {
+		return nil, errors.New("Data does not match its hash")
+	}
+	return util.RecoverData(reply.EncData, sk, reply.K, reply.C)
+}
+
+// CreateRangeReadTxn reads the write and fetches length bytes of its
+// encrypted data, starting at offset. The returned range cannot be
+// verified on its own.
+func CreateRangeReadTxn(roster *onet.Roster, wd *util.WriteData, sk kyber.Scalar, offset, length int64) (*fc.ReadReply, error) {
+	return readDataTxn(roster, wd, sk, offset, length)
+}
+
+func readDataTxn(roster *onet.Roster, wd *util.WriteData, sk kyber.Scalar, offset, length int64) (*fc.ReadReply, error) {
+	cl := fc.NewClient()
+	defer cl.Close()
+	rr, msg, err := newReadRequest(wd.StoredKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	rr.Sig, err = schnorr.Sign(cothority.Suite, sk, msg)
+	if err != nil {
+		return nil, err
+	}
+	rr.IncludeData = true
+	rr.Offset = offset
+	rr.Length = length
+	reply, err := cl.Read(roster, rr)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyReadReply(reply, wd, cothority.Suite.Point().Mul(sk, nil)); err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(reply.DataHash) != wd.StoredKey {
+		return nil, errors.New("Data hash does not match the write ID")
+	}
+	return reply, nil
+}
+
+// newReadRequest returns a read request with a fresh nonce and the current
+// time, together with the message its readers have to sign. The reader is
+// only set for writes with a policy.
+func newReadRequest(wID string, reader kyber.Point) (*fc.ReadRequest, []byte, error) {
+	rr := &fc.ReadRequest{
+		WriteID:   wID,
+		Nonce:     make([]byte, fc.NonceLen),
+		Timestamp: time.Now().Unix(),
+		Reader:    reader,
+	}
+	random.Bytes(rr.Nonce, random.New())
+	msg, err := fc.ReadMessage(rr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rr, msg, nil
+}
+
+func createReadTxn(cl *fc.Client, roster *onet.Roster, wd *util.WriteData, sk kyber.Scalar) (kyber.Point, kyber.Point, error) {
+	defer cl.Close()
+	rr, msg, err := newReadRequest(wd.StoredKey, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	rr.Sig, err = schnorr.Sign(cothority.Suite, sk, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	reply, err := cl.Read(roster, rr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = verifyReadReply(reply, wd, cothority.Suite.Point().Mul(sk, nil)); err != nil {
+		return nil, nil, err
+	}
+	return reply.K, reply.C, nil
+}
+
+// CreateReadBatchTxn asks for the re-encryption of the keys of all stored
+// writes wds to the reader sk in one request, and verifies the proof of
+// every reply. It returns the re-encrypted keys and the error of every read
+// that failed.
+func CreateReadBatchTxn(roster *onet.Roster, wds []*util.WriteData, sk kyber.Scalar, quorum int) ([]kyber.Point, []kyber.Point, []error, error) {
+	cl := fc.NewReplicatedClient(quorum)
+	defer cl.Close()
+	req := &fc.ReadBatchRequest{Reads: make([]*fc.ReadRequest, len(wds))}
+	for i, wd := range wds {
+		rr, msg, err := newReadRequest(wd.StoredKey, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		rr.Sig, err = schnorr.Sign(cothority.Suite, sk, msg)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		req.Reads[i] = rr
+	}
+	reply, err := cl.ReadBatch(roster, req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	reader := cothority.Suite.Point().Mul(sk, nil)
+	ks := make([]kyber.Point, len(wds))
+	cs := make([]kyber.Point, len(wds))
+	errs := make([]error, len(wds))
+	for i, rep := range reply.Replies {
+		if reply.Errors[i] != "" {
+			errs[i] = errors.New(reply.Errors[i])
+			continue
+		}
+		if errs[i] = verifyReadReply(rep, wds[i], reader); errs[i] != nil {
+			continue
+		}
+		ks[i], cs[i] = rep.K, rep.C
+	}
+	return ks, cs, errs, nil
+}
+
+// UpdateReadPolicy gives read access to newReader, or to the readers in
+// policy if it is not nil. version is the current
+// policy version of the write, which is 0 after it has been stored and is
+// returned by every successful policy change. quorum is the write quorum of
+// a replicated write and 0 otherwise.
+func UpdateReadPolicy(roster *onet.Roster, wID string, version int, newReader kyber.Point, policy expression.Expr, ownerSk kyber.Scalar, quorum int) (int, error) {
+	cl := fc.NewReplicatedClient(quorum)
+	defer cl.Close()
+	msg, err := fc.PolicyUpdateMessage(wID, version, newReader, policy)
+	if err != nil {
+		return version, err
+	}
+	sig, err := schnorr.Sign(cothority.Suite, ownerSk, msg)
+	if err != nil {
+		return version, err
+	}
+	reply, err := cl.UpdatePolicy(roster, &fc.UpdatePolicyRequest{
+		WriteID: wID,
+		Version: version,
+		Reader:  newReader,
+		Policy:  policy,
+		Sig:     sig,
+	})
+	if err != nil {
+		return version, err
+	}
+	return reply.Version, nil
+}
+
+// RevokeReadAccess revokes all read access to the write.
+func RevokeReadAccess(roster *onet.Roster, wID string, version int, ownerSk kyber.Scalar, quorum int) (int, error) {
+	cl := fc.NewReplicatedClient(quorum)
+	defer cl.Close()
+	msg, err := fc.RevokeMessage(wID, version)
+	if err != nil {
+		return version, err
+	}
+	sig, err := schnorr.Sign(cothority.Suite, ownerSk, msg)
+	if err != nil {
+		return version, err
+	}
+	reply, err := cl.Revoke(roster, &fc.RevokeRequest{
+		WriteID: wID,
+		Version: version,
+		Sig:     sig,
+	})
+	if err != nil {
+		return version, err
+	}
+	return reply.Version, nil
+}
+
+// GetAuditLog fetches the whole audit log of si and verifies the hash chain
+// up to its head.
+func GetAuditLog(si *network.ServerIdentity) ([]*fc.AuditEntry, error) {
+	cl := fc.NewClient()
+	defer cl.Close()
+	var entries []*fc.AuditEntry
+	var prevHash []byte
+	for {
+		reply, err := cl.GetAuditLog(si, len(entries), 1000, prevHash)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, reply.Entries...)
+		if len(entries) >= reply.Length || len(reply.Entries) == 0 {
+			break
+		}
+		prevHash = entries[len(entries)-1].Hash
+	}
+	return entries, nil
+}
+
+// ListWrites returns all writes on si that can be read by reader, or all
+// writes if reader is nil, fetching them pageSize at a time. sk is the key
+// of reader, or the identity key of si if reader is nil.
+func ListWrites(si *network.ServerIdentity, reader kyber.Point, sk kyber.Scalar, pageSize int) ([]*fc.WriteInfo, error) {
+	cl := fc.NewClient()
+	defer cl.Close()
+	var writes []*fc.WriteInfo
+	var cursor []byte
+	for {
+		reply, err := cl.ListWrites(si, reader, sk, cursor, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		writes = append(writes, reply.Writes...)
+		if len(reply.Next) == 0 {
+			break
+		}
+		cursor = reply.Next
+	}
+	return writes, nil
+}
+
+// CountWrites returns the number of writes on si that can be read by
+// reader, or of all writes if reader is nil. sk is the key of reader, or
+// the identity key of si if reader is nil.
+func CountWrites(si *network.ServerIdentity, reader kyber.Point, sk kyber.Scalar) (int, error) {
+	cl := fc.NewClient()
+	defer cl.Close()
+	return cl.CountWrites(si, reader, sk)
+}
+
+// DeleteWrite removes the write from all replicas.
+func DeleteWrite(roster *onet.Roster, wID string, version int, ownerSk kyber.Scalar, quorum int) error {
+	cl := fc.NewReplicatedClient(quorum)
+	defer cl.Close()
+	msg, err := fc.DeleteMessage(wID, version)
+	if err != nil {
+		return err
+	}
+	sig, err := schnorr.Sign(cothority.Suite, ownerSk, msg)
+	if err != nil {
+		return err
+	}
+	_, err = cl.Delete(roster, &fc.DeleteRequest{
+		WriteID: wID,
+		Version: version,
+		Sig:     sig,
+	})
+	return err
+}
+
+// GetServerKeys returns the encryption keys of all members of the roster,
+// in the order of the roster.
+func GetServerKeys(roster *onet.Roster) ([]kyber.Point, error) {
+	cl := fc.NewClient()
+	defer cl.Close()
+	keys := make([]kyber.Point, len(roster.List))
+	for i, si := range roster.List {
+		pk, err := cl.GetKey(si)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = pk
+	}
+	return keys, nil
+}
+
+// SetWriterQuota registers writer on si with quota q, or changes its
+// quota. Once a writer is registered, si only accepts writes signed by
+// registered writers. adminSk is the identity key of si.
+func SetWriterQuota(si *network.ServerIdentity, adminSk kyber.Scalar, writer kyber.Point, q util.Quota) (int64, error) {
+	cl := fc.NewClient()
+	defer cl.Close()
+	reply, err := cl.SetWriter(si, adminSk, writer, q, false)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Used, nil
+}
+
+// RemoveWriter removes the registration of writer on si.
+func RemoveWriter(si *network.ServerIdentity, adminSk kyber.Scalar, writer kyber.Point) error {
+	cl := fc.NewClient()
+	defer cl.Close()
+	_, err := cl.SetWriter(si, adminSk, writer, util.Quota{}, true)
+	return err
+}
+
+// RotateServerKey makes si replace its encryption key and returns the new
+// key. adminSk is the identity key of si.
+func RotateServerKey(si *network.ServerIdentity, adminSk kyber.Scalar) (kyber.Point, error) {
+	cl := fc.NewClient()
+	defer cl.Close()
+	reply, err := cl.RotateKey(si, adminSk)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Public, nil
+}
+
+// CreateChunkedWriteTxn stores the write like CreateReplicatedWriteTxn, but
+// uploads its data in chunks, so that it can be larger than one message.
+func CreateChunkedWriteTxn(roster *onet.Roster, wd *util.WriteData, quorum int) (*util.WriteData, error) {
+	if !bytes.Equal(wd.DataHash, util.DataHash(wd.Data)) {
+		return wd, errors.New("Data hash is not the Merkle root of the chunks")
+	}
+	wd.Chunked = true
+	return createWriteTxn(fc.NewReplicatedClient(quorum), roster, wd, nil)
+}
+
+// DownloadData fetches the data of a write from si and writes it to w.
+func DownloadData(si *network.ServerIdentity, wID string, w io.Writer) error {
+	cl := fc.NewClient()
+	defer cl.Close()
+	return cl.Download(si, wID, w)
+}
+
+// ReadChunk fetches the chunk with the given index of the data of a write
+// from si and verifies it against the write ID.
+func ReadChunk(si *network.ServerIdentity, wID string, index int) ([]byte, error) {
+	cl := fc.NewClient()
+	defer cl.Close()
+	return cl.ReadChunk(si, wID, index)
+}
@@ -6,15 +6,47 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	fc "github.com/ceyhunalp/calypso_experiments/fully_centralized"
 	"github.com/ceyhunalp/calypso_experiments/util"
 	"github.com/dedis/cothority"
 	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/encoding"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 )
 
+func runReplicatedCalypso(roster *onet.Roster, quorum int, data []byte) error {
+	rSk := cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
+	rPk := cothority.Suite.Point().Mul(rSk, nil)
+
+	serverKeys, err := fc.GetServerKeys(roster)
+	if err != nil {
+		return err
+	}
+	wd, err := util.CreateReplicatedWriteData(data, rPk, serverKeys, false)
+	if err != nil {
+		return err
+	}
+	wd, err = fc.CreateReplicatedWriteTxn(roster, wd, quorum)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Replicated write transaction success:", wd.StoredKey)
+
+	kRead, cRead, err := fc.CreateReplicatedReadTxn(roster, wd, rSk, quorum)
+	if err != nil {
+		return err
+	}
+	recvData, err := util.RecoverData(wd.Data, rSk, kRead, cRead)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(recvData[:]))
+	return nil
+}
+
 func runFullyCentralizedCalypso(roster *onet.Roster, serverKey kyber.Point, data []byte) error {
 	//data := []byte("On Wisconsin!")
 	// Reader keys
@@ -34,20 +66,54 @@ func runFullyCentralizedCalypso(roster *onet.Roster, serverKey kyber.Point, data
 	}
 	fmt.Println("Write transaction success:", wd.StoredKey)
 
-	// Create read transaction
-	kRead, cRead, err := fc.CreateReadTxn(roster, wd.StoredKey, rSk)
+	// Create read transaction, fetching the data from the server
+	recvData, err := fc.CreateReadDataTxn(roster, wd, rSk)
 	if err != nil {
 		os.Exit(1)
 	}
+	fmt.Println(string(recvData[:]))
+	return nil
+}
 
-	recvData, err := util.RecoverData(wd.Data, rSk, kRead, cRead)
+func listWrites(roster *onet.Roster, reader kyber.Point, sk kyber.Scalar) error {
+	writes, err := fc.ListWrites(roster.List[0], reader, sk, 100)
 	if err != nil {
-		os.Exit(1)
+		return err
 	}
-	fmt.Println(string(recvData[:]))
+	for _, w := range writes {
+		fmt.Printf("%s\t%s\tversion=%d\trevoked=%v\n", w.WriteID,
+			time.Unix(w.WriteTime, 0).Format(time.RFC3339), w.Version, w.Revoked)
+	}
+	return nil
+}
+
+func countWrites(roster *onet.Roster, reader kyber.Point, sk kyber.Scalar) error {
+	count, err := fc.CountWrites(roster.List[0], reader, sk)
+	if err != nil {
+		return err
+	}
+	fmt.Println(count)
 	return nil
 }
 
+// rotateKey rotates the encryption key of the first member of the roster
+// and publishes the new key in pkFile.
+func rotateKey(roster *onet.Roster, privFile string, pkFile string) error {
+	adminSk, err := util.ReadPrivateKey(privFile)
+	if err != nil {
+		return err
+	}
+	pk, err := fc.RotateServerKey(roster.List[0], adminSk)
+	if err != nil {
+		return err
+	}
+	fmt.Println("New server key:", pk)
+	if pkFile == "" {
+		return nil
+	}
+	return util.WriteServerKey(pkFile, pk)
+}
+
 //func getServerKey(pkPtr *string) (kyber.Point, error) {
 //return util.GetServerKey(pkPtr)
 //}
@@ -60,6 +126,10 @@ func main() {
 	pkPtr := flag.String("p", "", "pk.txt file")
 	dbgPtr := flag.Int("d", 0, "debug level")
 	filePtr := flag.String("r", "", "roster.toml file")
+	quorumPtr := flag.Int("q", 0, "write quorum (0 disables replication)")
+	cmdPtr := flag.String("cmd", "run", "command: run, list, count or rotate")
+	privPtr := flag.String("priv", "", "private.toml of the conode for rotate, and for list and count of all writes")
+	readerPtr := flag.String("reader", "", "reader private key in hex for list and count (all writes if empty)")
 	flag.Parse()
 	log.SetDebugVisible(*dbgPtr)
 
@@ -67,6 +137,53 @@ func main() {
 	if err != nil {
 		os.Exit(1)
 	}
+	switch *cmdPtr {
+	case "run":
+	case "list", "count":
+		var reader kyber.Point
+		var sk kyber.Scalar
+		if *readerPtr != "" {
+			sk, err = encoding.StringHexToScalar(cothority.Suite, *readerPtr)
+			if err != nil {
+				log.Errorf("Invalid reader key: %v", err)
+				os.Exit(1)
+			}
+			reader = cothority.Suite.Point().Mul(sk, nil)
+		} else {
+			sk, err = util.ReadPrivateKey(*privPtr)
+			if err != nil {
+				os.Exit(1)
+			}
+		}
+		if *cmdPtr == "list" {
+			err = listWrites(roster, reader, sk)
+		} else {
+			err = countWrites(roster, reader, sk)
+		}
+		if err != nil {
+			log.Errorf("Command %s failed: %v", *cmdPtr, err)
+			os.Exit(1)
+		}
+		return
+	case "rotate":
+		err = rotateKey(roster, *privPtr, *pkPtr)
+		if err != nil {
+			log.Errorf("Command rotate failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	default:
+		log.Errorf("Unknown command: %s", *cmdPtr)
+		os.Exit(1)
+	}
+	if *quorumPtr > 0 {
+		err = runReplicatedCalypso(roster, *quorumPtr, []byte("On Wisconsin!"))
+		if err != nil {
+			log.Errorf("Run ReplicatedCalypso failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
 	serverKey, err := util.GetServerKey(pkPtr)
 	if err != nil {
 		os.Exit(1)
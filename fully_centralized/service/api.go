@@ -9,15 +9,29 @@ This part of the service runs on the client or the app.
 */
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
 	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
 )
 
 // Client is a structure to communicate with the template
 // service
 type Client struct {
 	*onet.Client
+	// quorum is the number of roster members that have to store a write.
+	// If it is 0, only the first member of the roster is used.
+	quorum int
 }
 
 // NewClient instantiates a new template.Client
@@ -25,24 +39,424 @@ func NewClient() *Client {
 	return &Client{Client: onet.NewClient(cothority.Suite, ServiceName)}
 }
 
+// NewReplicatedClient instantiates a client that stores every write on all
+// members of the roster and considers it successful once quorum of them
+// acknowledged it. Reads are sent to the roster members in turn until one
+// of them answers.
+func NewReplicatedClient(quorum int) *Client {
+	return &Client{Client: onet.NewClient(cothority.Suite, ServiceName), quorum: quorum}
+}
+
+// replicas returns the roster members that hold the writes of this client.
+func (c *Client) replicas(r *onet.Roster) ([]*network.ServerIdentity, error) {
+	if len(r.List) == 0 {
+		return nil, errors.New("Empty roster")
+	}
+	if c.quorum == 0 {
+		return r.List[:1], nil
+	}
+	if c.quorum < 0 || c.quorum > len(r.List) {
+		return nil, fmt.Errorf("Invalid quorum %d for a roster of size %d", c.quorum, len(r.List))
+	}
+	return r.List, nil
+}
+
+// sendQuorum sends msg to every replica in parallel and returns the first
+// successful reply once the quorum is reached. newReply has to return a
+// fresh reply structure for each replica.
+func (c *Client) sendQuorum(r *onet.Roster, msg interface{}, newReply func() interface{}) (interface{}, error) {
+	return c.forQuorum(r, func(dest *network.ServerIdentity) (interface{}, error) {
+		log.Lvl3("Sending message to", dest)
+		reply := newReply()
+		err := c.SendProtobuf(dest, msg, reply)
+		return reply, err
+	})
+}
+
+// forQuorum calls f for every replica in parallel and returns the first
+// successful result as soon as the quorum is reached, or an error as soon
+// as too many replicas failed to reach it. The calls that are still running
+// finish in the background.
+func (c *Client) forQuorum(r *onet.Roster, f func(*network.ServerIdentity) (interface{}, error)) (interface{}, error) {
+	dests, err := c.replicas(r)
+	if err != nil {
+		return nil, err
+	}
+	quorum := c.quorum
+	if quorum == 0 {
+		quorum = 1
+	}
+	type result struct {
+		dest  *network.ServerIdentity
+		reply interface{}
+		err   error
+	}
+	// The channel holds all results, so that the late calls do not block.
+	results := make(chan result, len(dests))
+	for _, dest := range dests {
+		go func(dest *network.ServerIdentity) {
+			reply, err := f(dest)
+			results <- result{dest, reply, err}
+		}(dest)
+	}
+
+	var first interface{}
+	var lastErr error
+	acks, fails := 0, 0
+	for range dests {
+		res := <-results
+		if res.err != nil {
+			log.Lvlf2("Replica %v failed: %v", res.dest, res.err)
+			lastErr = res.err
+			if fails++; len(dests)-fails < quorum {
+				return nil, fmt.Errorf("Only %d out of %d replicas can answer, need %d: %v",
+					len(dests)-fails, len(dests), quorum, lastErr)
+			}
+			continue
+		}
+		if first == nil {
+			first = res.reply
+		}
+		if acks++; acks == quorum {
+			return first, nil
+		}
+	}
+	return nil, fmt.Errorf("Only %d out of %d replicas answered, need %d: %v", acks, len(dests), quorum, lastErr)
+}
+
+// sendAny sends msg to the replicas one after the other and returns the
+// reply of the first one that answers without an error.
+func (c *Client) sendAny(r *onet.Roster, msg interface{}, reply interface{}) error {
+	dests, err := c.replicas(r)
+	if err != nil {
+		return err
+	}
+	for _, dest := range dests {
+		log.Lvl3("Sending message to", dest)
+		err = c.SendProtobuf(dest, msg, reply)
+		if err == nil {
+			return nil
+		}
+		log.Lvlf2("Replica %v failed: %v", dest, err)
+	}
+	return err
+}
+
 func (c *Client) Write(r *onet.Roster, wr *WriteRequest) (*WriteReply, error) {
-	dest := r.List[0]
-	log.Lvl3("Sending message to", dest)
-	reply := &WriteReply{}
-	err := c.SendProtobuf(dest, wr, reply)
+	reply, err := c.sendQuorum(r, wr, func() interface{} { return &WriteReply{} })
 	if err != nil {
 		return nil, err
 	}
-	return reply, nil
+	return reply.(*WriteReply), nil
 }
 
 func (c *Client) Read(r *onet.Roster, rr *ReadRequest) (*ReadReply, error) {
-	dest := r.List[0]
-	log.Lvl3("Sending message to", dest)
 	reply := &ReadReply{}
-	err := c.SendProtobuf(dest, rr, reply)
+	err := c.sendAny(r, rr, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// WriteBatch stores a batch of writes on all replicas. The per-item
+// results are those of the first replica that answered.
+func (c *Client) WriteBatch(r *onet.Roster, req *WriteBatchRequest) (*WriteBatchReply, error) {
+	reply, err := c.sendQuorum(r, req, func() interface{} { return &WriteBatchReply{} })
+	if err != nil {
+		return nil, err
+	}
+	return reply.(*WriteBatchReply), nil
+}
+
+// ReadBatch asks one replica for the re-encryption of a batch of writes.
+func (c *Client) ReadBatch(r *onet.Roster, req *ReadBatchRequest) (*ReadBatchReply, error) {
+	reply := &ReadBatchReply{}
+	err := c.sendAny(r, req, reply)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Replies) != len(req.Reads) || len(reply.Errors) != len(req.Reads) {
+		return nil, errors.New("Wrong number of replies in batch")
+	}
+	return reply, nil
+}
+
+// UpdatePolicy changes the reader on all replicas of the write.
+func (c *Client) UpdatePolicy(r *onet.Roster, req *UpdatePolicyRequest) (*UpdatePolicyReply, error) {
+	reply, err := c.sendQuorum(r, req, func() interface{} { return &UpdatePolicyReply{} })
+	if err != nil {
+		return nil, err
+	}
+	return reply.(*UpdatePolicyReply), nil
+}
+
+// Revoke revokes read access on all replicas of the write.
+func (c *Client) Revoke(r *onet.Roster, req *RevokeRequest) (*RevokeReply, error) {
+	reply, err := c.sendQuorum(r, req, func() interface{} { return &RevokeReply{} })
+	if err != nil {
+		return nil, err
+	}
+	return reply.(*RevokeReply), nil
+}
+
+// Delete removes the write from all replicas.
+func (c *Client) Delete(r *onet.Roster, req *DeleteRequest) (*DeleteReply, error) {
+	reply, err := c.sendQuorum(r, req, func() interface{} { return &DeleteReply{} })
+	if err != nil {
+		return nil, err
+	}
+	return reply.(*DeleteReply), nil
+}
+
+// uploadRetries is how often an upload to one server is resumed before it
+// is given up.
+const uploadRetries = 3
+
+// WriteChunked uploads data in chunks to every replica and stores wr with
+// it. The DataHash of wr has to be the Merkle root of the chunks of data.
+// If writers are registered, sk is the key of the owner of wr, which signs
+// the chunks, and it can be nil otherwise.
+func (c *Client) WriteChunked(r *onet.Roster, wr *WriteRequest, data []byte, sk kyber.Scalar) (*WriteReply, error) {
+	reply, err := c.forQuorum(r, func(dest *network.ServerIdentity) (interface{}, error) {
+		id, err := c.BeginUpload(dest, data, wr)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; ; i++ {
+			err = c.ResumeUpload(dest, id, data, sk)
+			if err == nil {
+				break
+			}
+			if i == uploadRetries {
+				return nil, err
+			}
+			log.Lvlf2("Upload to %v interrupted, resuming: %v", dest, err)
+		}
+		return c.FinishUpload(dest, id, wr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply.(*WriteReply), nil
+}
+
+// BeginUpload starts the upload of data to si and returns the ID of the
+// upload session. The upload is authenticated with the signature of wr.
+func (c *Client) BeginUpload(si *network.ServerIdentity, data []byte, wr *WriteRequest) (string, error) {
+	reply := &BeginUploadReply{}
+	req := &BeginUploadRequest{Size: int64(len(data)), ChunkHashes: util.ChunkHashes(data), Write: wr}
+	if err := c.SendProtobuf(si, req, reply); err != nil {
+		return "", err
+	}
+	return reply.SessionID, nil
+}
+
+// ResumeUpload sends the chunks of data that si has not received yet in the
+// upload session. If sk is not nil, the chunks are signed with it.
+func (c *Client) ResumeUpload(si *network.ServerIdentity, sessionID string, data []byte, sk kyber.Scalar) error {
+	status := &UploadStatusReply{}
+	err := c.SendProtobuf(si, &UploadStatusRequest{SessionID: sessionID}, status)
+	if err != nil {
+		return err
+	}
+	for _, i := range status.Missing {
+		req := &UploadChunkRequest{SessionID: sessionID, Index: i, Data: util.DataChunk(data, i)}
+		if req.Sig, err = util.SignChunk(sk, sessionID, i, req.Data); err != nil {
+			return err
+		}
+		if err = c.SendProtobuf(si, req, &UploadChunkReply{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FinishUpload stores wr with the data of a complete upload session.
+func (c *Client) FinishUpload(si *network.ServerIdentity, sessionID string, wr *WriteRequest) (*WriteReply, error) {
+	reply := &WriteReply{}
+	err := c.SendProtobuf(si, &FinishUploadRequest{SessionID: sessionID, Write: wr}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Download fetches the data of a write from si chunk by chunk, verifies it
+// against the write ID and writes it to w.
+func (c *Client) Download(si *network.ServerIdentity, wID string, w io.Writer) error {
+	root, err := hex.DecodeString(wID)
+	if err != nil {
+		return err
+	}
+	info := &GetChunkInfoReply{}
+	err = c.SendProtobuf(si, &GetChunkInfoRequest{WriteID: wID}, info)
+	if err != nil {
+		return err
+	}
+	return util.DownloadChunks(root, info.ChunkHashes, func(i int) ([]byte, error) {
+		reply := &GetChunkReply{}
+		err := c.SendProtobuf(si, &GetChunkRequest{WriteID: wID, Index: i}, reply)
+		return reply.Data, err
+	}, w)
+}
+
+// ReadChunk fetches the chunk with the given index of the data of a write
+// from si, and verifies it against the write ID with its Merkle path.
+func (c *Client) ReadChunk(si *network.ServerIdentity, wID string, index int) ([]byte, error) {
+	root, err := hex.DecodeString(wID)
+	if err != nil {
+		return nil, err
+	}
+	reply := &GetChunkReply{}
+	err = c.SendProtobuf(si, &GetChunkRequest{WriteID: wID, Index: index}, reply)
+	if err != nil {
+		return nil, err
+	}
+	err = util.VerifyChunk(root, reply.Size, index, &util.ChunkProof{Chunk: reply.Data, Path: reply.Path})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Data, nil
+}
+
+// GetKey returns the encryption key of si, after checking that it is signed
+// by the identity key of si.
+func (c *Client) GetKey(si *network.ServerIdentity) (kyber.Point, error) {
+	reply := &GetKeyReply{}
+	err := c.SendProtobuf(si, &GetKeyRequest{}, reply)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := util.KeyMessage(reply.Public)
+	if err != nil {
+		return nil, err
+	}
+	if err = schnorr.Verify(cothority.Suite, si.Public, msg, reply.Sig); err != nil {
+		return nil, errors.New("Invalid signature on server key: " + err.Error())
+	}
+	return reply.Public, nil
+}
+
+// RotateKey makes si replace its encryption key. adminSk is the identity
+// key of si.
+func (c *Client) RotateKey(si *network.ServerIdentity, adminSk kyber.Scalar) (*RotateKeyReply, error) {
+	current, err := c.GetKey(si)
+	if err != nil {
+		return nil, err
+	}
+	data, err := rotateData(current)
+	if err != nil {
+		return nil, err
+	}
+	ts := time.Now().Unix()
+	sig, err := schnorr.Sign(cothority.Suite, adminSk, util.AdminMessage(rotateAction, ts, data))
+	if err != nil {
+		return nil, err
+	}
+	reply := &RotateKeyReply{}
+	err = c.SendProtobuf(si, &RotateKeyRequest{Timestamp: ts, Sig: sig}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// SetWriter registers writer on si with quota q, or removes it. adminSk is
+// the identity key of si. The request is bound to the current version of
+// the writers of si, so that it cannot be replayed after a later change.
+func (c *Client) SetWriter(si *network.ServerIdentity, adminSk kyber.Scalar, writer kyber.Point, q util.Quota, remove bool) (*SetWriterReply, error) {
+	cur, err := c.GetWriter(si, writer)
+	if err != nil {
+		return nil, err
+	}
+	data, err := util.WriterData(writer, q, remove, cur.Version)
+	if err != nil {
+		return nil, err
+	}
+	ts := time.Now().Unix()
+	sig, err := schnorr.Sign(cothority.Suite, adminSk, util.AdminMessage(util.WriterAction, ts, data))
 	if err != nil {
 		return nil, err
 	}
+	reply := &SetWriterReply{}
+	req := &SetWriterRequest{Writer: writer, Quota: q, Remove: remove, Version: cur.Version, Timestamp: ts, Sig: sig}
+	if err = c.SendProtobuf(si, req, reply); err != nil {
+		return nil, err
+	}
 	return reply, nil
 }
+
+// GetWriter returns the registration of writer on si.
+func (c *Client) GetWriter(si *network.ServerIdentity, writer kyber.Point) (*GetWriterReply, error) {
+	reply := &GetWriterReply{}
+	if err := c.SendProtobuf(si, &GetWriterRequest{Writer: writer}, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetAuditLog fetches count entries of the audit log of si, starting at
+// index start, and verifies that they are correctly chained. prevHash is
+// the hash of the entry before start, or nil if start is 0.
+func (c *Client) GetAuditLog(si *network.ServerIdentity, start, count int, prevHash []byte) (*GetAuditLogReply, error) {
+	reply := &GetAuditLogReply{}
+	err := c.SendProtobuf(si, &GetAuditLogRequest{Start: start, Count: count}, reply)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Entries) > 0 && reply.Entries[0].Index != start {
+		return nil, errors.New("Audit log does not start at the requested index")
+	}
+	last, err := VerifyAuditLog(reply.Entries, prevHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Entries) > 0 && reply.Entries[len(reply.Entries)-1].Index == reply.Length-1 &&
+		!bytes.Equal(last, reply.Head) {
+		return nil, errors.New("Audit log does not end at the head")
+	}
+	return reply, nil
+}
+
+// ListWrites returns one page of the writes on si that can be read by
+// reader, or of all writes if reader is nil. sk is the key of reader, or
+// the identity key of si if reader is nil.
+func (c *Client) ListWrites(si *network.ServerIdentity, reader kyber.Point, sk kyber.Scalar, cursor []byte, limit int) (*ListWritesReply, error) {
+	ts := time.Now().Unix()
+	sig, err := signReader(ListAction, reader, sk, ts)
+	if err != nil {
+		return nil, err
+	}
+	reply := &ListWritesReply{}
+	req := &ListWritesRequest{Reader: reader, Cursor: cursor, Limit: limit, Timestamp: ts, Sig: sig}
+	if err = c.SendProtobuf(si, req, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// CountWrites returns the number of writes on si that can be read by
+// reader, or of all writes if reader is nil. sk is the key of reader, or
+// the identity key of si if reader is nil.
+func (c *Client) CountWrites(si *network.ServerIdentity, reader kyber.Point, sk kyber.Scalar) (int, error) {
+	ts := time.Now().Unix()
+	sig, err := signReader(CountAction, reader, sk, ts)
+	if err != nil {
+		return 0, err
+	}
+	reply := &CountWritesReply{}
+	req := &CountWritesRequest{Reader: reader, Timestamp: ts, Sig: sig}
+	if err = c.SendProtobuf(si, req, reply); err != nil {
+		return 0, err
+	}
+	return reply.Count, nil
+}
+
+func signReader(action string, reader kyber.Point, sk kyber.Scalar, ts int64) ([]byte, error) {
+	msg, err := ReaderMessage(action, reader, ts)
+	if err != nil {
+		return nil, err
+	}
+	return schnorr.Sign(cothority.Suite, sk, msg)
+}
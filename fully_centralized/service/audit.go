@@ -0,0 +1,147 @@
+package service
+
+/*
+The audit.go keeps a hash-chained log of all successful reads, so that the
+accesses to the secrets stored on a server can be checked afterwards.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// maxAuditEntries is the maximum number of entries returned by one
+// GetAuditLog request.
+const maxAuditEntries = 1000
+
+// ComputeHash returns the hash of the entry, without its Hash field.
+func (ae *AuditEntry) ComputeHash() ([]byte, error) {
+	readerBytes, err := ae.Reader.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, int64(ae.Index))
+	h.Write(readerBytes)
+	h.Write([]byte(ae.WriteID))
+	binary.Write(h, binary.LittleEndian, ae.Timestamp)
+	h.Write(ae.PrevHash)
+	return h.Sum(nil), nil
+}
+
+// VerifyAuditLog checks that the entries are consecutive, that their hashes
+// are correct and that they are chained, starting from prevHash. prevHash
+// is nil if entries starts at the first entry of the log. It returns the
+// hash of the last entry.
+func VerifyAuditLog(entries []*AuditEntry, prevHash []byte) ([]byte, error) {
+	for i, ae := range entries {
+		if i > 0 && ae.Index != entries[i-1].Index+1 {
+			return nil, fmt.Errorf("Entry %d is not consecutive", ae.Index)
+		}
+		if !bytes.Equal(ae.PrevHash, prevHash) {
+			return nil, fmt.Errorf("Entry %d is not chained to the previous one", ae.Index)
+		}
+		h, err := ae.ComputeHash()
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(h, ae.Hash) {
+			return nil, fmt.Errorf("Entry %d has a wrong hash", ae.Index)
+		}
+		prevHash = ae.Hash
+	}
+	return prevHash, nil
+}
+
+func auditKey(index int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(index))
+	return key
+}
+
+func decodeAuditEntry(val []byte) (*AuditEntry, error) {
+	buf := make([]byte, len(val))
+	copy(buf, val)
+	_, msg, err := network.Unmarshal(buf, cothority.Suite)
+	if err != nil {
+		return nil, err
+	}
+	ae, ok := msg.(*AuditEntry)
+	if !ok {
+		return nil, errors.New("Data of wrong type")
+	}
+	return ae, nil
+}
+
+// appendAuditTx appends a new entry at the end of the audit log.
+func (cdb *CentralizedCalypsoDB) appendAuditTx(tx *bolt.Tx, reader kyber.Point, wID string, ts int64) (*AuditEntry, error) {
+	b := tx.Bucket(cdb.auditBucket)
+	ae := &AuditEntry{
+		Reader:    reader,
+		WriteID:   wID,
+		Timestamp: ts,
+	}
+	if _, last := b.Cursor().Last(); last != nil {
+		prev, err := decodeAuditEntry(last)
+		if err != nil {
+			return nil, err
+		}
+		ae.Index = prev.Index + 1
+		ae.PrevHash = prev.Hash
+	}
+	var err error
+	ae.Hash, err = ae.ComputeHash()
+	if err != nil {
+		return nil, err
+	}
+	val, err := network.Marshal(ae)
+	if err != nil {
+		return nil, err
+	}
+	return ae, b.Put(auditKey(ae.Index), val)
+}
+
+// GetAuditLog returns at most count entries starting at index start,
+// together with the length of the log and the hash of its last entry.
+func (cdb *CentralizedCalypsoDB) GetAuditLog(start, count int) (*GetAuditLogReply, error) {
+	if start < 0 || count < 0 {
+		return nil, errors.New("Invalid range")
+	}
+	if count > maxAuditEntries {
+		count = maxAuditEntries
+	}
+	reply := &GetAuditLogReply{}
+	err := cdb.DB.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(cdb.auditBucket).Cursor()
+		if _, last := c.Last(); last != nil {
+			head, err := decodeAuditEntry(last)
+			if err != nil {
+				return err
+			}
+			reply.Length = head.Index + 1
+			reply.Head = head.Hash
+		}
+		for k, v := c.Seek(auditKey(start)); k != nil && len(reply.Entries) < count; k, v = c.Next() {
+			ae, err := decodeAuditEntry(v)
+			if err != nil {
+				return err
+			}
+			reply.Entries = append(reply.Entries, ae)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("GetAuditLog error: %v", err)
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber/util/key"
+)
+
+// copyEntries returns a copy of the entries that can be changed without
+// changing the originals.
+func copyEntries(entries []*AuditEntry) []*AuditEntry {
+	c := make([]*AuditEntry, len(entries))
+	for i, ae := range entries {
+		e := *ae
+		e.Hash = append([]byte{}, ae.Hash...)
+		e.PrevHash = append([]byte{}, ae.PrevHash...)
+		c[i] = &e
+	}
+	return c
+}
+
+func TestAuditLog(t *testing.T) {
+	cdb, cleanup := newTestDB(t)
+	defer cleanup()
+	reader := key.NewKeyPair(cothority.Suite).Public
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		rr := &ReadRequest{
+			WriteID:   hex.EncodeToString([]byte{byte(i)}),
+			Timestamp: now.Unix(),
+			Nonce:     bytes.Repeat([]byte{byte(i)}, NonceLen),
+		}
+		if err := cdb.RecordRead(rr, reader, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reply, err := cdb.GetAuditLog(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Length != 4 || len(reply.Entries) != 4 {
+		t.Fatalf("Wrong length %d with %d entries", reply.Length, len(reply.Entries))
+	}
+	head, err := VerifyAuditLog(reply.Entries, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(head, reply.Head) {
+		t.Fatal("Wrong head of the log")
+	}
+	// A part of the log is verified from the hash of the entry before it.
+	part, err := cdb.GetAuditLog(2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = VerifyAuditLog(part.Entries, reply.Entries[1].Hash); err != nil {
+		t.Fatal(err)
+	}
+
+	other := key.NewKeyPair(cothority.Suite).Public
+	tests := []struct {
+		name   string
+		tamper func([]*AuditEntry) []*AuditEntry
+	}{
+		{"changed write ID", func(e []*AuditEntry) []*AuditEntry {
+			e[1].WriteID = "ff"
+			return e
+		}},
+		{"changed reader", func(e []*AuditEntry) []*AuditEntry {
+			e[2].Reader = other
+			return e
+		}},
+		{"changed timestamp", func(e []*AuditEntry) []*AuditEntry {
+			e[0].Timestamp++
+			return e
+		}},
+		{"rehashed entry", func(e []*AuditEntry) []*AuditEntry {
+			e[1].WriteID = "ff"
+			e[1].Hash, _ = e[1].ComputeHash()
+			return e
+		}},
+		{"removed entry", func(e []*AuditEntry) []*AuditEntry {
+			return append(e[:1], e[2:]...)
+		}},
+		{"swapped entries", func(e []*AuditEntry) []*AuditEntry {
+			e[1], e[2] = e[2], e[1]
+			return e
+		}},
+		{"removed first entry", func(e []*AuditEntry) []*AuditEntry {
+			return e[1:]
+		}},
+	}
+	for _, tt := range tests {
+		if _, err := VerifyAuditLog(tt.tamper(copyEntries(reply.Entries)), nil); err == nil {
+			t.Errorf("%s: tampered log was accepted", tt.name)
+		}
+	}
+}
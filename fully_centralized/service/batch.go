@@ -0,0 +1,194 @@
+package service
+
+/*
+The batch.go implements the batched writes and reads. All items of a batch
+are stored or recorded in one bolt transaction, and a failing item does not
+stop the others.
+*/
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/log"
+)
+
+// MaxBatchSize is the maximal number of items in a batch.
+const MaxBatchSize = 1024
+
+// WriteBatch stores many writes at once.
+func (s *Service) WriteBatch(req *WriteBatchRequest) (*WriteBatchReply, error) {
+	if err := checkBatchSize(len(req.Writes)); err != nil {
+		log.Errorf("WriteBatch error: %v", err)
+		return nil, err
+	}
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+	errs := make([]error, len(req.Writes))
+	now := time.Now()
+	for i, wr := range req.Writes {
+		if errs[i] = s.authWrite(wr, int64(len(wr.EncData)), now); errs[i] != nil {
+			continue
+		}
+		errs[i] = s.checkWrite(wr)
+	}
+	ids, err := s.db.StoreWrites(req.Writes, errs)
+	if err != nil {
+		log.Errorf("WriteBatch error: %v", err)
+		return nil, err
+	}
+	return &WriteBatchReply{WriteIDs: ids, Errors: errorStrings(errs)}, nil
+}
+
+// ReadBatch re-encrypts the keys of many writes at once.
+func (s *Service) ReadBatch(req *ReadBatchRequest) (*ReadBatchReply, error) {
+	if err := checkBatchSize(len(req.Reads)); err != nil {
+		log.Errorf("ReadBatch error: %v", err)
+		return nil, err
+	}
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+	wIDs := make([]string, len(req.Reads))
+	for i, rr := range req.Reads {
+		wIDs[i] = rr.WriteID
+	}
+	writes, errs, err := s.db.GetWrites(wIDs)
+	if err != nil {
+		log.Errorf("ReadBatch error: %v", err)
+		return nil, err
+	}
+	replies := make([]*ReadReply, len(req.Reads))
+	readers := make([]kyber.Point, len(req.Reads))
+	for i, rr := range req.Reads {
+		if errs[i] != nil {
+			continue
+		}
+		replies[i], errs[i] = s.reencrypt(rr, writes[i])
+		readers[i] = readerOf(rr, writes[i])
+	}
+	if err = s.db.RecordReads(req.Reads, readers, errs, time.Now()); err != nil {
+		log.Errorf("ReadBatch error: %v", err)
+		return nil, err
+	}
+	for i, rr := range req.Reads {
+		if errs[i] == nil && rr.IncludeData {
+			errs[i] = s.readData(writes[i], rr.Offset, rr.Length, replies[i])
+		}
+		if errs[i] != nil {
+			replies[i] = &ReadReply{}
+		}
+	}
+	return &ReadBatchReply{Replies: replies, Errors: errorStrings(errs)}, nil
+}
+
+func checkBatchSize(n int) error {
+	if n == 0 || n > MaxBatchSize {
+		return fmt.Errorf("Batch size has to be between 1 and %d", MaxBatchSize)
+	}
+	return nil
+}
+
+// errorStrings returns the messages of errs, with an empty string for every
+// nil error.
+func errorStrings(errs []error) []string {
+	strs := make([]string, len(errs))
+	for i, err := range errs {
+		if err != nil {
+			strs[i] = err.Error()
+		}
+	}
+	return strs
+}
+
+// StoreWrites stores the writes with inline data whose entry in errs is
+// nil, in a single transaction. The errors of the writes that cannot be
+// stored are set in errs. An error is only returned if the transaction
+// failed, in which case none of the writes is stored.
+func (cdb *CentralizedCalypsoDB) StoreWrites(reqs []*WriteRequest, errs []error) ([]string, error) {
+	vals := make([][]byte, len(reqs))
+	for i, req := range reqs {
+		if errs[i] != nil {
+			continue
+		}
+		if errs[i] = checkDataHash(req); errs[i] != nil {
+			continue
+		}
+		req.Chunked = false
+		vals[i], errs[i] = prepareWrite(req, int64(len(req.EncData)))
+	}
+	ids := make([]string, len(reqs))
+	err := cdb.DB.Update(func(tx *bolt.Tx) error {
+		for i, req := range reqs {
+			if errs[i] != nil {
+				continue
+			}
+			if errs[i] = cdb.checkNewTx(tx, req.DataHash); errs[i] != nil {
+				continue
+			}
+			if errs[i] = cdb.writers.ChargeTx(tx, req.Owner, req.Charged); errs[i] != nil {
+				continue
+			}
+			if err := cdb.storeWriteTx(tx, req, vals[i]); err != nil {
+				return err
+			}
+			ids[i] = hex.EncodeToString(req.DataHash)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("StoreWrites error: %v", err)
+		return nil, err
+	}
+	return ids, nil
+}
+
+// GetWrites returns the writes with the given IDs, read in a single
+// transaction. The second return value holds the error of every write that
+// cannot be read.
+func (cdb *CentralizedCalypsoDB) GetWrites(wIDs []string) ([]*WriteRequest, []error, error) {
+	writes := make([]*WriteRequest, len(wIDs))
+	errs := make([]error, len(wIDs))
+	err := cdb.DB.View(func(tx *bolt.Tx) error {
+		for i, wID := range wIDs {
+			key, err := hex.DecodeString(wID)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			writes[i], errs[i] = cdb.getFromTx(tx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("GetWrites error: %v", err)
+		return nil, nil, err
+	}
+	return writes, errs, nil
+}
+
+// RecordReads does the same as RecordRead for every read whose entry in
+// errs is nil, in a single transaction. Reads with a spent nonce get their
+// error set in errs.
+func (cdb *CentralizedCalypsoDB) RecordReads(rrs []*ReadRequest, readers []kyber.Point, errs []error, now time.Time) error {
+	err := cdb.DB.Update(func(tx *bolt.Tx) error {
+		for i, rr := range rrs {
+			if errs[i] != nil {
+				continue
+			}
+			if errs[i] = cdb.spendNonceTx(tx, rr.Timestamp, rr.Nonce, now); errs[i] != nil {
+				continue
+			}
+			if _, err := cdb.appendAuditTx(tx, readers[i], rr.WriteID, now.Unix()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("RecordReads error: %v", err)
+	}
+	return err
+}
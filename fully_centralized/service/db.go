@@ -0,0 +1,70 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/log"
+)
+
+// ReadWindow is how far the timestamp of a read request may be from the
+// time of the server.
+const ReadWindow = 5 * time.Minute
+
+// NonceLen is the minimal length of the nonce of a read request.
+const NonceLen = 16
+
+// nonceKey returns the key under which a spent nonce is stored. Keys start
+// with the big endian timestamp so that they are sorted by time.
+func nonceKey(ts int64, nonce []byte) []byte {
+	key := make([]byte, 8+len(nonce))
+	binary.BigEndian.PutUint64(key, uint64(ts))
+	copy(key[8:], nonce)
+	return key
+}
+
+// RecordRead spends the nonce of a successful read request and appends the
+// read to the audit log, in a single transaction.
+func (cdb *CentralizedCalypsoDB) RecordRead(rr *ReadRequest, reader kyber.Point, now time.Time) error {
+	err := cdb.DB.Update(func(tx *bolt.Tx) error {
+		if err := cdb.spendNonceTx(tx, rr.Timestamp, rr.Nonce, now); err != nil {
+			return err
+		}
+		_, err := cdb.appendAuditTx(tx, reader, rr.WriteID, now.Unix())
+		return err
+	})
+	if err != nil {
+		log.Errorf("RecordRead error: %v", err)
+	}
+	return err
+}
+
+// spendNonceTx records the nonce of a read request and fails if it has been
+// used before. Nonces whose timestamps are outside of the read window are
+// removed, as requests using them are rejected anyway.
+func (cdb *CentralizedCalypsoDB) spendNonceTx(tx *bolt.Tx, ts int64, nonce []byte, now time.Time) error {
+	key := nonceKey(ts, nonce)
+	b := tx.Bucket(cdb.nonceBucket)
+	if b.Get(key) != nil {
+		return errors.New("Nonce has already been used")
+	}
+	if err := b.Put(key, []byte{}); err != nil {
+		return err
+	}
+	limit := nonceKey(now.Add(-ReadWindow).Unix(), nil)
+	var expired [][]byte
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k[:8], limit) < 0; k, _ = c.Next() {
+		expired = append(expired, append([]byte{}, k...))
+	}
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
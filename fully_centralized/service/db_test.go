@@ -0,0 +1,98 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+// newTestDB returns a CentralizedCalypsoDB in a temporary directory, and a
+// function that removes it.
+func newTestDB(t *testing.T) (*CentralizedCalypsoDB, func()) {
+	dir, err := ioutil.TempDir("", "centralized")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "db"), 0600, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	bn := []byte("test")
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bn)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdb, err := NewCentralizedCalypsoDB(db, bn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cdb, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestVerifyFreshness(t *testing.T) {
+	now := time.Now()
+	nonce := bytes.Repeat([]byte{1}, NonceLen)
+	tests := []struct {
+		name  string
+		nonce []byte
+		ts    time.Time
+		ok    bool
+	}{
+		{"fresh", nonce, now, true},
+		{"edge of the window", nonce, now.Add(-ReadWindow + 2*time.Second), true},
+		{"short nonce", nonce[1:], now, false},
+		{"too old", nonce, now.Add(-ReadWindow - time.Second), false},
+		{"in the future", nonce, now.Add(ReadWindow + time.Second), false},
+	}
+	for _, tt := range tests {
+		err := verifyFreshness(&ReadRequest{Nonce: tt.nonce, Timestamp: tt.ts.Unix()}, now)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+}
+
+func TestSpendNonce(t *testing.T) {
+	cdb, cleanup := newTestDB(t)
+	defer cleanup()
+	now := time.Now()
+	old := now.Add(-2 * ReadWindow)
+	spend := func(ts time.Time, nonce byte, at time.Time) error {
+		return cdb.DB.Update(func(tx *bolt.Tx) error {
+			return cdb.spendNonceTx(tx, ts.Unix(), bytes.Repeat([]byte{nonce}, NonceLen), at)
+		})
+	}
+	tests := []struct {
+		name  string
+		ts    time.Time
+		nonce byte
+		at    time.Time
+		ok    bool
+	}{
+		{"old nonce", old, 1, old, true},
+		{"new nonce", now, 1, now, true},
+		{"replay", now, 1, now, false},
+		{"other nonce", now, 2, now, true},
+		{"same nonce at another time", now.Add(time.Second), 1, now, true},
+		// The first nonce was removed once it left the window.
+		{"expired nonce", old, 1, now, true},
+	}
+	for _, tt := range tests {
+		err := spend(tt.ts, tt.nonce, tt.at)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+}
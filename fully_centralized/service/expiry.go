@@ -0,0 +1,185 @@
+package service
+
+/*
+The expiry.go removes writes from the database, either because the owner
+deletes them or because their TTL ran out.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/onet/log"
+)
+
+// SweepInterval is how often the service purges expired writes.
+var SweepInterval = time.Minute
+
+// expired returns true if the write has a TTL that ran out before now.
+func (wr *WriteRequest) expired(now time.Time) bool {
+	return wr.ExpireTime > 0 && now.Unix() >= wr.ExpireTime
+}
+
+// DeleteMessage returns the message the owner signs to delete a write.
+func DeleteMessage(wID string, version int) ([]byte, error) {
+	return policyMessage(wID, "delete", version, nil)
+}
+
+// DeleteWrite removes the write and all its index entries, if check
+// returns no error for it. It returns the number of bytes freed.
+func (cdb *CentralizedCalypsoDB) DeleteWrite(wID string, check func(*WriteRequest) error) (int, error) {
+	key, err := hex.DecodeString(wID)
+	if err != nil {
+		log.Errorf("DeleteWrite error: %v", err)
+		return 0, err
+	}
+	var size int
+	err = cdb.DB.Update(func(tx *bolt.Tx) error {
+		sw, err := cdb.getFromTx(tx, key)
+		if err != nil {
+			return err
+		}
+		if err = check(sw); err != nil {
+			return err
+		}
+		size, err = cdb.deleteTx(tx, sw, key)
+		return err
+	})
+	if err != nil {
+		log.Errorf("DeleteWrite error: %v", err)
+		return 0, err
+	}
+	return size, nil
+}
+
+// deleteTx removes the write with the given key from the database and from
+// all indexes, releases the bytes charged for it and returns the size of the
+// stored value.
+func (cdb *CentralizedCalypsoDB) deleteTx(tx *bolt.Tx, sw *WriteRequest, key []byte) (int, error) {
+	b := tx.Bucket(cdb.bucketName)
+	size := len(b.Get(key))
+	if err := b.Delete(key); err != nil {
+		return 0, err
+	}
+	chunkSize, err := cdb.chunks.DeleteTx(tx, key)
+	if err != nil {
+		return 0, err
+	}
+	size += chunkSize
+	if err := cdb.writers.ReleaseTx(tx, sw.Owner, sw.Charged); err != nil {
+		return 0, err
+	}
+	if err := tx.Bucket(cdb.timeBucket).Delete(timeKey(sw.WriteTime, key)); err != nil {
+		return 0, err
+	}
+	if sw.ExpireTime > 0 {
+		if err := tx.Bucket(cdb.expiryBucket).Delete(timeKey(sw.ExpireTime, key)); err != nil {
+			return 0, err
+		}
+	}
+	readerKeys, err := indexKeys(sw, key)
+	if err != nil {
+		return 0, err
+	}
+	rb := tx.Bucket(cdb.readerBucket)
+	for _, k := range readerKeys {
+		if err := rb.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// PurgeExpired removes all writes that expired before now. It returns the
+// number of writes removed and the number of bytes freed.
+func (cdb *CentralizedCalypsoDB) PurgeExpired(now time.Time) (int, int, error) {
+	var count, size int
+	limit := make([]byte, 8)
+	binary.BigEndian.PutUint64(limit, uint64(now.Unix()))
+	err := cdb.DB.Update(func(tx *bolt.Tx) error {
+		var expired [][]byte
+		c := tx.Bucket(cdb.expiryBucket).Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k[:8], limit) <= 0; k, v = c.Next() {
+			expired = append(expired, append([]byte{}, v...))
+		}
+		for _, key := range expired {
+			sw, err := cdb.getFromTx(tx, key)
+			if err != nil {
+				return err
+			}
+			n, err := cdb.deleteTx(tx, sw, key)
+			if err != nil {
+				return err
+			}
+			count++
+			size += n
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("PurgeExpired error: %v", err)
+		return 0, 0, err
+	}
+	return count, size, nil
+}
+
+// sweep periodically purges the expired writes and upload sessions and
+// retires the previous encryption key until the service is closed.
+func (s *Service) sweep() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.retireKey(time.Now())
+			count, size, err := s.db.PurgeExpired(time.Now())
+			if err != nil {
+				log.Error("Couldn't purge expired writes:", err)
+				continue
+			}
+			if count > 0 {
+				log.Lvlf1("%s: purged %d expired writes, reclaimed %d bytes",
+					s.ServerIdentity(), count, size)
+			}
+			sessions, err := s.db.chunks.PurgeSessions(time.Now())
+			if err != nil {
+				log.Error("Couldn't purge upload sessions:", err)
+			} else if sessions > 0 {
+				log.Lvlf2("%s: purged %d unfinished uploads", s.ServerIdentity(), sessions)
+			}
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// Delete removes a write. The request has to be signed by the owner of the
+// write.
+func (s *Service) Delete(req *DeleteRequest) (*DeleteReply, error) {
+	msg, err := DeleteMessage(req.WriteID, req.Version)
+	if err != nil {
+		log.Errorf("Delete error: %v", err)
+		return nil, err
+	}
+	size, err := s.db.DeleteWrite(req.WriteID, func(sw *WriteRequest) error {
+		return verifyOwner(sw, req.Version, msg, req.Sig)
+	})
+	if err != nil {
+		log.Errorf("Delete error: %v", err)
+		return nil, err
+	}
+	log.Lvlf2("%s: deleted write %s, reclaimed %d bytes", s.ServerIdentity(), req.WriteID, size)
+	return &DeleteReply{}, nil
+}
+
+// Close is called by onet when the conode shuts down. It stops the sweeper
+// of the service and waits for it to return.
+func (s *Service) Close() error {
+	s.closeOnce.Do(func() { close(s.closing) })
+	s.wg.Wait()
+	return nil
+}
@@ -0,0 +1,236 @@
+package service
+
+/*
+The index.go keeps secondary indexes over the stored writes, so that the
+writes can be listed by reader and by the time they were stored.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/log"
+)
+
+// maxListLimit is the maximum number of writes returned by one ListWrites
+// request.
+const maxListLimit = 1000
+
+// Actions signed by the reader to list or count its writes.
+const (
+	ListAction  = "listwrites"
+	CountAction = "countwrites"
+)
+
+// readerData returns the data of the message that is signed to list or
+// count the writes of reader.
+func readerData(reader kyber.Point) ([]byte, error) {
+	if reader == nil {
+		return nil, nil
+	}
+	return reader.MarshalBinary()
+}
+
+// ReaderMessage returns the message the reader signs at time ts to list or
+// count its writes, depending on action. If reader is nil, the message is
+// signed with the identity key of the server and covers all writes.
+func ReaderMessage(action string, reader kyber.Point, ts int64) ([]byte, error) {
+	data, err := readerData(reader)
+	if err != nil {
+		return nil, err
+	}
+	return util.AdminMessage(action, ts, data), nil
+}
+
+// verifyReader checks that a request for the writes of reader is signed by
+// it, or by the identity key of the server if reader is nil, and that its
+// timestamp is within util.AdminWindow of now.
+func (s *Service) verifyReader(action string, reader kyber.Point, ts int64, sig []byte, now time.Time) error {
+	data, err := readerData(reader)
+	if err != nil {
+		return err
+	}
+	pub := reader
+	if pub == nil {
+		pub = s.ServerIdentity().Public
+	}
+	return util.VerifyAdminRequest(pub, action, ts, data, sig, now)
+}
+
+// writeReaders returns the keys of all readers that can read the write.
+func writeReaders(sw *WriteRequest) ([]kyber.Point, error) {
+	if len(sw.Policy) > 0 {
+		return policyReaders(sw.Policy)
+	}
+	if sw.Reader == nil {
+		return nil, nil
+	}
+	return []kyber.Point{sw.Reader}, nil
+}
+
+// timeKey returns the key of a write in the time index: the big endian
+// write time followed by the write ID.
+func timeKey(ts int64, wID []byte) []byte {
+	key := make([]byte, 8+len(wID))
+	binary.BigEndian.PutUint64(key, uint64(ts))
+	copy(key[8:], wID)
+	return key
+}
+
+// readerPrefix returns the prefix of all keys of a reader in the reader
+// index.
+func readerPrefix(reader kyber.Point) ([]byte, error) {
+	return reader.MarshalBinary()
+}
+
+// indexKeys returns the keys of the write in the reader index.
+func indexKeys(sw *WriteRequest, wID []byte) ([][]byte, error) {
+	readers, err := writeReaders(sw)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, len(readers))
+	for i, r := range readers {
+		prefix, err := readerPrefix(r)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = append(prefix, timeKey(sw.WriteTime, wID)...)
+	}
+	return keys, nil
+}
+
+// indexWriteTx adds the write to the time index and to the reader index.
+func (cdb *CentralizedCalypsoDB) indexWriteTx(tx *bolt.Tx, sw *WriteRequest, wID []byte) error {
+	if err := tx.Bucket(cdb.timeBucket).Put(timeKey(sw.WriteTime, wID), wID); err != nil {
+		return err
+	}
+	keys, err := indexKeys(sw, wID)
+	if err != nil {
+		return err
+	}
+	b := tx.Bucket(cdb.readerBucket)
+	for _, k := range keys {
+		if err := b.Put(k, wID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindexReadersTx replaces the entries of a write in the reader index
+// after its readers changed from old to sw.
+func (cdb *CentralizedCalypsoDB) reindexReadersTx(tx *bolt.Tx, old, sw *WriteRequest, wID []byte) error {
+	oldKeys, err := indexKeys(old, wID)
+	if err != nil {
+		return err
+	}
+	b := tx.Bucket(cdb.readerBucket)
+	for _, k := range oldKeys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	newKeys, err := indexKeys(sw, wID)
+	if err != nil {
+		return err
+	}
+	for _, k := range newKeys {
+		if err := b.Put(k, wID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListWrites returns at most limit writes that can be read by reader, or
+// all writes if reader is nil, sorted by the time they were stored. cursor
+// is the Next value of the previous reply, or nil to start at the
+// beginning. The returned cursor is nil once all writes were listed.
+func (cdb *CentralizedCalypsoDB) ListWrites(reader kyber.Point, cursor []byte, limit int) ([]*WriteInfo, []byte, error) {
+	if limit <= 0 || limit > maxListLimit {
+		limit = maxListLimit
+	}
+	var infos []*WriteInfo
+	var last, next []byte
+	err := cdb.DB.View(func(tx *bolt.Tx) error {
+		c, prefix, err := cdb.indexCursor(tx, reader)
+		if err != nil {
+			return err
+		}
+		k, v := c.Seek(prefix)
+		if cursor != nil {
+			if !bytes.HasPrefix(cursor, prefix) {
+				return errors.New("Invalid cursor")
+			}
+			k, v = c.Seek(cursor)
+			if bytes.Equal(k, cursor) {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if len(infos) == limit {
+				next = last
+				return nil
+			}
+			sw, err := cdb.getFromTx(tx, v)
+			if err != nil {
+				return err
+			}
+			infos = append(infos, &WriteInfo{
+				WriteID:   hex.EncodeToString(v),
+				WriteTime: sw.WriteTime,
+				Owner:     sw.Owner,
+				Version:   sw.Version,
+				Revoked:   sw.Revoked,
+			})
+			last = append([]byte{}, k...)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("ListWrites error: %v", err)
+		return nil, nil, err
+	}
+	return infos, next, nil
+}
+
+// CountWrites returns the number of writes that can be read by reader, or
+// the number of all writes if reader is nil.
+func (cdb *CentralizedCalypsoDB) CountWrites(reader kyber.Point) (int, error) {
+	count := 0
+	err := cdb.DB.View(func(tx *bolt.Tx) error {
+		c, prefix, err := cdb.indexCursor(tx, reader)
+		if err != nil {
+			return err
+		}
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("CountWrites error: %v", err)
+		return 0, err
+	}
+	return count, nil
+}
+
+// indexCursor returns a cursor over the index to use for reader, and the
+// prefix of the keys that belong to it.
+func (cdb *CentralizedCalypsoDB) indexCursor(tx *bolt.Tx, reader kyber.Point) (*bolt.Cursor, []byte, error) {
+	if reader == nil {
+		return tx.Bucket(cdb.timeBucket).Cursor(), []byte{}, nil
+	}
+	prefix, err := readerPrefix(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tx.Bucket(cdb.readerBucket).Cursor(), prefix, nil
+}
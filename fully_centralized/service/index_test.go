@@ -0,0 +1,132 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+)
+
+func TestListWrites(t *testing.T) {
+	cdb, cleanup := newTestDB(t)
+	defer cleanup()
+	readerA := key.NewKeyPair(cothority.Suite).Public
+	readerB := key.NewKeyPair(cothority.Suite).Public
+	ids := make(map[kyber.Point]map[string]bool)
+	ids[nil] = make(map[string]bool)
+	for i, reader := range []kyber.Point{readerA, readerB, readerA, readerA, readerB} {
+		data := []byte{byte(i)}
+		wID, err := cdb.StoreWrite(&WriteRequest{EncData: data, DataHash: util.DataHash(data), Reader: reader})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids[reader] == nil {
+			ids[reader] = make(map[string]bool)
+		}
+		ids[reader][wID] = true
+		ids[nil][wID] = true
+	}
+
+	tests := []struct {
+		name   string
+		reader kyber.Point
+		limit  int
+		pages  []int
+	}{
+		{"all at once", nil, 0, []int{5}},
+		{"all in pages", nil, 2, []int{2, 2, 1}},
+		{"exact pages", readerB, 1, []int{1, 1}},
+		{"reader in pages", readerA, 2, []int{2, 1}},
+		{"reader at once", readerA, 3, []int{3}},
+	}
+	for _, tt := range tests {
+		seen := make(map[string]bool)
+		var cursor []byte
+		for i, size := range tt.pages {
+			infos, next, err := cdb.ListWrites(tt.reader, cursor, tt.limit)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if len(infos) != size {
+				t.Fatalf("%s: page %d has %d writes instead of %d", tt.name, i, len(infos), size)
+			}
+			for _, info := range infos {
+				if seen[info.WriteID] || !ids[tt.reader][info.WriteID] {
+					t.Fatalf("%s: wrong write %s", tt.name, info.WriteID)
+				}
+				seen[info.WriteID] = true
+			}
+			if (next == nil) != (i == len(tt.pages)-1) {
+				t.Fatalf("%s: wrong cursor after page %d", tt.name, i)
+			}
+			cursor = next
+		}
+		count, err := cdb.CountWrites(tt.reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seen) != len(ids[tt.reader]) || count != len(seen) {
+			t.Errorf("%s: listed %d and counted %d of %d writes", tt.name, len(seen), count, len(ids[tt.reader]))
+		}
+	}
+
+	// The cursor of one reader cannot be used to list the writes of
+	// another one.
+	_, next, err := cdb.ListWrites(readerB, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = cdb.ListWrites(readerA, next, 1); err == nil {
+		t.Fatal("Cursor of another reader was accepted")
+	}
+}
+
+func TestVerifyReader(t *testing.T) {
+	local := onet.NewTCPTest(cothority.Suite)
+	defer local.CloseAll()
+	servers, _, _ := local.GenTree(1, true)
+	s := local.GetServices(servers, templateID)[0].(*Service)
+	reader := key.NewKeyPair(cothority.Suite)
+	other := key.NewKeyPair(cothority.Suite)
+	admin := s.ServerIdentity().GetPrivate()
+	now := time.Now()
+	sign := func(action string, pub kyber.Point, sk kyber.Scalar, ts time.Time) []byte {
+		msg, err := ReaderMessage(action, pub, ts.Unix())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := schnorr.Sign(cothority.Suite, sk, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	tests := []struct {
+		name   string
+		reader kyber.Point
+		ts     time.Time
+		sig    []byte
+		ok     bool
+	}{
+		{"reader", reader.Public, now, sign(ListAction, reader.Public, reader.Private, now), true},
+		{"all writes", nil, now, sign(ListAction, nil, admin, now), true},
+		{"signed by another reader", reader.Public, now, sign(ListAction, reader.Public, other.Private, now), false},
+		{"signed for another reader", reader.Public, now, sign(ListAction, other.Public, reader.Private, now), false},
+		{"all writes signed by a reader", nil, now, sign(ListAction, nil, reader.Private, now), false},
+		{"signed to count", reader.Public, now, sign(CountAction, reader.Public, reader.Private, now), false},
+		{"old timestamp", reader.Public, now.Add(-2 * util.AdminWindow),
+			sign(ListAction, reader.Public, reader.Private, now.Add(-2*util.AdminWindow)), false},
+		{"missing signature", reader.Public, now, nil, false},
+	}
+	for _, tt := range tests {
+		err := s.verifyReader(ListAction, tt.reader, tt.ts.Unix(), tt.sig, now)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package service
+
+/*
+The keys.go manages the key the symmetric keys of the writes are encrypted
+to. It is separate from the identity key of the conode so that it can be
+rotated. Until the first rotation, the identity key is used.
+*/
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// RotationGrace is how long the previous encryption key is still accepted
+// for new writes after a rotation, so that clients that fetched the key
+// before the rotation can still write.
+var RotationGrace = 10 * time.Minute
+
+// rotateAction is the action signed by the admin to rotate the key.
+const rotateAction = "rotate"
+
+// rotateData returns the data of the admin message that rotates the
+// encryption key current. As the key changes with the rotation, a request
+// can rotate the key only once.
+func rotateData(current kyber.Point) ([]byte, error) {
+	return current.MarshalBinary()
+}
+
+// encKey returns the current encryption key. The caller has to hold the
+// lock of the storage.
+func (s *Service) encKey() kyber.Scalar {
+	if s.storage.EncKey == nil {
+		return s.ServerIdentity().GetPrivate()
+	}
+	return s.storage.EncKey
+}
+
+// EncPublic returns the public encryption key of the service.
+func (s *Service) EncPublic() kyber.Point {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	return cothority.Suite.Point().Mul(s.encKey(), nil)
+}
+
+// keyFor returns the private key of pub, which has to be the current
+// encryption key or the previous one within its grace period. A nil pub
+// stands for the identity key.
+func (s *Service) keyFor(pub kyber.Point, now time.Time) (kyber.Scalar, error) {
+	if pub == nil {
+		pub = s.ServerIdentity().Public
+	}
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	sk := s.encKey()
+	if cothority.Suite.Point().Mul(sk, nil).Equal(pub) {
+		return sk, nil
+	}
+	if s.storage.PrevKey != nil && now.Unix() < s.storage.PrevExpire &&
+		cothority.Suite.Point().Mul(s.storage.PrevKey, nil).Equal(pub) {
+		return s.storage.PrevKey, nil
+	}
+	return nil, errors.New("Unknown server key")
+}
+
+// wrapToCurrent makes sure that K and C of the write are encrypted to the
+// current encryption key, re-encrypting them if they are encrypted to the
+// previous one. It records the key the writer encrypted to in WriteKey.
+func (s *Service) wrapToCurrent(req *WriteRequest) error {
+	if req.ServerKey == nil {
+		req.ServerKey = s.ServerIdentity().Public
+	}
+	req.WriteKey = req.ServerKey
+	req.Rewraps = nil
+	return s.rewrap(req, s.EncPublic(), time.Now())
+}
+
+// rewrap re-encrypts K and C of the write to pub, unless they are already
+// encrypted to it, and records the re-encryption with its proof so that
+// readers can check it against the ciphertext of the writer.
+func (s *Service) rewrap(sw *WriteRequest, pub kyber.Point, now time.Time) error {
+	sk, err := s.keyFor(sw.ServerKey, now)
+	if err != nil {
+		return err
+	}
+	if cothority.Suite.Point().Mul(sk, nil).Equal(pub) {
+		sw.ServerKey = pub
+		return nil
+	}
+	k, c, proof, err := util.Reencrypt(sk, sw.K, sw.C, pub)
+	if err != nil {
+		return err
+	}
+	sw.K, sw.C, sw.ServerKey = k, c, pub
+	sw.Rewraps = append(sw.Rewraps, &util.Rewrap{Server: pub, K: k, C: c, Proof: proof})
+	return nil
+}
+
+// GetKey returns the current encryption key, signed with the identity key.
+func (s *Service) GetKey(req *GetKeyRequest) (*GetKeyReply, error) {
+	pub := s.EncPublic()
+	msg, err := util.KeyMessage(pub)
+	if err != nil {
+		log.Errorf("GetKey error: %v", err)
+		return nil, err
+	}
+	sig, err := schnorr.Sign(cothority.Suite, s.ServerIdentity().GetPrivate(), msg)
+	if err != nil {
+		log.Errorf("GetKey error: %v", err)
+		return nil, err
+	}
+	return &GetKeyReply{Public: pub, Sig: sig}, nil
+}
+
+// RotateKey creates a new encryption key and re-encrypts the keys of all
+// stored writes to it in one transaction. The request has to be signed
+// with the identity key of the conode, over the current encryption key.
+func (s *Service) RotateKey(req *RotateKeyRequest) (*RotateKeyReply, error) {
+	now := time.Now()
+	// No reads or writes may use the keys while the writes are re-wrapped,
+	// and the key cannot change between the check of the request and the
+	// rotation.
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
+	data, err := rotateData(s.EncPublic())
+	if err != nil {
+		log.Errorf("RotateKey error: %v", err)
+		return nil, err
+	}
+	err = util.VerifyAdminRequest(s.ServerIdentity().Public, rotateAction, req.Timestamp, data, req.Sig, now)
+	if err != nil {
+		log.Errorf("RotateKey error: %v", err)
+		return nil, err
+	}
+
+	newKey := cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
+	newPub := cothority.Suite.Point().Mul(newKey, nil)
+	keys := s.rotatedKeys(newKey, now)
+	count, err := s.db.RewrapWrites(func(sw *WriteRequest) error {
+		return s.rewrap(sw, newPub, now)
+	}, func(tx *bolt.Tx) error {
+		// The new key is stored in the same transaction as the writes, so
+		// that they are never stored under a key the service does not
+		// know.
+		return s.db.saveKeysTx(tx, keys)
+	})
+	if err != nil {
+		log.Errorf("RotateKey error: %v", err)
+		return nil, err
+	}
+	s.setKeys(keys)
+	log.Lvlf1("%s: rotated encryption key, re-wrapped %d writes", s.ServerIdentity(), count)
+	return &RotateKeyReply{Public: newPub, Rewrapped: count}, nil
+}
+
+// rotatedKeys returns the keys of the service after a rotation to key: the
+// current key becomes the previous one and is kept for RotationGrace.
+func (s *Service) rotatedKeys(key kyber.Scalar, now time.Time) *storage {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	return &storage{
+		EncKey:     key,
+		PrevKey:    s.encKey(),
+		PrevExpire: now.Add(RotationGrace).Unix(),
+	}
+}
+
+// setKeys replaces the keys of the service with keys, once they are stored.
+func (s *Service) setKeys(keys *storage) {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	s.storage.EncKey = keys.EncKey
+	s.storage.PrevKey = keys.PrevKey
+	s.storage.PrevExpire = keys.PrevExpire
+}
+
+// retireKey forgets the previous encryption key once its grace period is
+// over.
+func (s *Service) retireKey(now time.Time) {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	if s.storage.PrevKey == nil || now.Unix() < s.storage.PrevExpire {
+		return
+	}
+	s.storage.PrevKey = nil
+	s.storage.PrevExpire = 0
+	if err := s.db.saveKeys(s.storage); err != nil {
+		log.Error("Couldn't save data:", err)
+		return
+	}
+	log.Lvlf2("%s: retired previous encryption key", s.ServerIdentity())
+}
+
+// loadKeys returns the stored encryption keys, or empty keys if none have
+// been stored yet.
+func (cdb *CentralizedCalypsoDB) loadKeys() (*storage, error) {
+	keys := &storage{}
+	err := cdb.DB.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(cdb.keyBucket).Get(storageID)
+		if val == nil {
+			return nil
+		}
+		buf := make([]byte, len(val))
+		copy(buf, val)
+		_, msg, err := network.Unmarshal(buf, cothority.Suite)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if keys, ok = msg.(*storage); !ok {
+			return errors.New("Data of wrong type")
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("loadKeys error: %v", err)
+		return nil, err
+	}
+	return keys, nil
+}
+
+// saveKeys stores the encryption keys.
+func (cdb *CentralizedCalypsoDB) saveKeys(keys *storage) error {
+	return cdb.DB.Update(func(tx *bolt.Tx) error {
+		return cdb.saveKeysTx(tx, keys)
+	})
+}
+
+// saveKeysTx stores the encryption keys within tx. They are kept in the
+// database of the writes instead of the storage of the context, as saving
+// there opens another write transaction on the same database.
+func (cdb *CentralizedCalypsoDB) saveKeysTx(tx *bolt.Tx, keys *storage) error {
+	val, err := network.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(cdb.keyBucket).Put(storageID, val)
+}
+
+// RewrapWrites applies rewrap to every stored write and calls commit
+// before storing the results, all within one transaction. If rewrap or
+// commit return an error, nothing is changed. It returns the number of
+// writes.
+func (cdb *CentralizedCalypsoDB) RewrapWrites(rewrap func(*WriteRequest) error, commit func(*bolt.Tx) error) (int, error) {
+	count := 0
+	err := cdb.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(cdb.bucketName)
+		var keys [][]byte
+		err := b.ForEach(func(k, _ []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			sw, err := cdb.getFromTx(tx, k)
+			if err != nil {
+				return err
+			}
+			if err = rewrap(sw); err != nil {
+				return err
+			}
+			if err = cdb.putTx(tx, k, sw); err != nil {
+				return err
+			}
+		}
+		count = len(keys)
+		return commit(tx)
+	})
+	if err != nil {
+		log.Errorf("RewrapWrites error: %v", err)
+		return 0, err
+	}
+	return count, nil
+}
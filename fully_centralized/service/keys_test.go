@@ -0,0 +1,107 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/kyber/util/random"
+	"github.com/dedis/onet"
+)
+
+func TestRotateKey(t *testing.T) {
+	local := onet.NewTCPTest(cothority.Suite)
+	defer local.CloseAll()
+	servers, _, _ := local.GenTree(1, true)
+	s := local.GetServices(servers, templateID)[0].(*Service)
+	reader := key.NewKeyPair(cothority.Suite)
+
+	data := []byte("data of the write")
+	wd, err := util.CreateWriteData(data, reader.Public, s.EncPublic(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wReply, err := s.Write(&WriteRequest{EncData: wd.Data, DataHash: wd.DataHash, K: wd.K, C: wd.C,
+		Reader: wd.Reader, ServerKey: wd.ServerKey, Ubar: wd.Ubar, E: wd.E, F: wd.F})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotateReq := &RotateKeyRequest{Timestamp: time.Now().Unix()}
+	rd, err := rotateData(s.EncPublic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotateReq.Sig, err = schnorr.Sign(cothority.Suite, s.ServerIdentity().GetPrivate(),
+		util.AdminMessage(rotateAction, rotateReq.Timestamp, rd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The rotation stores the writes and the new key in one transaction
+	// and must not wait for another one.
+	done := make(chan error)
+	var reply *RotateKeyReply
+	go func() {
+		var err error
+		reply, err = s.RotateKey(rotateReq)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Key rotation does not return")
+	}
+	if reply.Rewrapped != 1 || !reply.Public.Equal(s.EncPublic()) || reply.Public.Equal(wd.ServerKey) {
+		t.Fatalf("Wrong rotation reply %+v", reply)
+	}
+	if _, err = s.RotateKey(rotateReq); err == nil {
+		t.Fatal("Rotation request was replayed")
+	}
+	keys, err := s.db.loadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cothority.Suite.Point().Mul(keys.EncKey, nil).Equal(reply.Public) {
+		t.Fatal("New key was not stored")
+	}
+
+	// The write from before the rotation can still be read, and the key
+	// can be followed from the ciphertext of the writer.
+	rr := &ReadRequest{WriteID: wReply.WriteID, Nonce: make([]byte, NonceLen), Timestamp: time.Now().Unix()}
+	random.Bytes(rr.Nonce, random.New())
+	msg, err := ReadMessage(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Sig, err = schnorr.Sign(cothority.Suite, reader.Private, msg); err != nil {
+		t.Fatal(err)
+	}
+	rReply, err := s.Read(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, k, c, err := util.VerifyRewraps(rReply.WriteKey, wd.K, wd.C, rReply.Rewraps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !serverKey.Equal(reply.Public) {
+		t.Fatal("Write was not re-wrapped to the new key")
+	}
+	if err = util.VerifyReencryption(serverKey, k, c, reader.Public, rReply.K, rReply.C, rReply.Proof); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := util.RecoverData(wd.Data, reader.Private, rReply.K, rReply.C)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, data) {
+		t.Fatal("Wrong data")
+	}
+}
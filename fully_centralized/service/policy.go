@@ -0,0 +1,156 @@
+package service
+
+/*
+The policy.go implements read policies that go beyond a single reader. A
+policy is a darc expression over ed25519 identities, so "any of these
+readers" and "k out of these readers" can be expressed the same way as
+with the DARCs on byzcoin.
+*/
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+)
+
+// maxPolicyTerms limits the number of conjunctions a threshold policy can
+// expand to.
+const maxPolicyTerms = 1024
+
+// PolicySignature is the signature of one reader on a read request.
+type PolicySignature struct {
+	Public kyber.Point
+	Sig    []byte
+}
+
+// readerIdentity returns the darc identity string of a reader key.
+func readerIdentity(pk kyber.Point) string {
+	return darc.NewIdentityEd25519(pk).String()
+}
+
+// AnyOfPolicy returns a policy that is satisfied by the signature of any one
+// of the readers.
+func AnyOfPolicy(readers []kyber.Point) expression.Expr {
+	ids := make([]string, len(readers))
+	for i, r := range readers {
+		ids[i] = readerIdentity(r)
+	}
+	return expression.InitOrExpr(ids...)
+}
+
+// ThresholdPolicy returns a policy that is satisfied if at least k of the
+// readers co-sign the read request.
+func ThresholdPolicy(k int, readers []kyber.Point) (expression.Expr, error) {
+	if k <= 0 || k > len(readers) {
+		return nil, fmt.Errorf("Invalid threshold %d for %d readers", k, len(readers))
+	}
+	ids := make([]string, len(readers))
+	for i, r := range readers {
+		ids[i] = readerIdentity(r)
+	}
+	var terms []string
+	var combine func(start int, chosen []string) error
+	combine = func(start int, chosen []string) error {
+		if len(chosen) == k {
+			if len(terms) == maxPolicyTerms {
+				return errors.New("Threshold policy is too large")
+			}
+			terms = append(terms, "("+string(expression.InitAndExpr(chosen...))+")")
+			return nil
+		}
+		for i := start; i <= len(ids)-(k-len(chosen)); i++ {
+			if err := combine(i+1, append(chosen, ids[i])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := combine(0, make([]string, 0, k)); err != nil {
+		return nil, err
+	}
+	return expression.Expr(strings.Join(terms, " | ")), nil
+}
+
+// verifyPolicyExpr makes sure that the policy can be parsed.
+func verifyPolicyExpr(policy expression.Expr) error {
+	_, err := expression.Evaluate(policy, func(string) bool { return false })
+	return err
+}
+
+var identityRegexp = regexp.MustCompile(`ed25519:[0-9a-fA-F]+`)
+
+// policyReaders returns the keys of all readers that appear in the policy.
+func policyReaders(policy expression.Expr) ([]kyber.Point, error) {
+	var readers []kyber.Point
+	seen := make(map[string]bool)
+	for _, id := range identityRegexp.FindAllString(string(policy), -1) {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		buf, err := hex.DecodeString(strings.TrimPrefix(id, "ed25519:"))
+		if err != nil {
+			return nil, err
+		}
+		pk := cothority.Suite.Point()
+		if err = pk.UnmarshalBinary(buf); err != nil {
+			return nil, err
+		}
+		readers = append(readers, pk)
+	}
+	return readers, nil
+}
+
+// verifyPolicy checks the signatures of a read request against the policy of
+// the write. The reader that asks for the re-encryption has to appear in the
+// policy and be one of the signers.
+func verifyPolicy(policy expression.Expr, reader kyber.Point, msg []byte, readerSig []byte, cosigs []*PolicySignature) error {
+	if reader == nil {
+		return errors.New("Missing reader")
+	}
+	readers, err := policyReaders(policy)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, r := range readers {
+		if r.Equal(reader) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.New("Reader is not in the policy")
+	}
+	if err := schnorr.Verify(cothority.Suite, reader, msg, readerSig); err != nil {
+		return err
+	}
+	signers := map[string]bool{readerIdentity(reader): true}
+	for _, ps := range cosigs {
+		if ps.Public == nil {
+			continue
+		}
+		if err := schnorr.Verify(cothority.Suite, ps.Public, msg, ps.Sig); err != nil {
+			return errors.New("Invalid co-signature: " + err.Error())
+		}
+		signers[readerIdentity(ps.Public)] = true
+	}
+	ok, err := expression.Evaluate(policy, func(id string) bool {
+		return signers[id]
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Read policy is not satisfied")
+	}
+	return nil
+}
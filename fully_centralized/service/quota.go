@@ -0,0 +1,67 @@
+package service
+
+/*
+The quota.go authenticates writers and limits how much they can store and
+how fast they can write. As long as no writer is registered, the service
+accepts writes from anyone, as in a closed testbed.
+*/
+
+import (
+	"time"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	"github.com/dedis/onet/log"
+)
+
+// authWrite checks that the write is signed by its owner, who has to be a
+// registered writer within its limits, and has room for size more bytes.
+func (s *Service) authWrite(req *WriteRequest, size int64, now time.Time) error {
+	digest, err := WriteDigest(req)
+	if err != nil {
+		return err
+	}
+	return s.db.writers.Authenticate(req.Owner, req.Timestamp, digest, req.Sig, size, now)
+}
+
+// SetWriter registers a writer or changes its quota, or removes it. The
+// request has to be signed by the identity key of the server.
+func (s *Service) SetWriter(req *SetWriterRequest) (*SetWriterReply, error) {
+	data, err := util.WriterData(req.Writer, req.Quota, req.Remove, req.Version)
+	if err != nil {
+		log.Errorf("SetWriter error: %v", err)
+		return nil, err
+	}
+	err = util.VerifyAdminRequest(s.ServerIdentity().Public, util.WriterAction, req.Timestamp, data, req.Sig, time.Now())
+	if err != nil {
+		log.Errorf("SetWriter error: %v", err)
+		return nil, err
+	}
+	if req.Remove {
+		if err = s.db.writers.RemoveWriter(req.Writer, req.Version); err != nil {
+			return nil, err
+		}
+		return &SetWriterReply{}, nil
+	}
+	wi, err := s.db.writers.SetWriter(req.Writer, req.Quota, req.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &SetWriterReply{Used: wi.Used}, nil
+}
+
+// GetWriter returns the registration of a writer and the version of the
+// writers.
+func (s *Service) GetWriter(req *GetWriterRequest) (*GetWriterReply, error) {
+	wi, version, err := s.db.writers.GetWriter(req.Writer)
+	if err != nil {
+		log.Errorf("GetWriter error: %v", err)
+		return nil, err
+	}
+	reply := &GetWriterReply{Version: version}
+	if wi != nil {
+		reply.Registered = true
+		reply.Quota = wi.Quota
+		reply.Used = wi.Used
+	}
+	return reply, nil
+}
@@ -8,7 +8,11 @@ runs on the node.
 import (
 	"errors"
 	"sync"
+	"time"
 
+	"github.com/ceyhunalp/calypso_experiments/util"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 	"github.com/dedis/onet/network"
@@ -25,7 +29,17 @@ func init() {
 	var err error
 	templateID, err = onet.RegisterNewService(ServiceName, newCentralizedCalypsoService)
 	log.ErrFatal(err)
-	network.RegisterMessages(&storage{}, &WriteRequest{}, &WriteReply{})
+	network.RegisterMessages(&storage{}, &WriteRequest{}, &WriteReply{},
+		&UpdatePolicyRequest{}, &UpdatePolicyReply{}, &RevokeRequest{}, &RevokeReply{},
+		&AuditEntry{}, &GetAuditLogRequest{}, &GetAuditLogReply{},
+		&ListWritesRequest{}, &ListWritesReply{}, &CountWritesRequest{}, &CountWritesReply{},
+		&DeleteRequest{}, &DeleteReply{}, &GetKeyRequest{}, &GetKeyReply{},
+		&RotateKeyRequest{}, &RotateKeyReply{},
+		&BeginUploadRequest{}, &BeginUploadReply{}, &UploadChunkRequest{}, &UploadChunkReply{},
+		&UploadStatusRequest{}, &UploadStatusReply{}, &FinishUploadRequest{},
+		&GetChunkInfoRequest{}, &GetChunkInfoReply{}, &GetChunkRequest{}, &GetChunkReply{},
+		&WriteBatchRequest{}, &WriteBatchReply{}, &ReadBatchRequest{}, &ReadBatchReply{},
+		&SetWriterRequest{}, &SetWriterReply{}, &GetWriterRequest{}, &GetWriterReply{})
 }
 
 // Service is our template-service
@@ -35,6 +49,14 @@ type Service struct {
 	*onet.ServiceProcessor
 	db      *CentralizedCalypsoDB
 	storage *storage
+	// closing stops the sweeper of expired writes, and wg waits for it to
+	// return.
+	closing   chan bool
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	// keyLock is held for reading while the encryption keys are used and
+	// for writing while they are rotated.
+	keyLock sync.RWMutex
 }
 
 // storageID reflects the data we're storing - we could store more
@@ -44,10 +66,27 @@ var storageID = []byte("CentralizedCalypso")
 // storage is used to save our data.
 type storage struct {
 	//Suite *edwards25519.SuiteEd25519
+	// EncKey is the key the symmetric keys of the writes are encrypted to.
+	// It is nil until the first rotation, and the identity key is used.
+	EncKey kyber.Scalar
+	// PrevKey is the key before the last rotation, which is accepted for
+	// new writes until PrevExpire.
+	PrevKey    kyber.Scalar
+	PrevExpire int64
 	sync.Mutex
 }
 
 func (s *Service) Write(req *WriteRequest) (*WriteReply, error) {
+	if err := s.authWrite(req, int64(len(req.EncData)), time.Now()); err != nil {
+		log.Errorf("Write error: %v", err)
+		return nil, err
+	}
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+	if err := s.checkWrite(req); err != nil {
+		log.Errorf("Write error: %v", err)
+		return nil, err
+	}
 	storedKey, err := s.db.StoreWrite(req)
 	if err != nil {
 		log.Errorf("Write error: %v", err)
@@ -59,59 +98,229 @@ func (s *Service) Write(req *WriteRequest) (*WriteReply, error) {
 	return reply, nil
 }
 
+// checkWrite picks the ciphertext of this server, verifies the write proof
+// and moves the key to the current encryption key. The caller has to hold
+// keyLock.
+func (s *Service) checkWrite(req *WriteRequest) error {
+	if len(req.Replicas) > 0 {
+		if err := s.pickReplicaKey(req); err != nil {
+			return err
+		}
+	}
+	if err := s.verifyWriteProof(req); err != nil {
+		return err
+	}
+	return s.wrapToCurrent(req)
+}
+
+// pickReplicaKey replaces K and C of a replicated write request with the
+// ciphertext that is encrypted to this server.
+func (s *Service) pickReplicaKey(req *WriteRequest) error {
+	now := time.Now()
+	for _, rk := range req.Replicas {
+		if rk.Server == nil {
+			continue
+		}
+		if _, err := s.keyFor(rk.Server, now); err == nil {
+			req.K = rk.K
+			req.C = rk.C
+			req.Ubar = rk.Ubar
+			req.E = rk.E
+			req.F = rk.F
+			req.ServerKey = rk.Server
+			req.Replicas = nil
+			return nil
+		}
+	}
+	return errors.New("No replica key for this server")
+}
+
+// verifyWriteProof checks that the writer knows the randomness of the
+// ciphertext, so that it cannot be a copy of another write.
+func (s *Service) verifyWriteProof(req *WriteRequest) error {
+	pub := req.ServerKey
+	if pub == nil {
+		pub = s.ServerIdentity().Public
+	}
+	return util.VerifyWriteProof(pub, req.K, req.C, req.Ubar, req.E, req.F, req.Reader, req.DataHash)
+}
+
 func (s *Service) Read(req *ReadRequest) (*ReadReply, error) {
-	sk := s.ServerIdentity().GetPrivate()
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
 	storedWrite, err := s.db.GetWrite(req.WriteID)
 	if err != nil {
 		log.Errorf("Read error: %v", err)
 		return nil, err
 	}
-	k, c, err := reencryptData(req, storedWrite, sk)
-	if k == nil || c == nil {
+	resp, err := s.reencrypt(req, storedWrite)
+	if err != nil {
 		log.Errorf("Read error: %v", err)
 		return nil, err
-		//return nil, errors.New("Could not reencrypt symmetric key")
 	}
-	resp := &ReadReply{
-		K: k,
-		C: c,
+	err = s.db.RecordRead(req, readerOf(req, storedWrite), time.Now())
+	if err != nil {
+		log.Errorf("Read error: %v", err)
+		return nil, err
+	}
+	if req.IncludeData {
+		if err = s.readData(storedWrite, req.Offset, req.Length, resp); err != nil {
+			log.Errorf("Read error: %v", err)
+			return nil, err
+		}
 	}
 	return resp, nil
 }
 
+// reencrypt checks the read request and returns the reply with the key of
+// the write re-encrypted to the reader. The caller has to hold keyLock.
+func (s *Service) reencrypt(req *ReadRequest, sw *WriteRequest) (*ReadReply, error) {
+	sk, err := s.keyFor(sw.ServerKey, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	k, c, proof, err := reencryptData(req, sw, sk)
+	if k == nil || c == nil {
+		if err == nil {
+			err = errors.New("Could not reencrypt symmetric key")
+		}
+		return nil, err
+	}
+	writeKey := sw.WriteKey
+	if writeKey == nil {
+		writeKey = cothority.Suite.Point().Mul(sk, nil)
+	}
+	return &ReadReply{
+		K:        k,
+		C:        c,
+		WriteKey: writeKey,
+		Rewraps:  sw.Rewraps,
+		Proof:    proof,
+	}, nil
+}
+
+// readerOf returns the key a read request is re-encrypted to.
+func readerOf(rr *ReadRequest, sw *WriteRequest) kyber.Point {
+	if len(sw.Policy) > 0 {
+		return rr.Reader
+	}
+	return sw.Reader
+}
+
+// GetAuditLog returns a range of the audit log of reads on this server.
+func (s *Service) GetAuditLog(req *GetAuditLogRequest) (*GetAuditLogReply, error) {
+	return s.db.GetAuditLog(req.Start, req.Count)
+}
+
+// ListWrites returns one page of the writes that can be read by a reader.
+// The request has to be signed by the reader.
+func (s *Service) ListWrites(req *ListWritesRequest) (*ListWritesReply, error) {
+	if err := s.verifyReader(ListAction, req.Reader, req.Timestamp, req.Sig, time.Now()); err != nil {
+		log.Errorf("ListWrites error: %v", err)
+		return nil, err
+	}
+	var cursor []byte
+	if len(req.Cursor) > 0 {
+		cursor = req.Cursor
+	}
+	writes, next, err := s.db.ListWrites(req.Reader, cursor, req.Limit)
+	if err != nil {
+		log.Errorf("ListWrites error: %v", err)
+		return nil, err
+	}
+	return &ListWritesReply{Writes: writes, Next: next}, nil
+}
+
+// CountWrites returns the number of writes that can be read by a reader.
+// The request has to be signed by the reader.
+func (s *Service) CountWrites(req *CountWritesRequest) (*CountWritesReply, error) {
+	if err := s.verifyReader(CountAction, req.Reader, req.Timestamp, req.Sig, time.Now()); err != nil {
+		log.Errorf("CountWrites error: %v", err)
+		return nil, err
+	}
+	count, err := s.db.CountWrites(req.Reader)
+	if err != nil {
+		log.Errorf("CountWrites error: %v", err)
+		return nil, err
+	}
+	return &CountWritesReply{Count: count}, nil
+}
+
+// UpdatePolicy gives read access to a new reader. The request has to be
+// signed by the owner of the write.
+func (s *Service) UpdatePolicy(req *UpdatePolicyRequest) (*UpdatePolicyReply, error) {
+	if req.Reader == nil && len(req.Policy) == 0 {
+		return nil, errors.New("Missing reader or policy")
+	}
+	if len(req.Policy) > 0 {
+		if err := verifyPolicyExpr(req.Policy); err != nil {
+			return nil, errors.New("Invalid policy: " + err.Error())
+		}
+	}
+	msg, err := PolicyUpdateMessage(req.WriteID, req.Version, req.Reader, req.Policy)
+	if err != nil {
+		log.Errorf("UpdatePolicy error: %v", err)
+		return nil, err
+	}
+	sw, err := s.db.UpdateWrite(req.WriteID, func(sw *WriteRequest) error {
+		if err := verifyOwner(sw, req.Version, msg, req.Sig); err != nil {
+			return err
+		}
+		if req.Reader != nil {
+			sw.Reader = req.Reader
+		}
+		sw.Policy = req.Policy
+		sw.Revoked = false
+		sw.Version++
+		return nil
+	})
+	if err != nil {
+		log.Errorf("UpdatePolicy error: %v", err)
+		return nil, err
+	}
+	return &UpdatePolicyReply{Version: sw.Version}, nil
+}
+
+// Revoke removes all read access to a write. The request has to be signed
+// by the owner of the write.
+func (s *Service) Revoke(req *RevokeRequest) (*RevokeReply, error) {
+	msg, err := RevokeMessage(req.WriteID, req.Version)
+	if err != nil {
+		log.Errorf("Revoke error: %v", err)
+		return nil, err
+	}
+	sw, err := s.db.UpdateWrite(req.WriteID, func(sw *WriteRequest) error {
+		if err := verifyOwner(sw, req.Version, msg, req.Sig); err != nil {
+			return err
+		}
+		sw.Revoked = true
+		sw.Version++
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Revoke error: %v", err)
+		return nil, err
+	}
+	return &RevokeReply{Version: sw.Version}, nil
+}
+
 // saves all data.
 func (s *Service) save() {
 	s.storage.Lock()
 	defer s.storage.Unlock()
-	err := s.Save(storageID, s.storage)
+	err := s.db.saveKeys(s.storage)
 	if err != nil {
 		log.Error("Couldn't save data:", err)
 	}
 }
 
 // Tries to load the configuration and updates the data in the service
-// if it finds a valid config-file.
+// if it finds a valid config-file. The keys are stored in the database of
+// the writes, see saveKeysTx.
 func (s *Service) tryLoad() error {
-	s.storage = &storage{}
-	//defer func() {
-	//if s.storage.Suite == nil {
-	//s.storage.Suite = edwards25519.NewBlakeSHA256Ed25519()
-	//}
-	//}()
-	msg, err := s.Load(storageID)
-	if err != nil {
-		return err
-	}
-	if msg == nil {
-		return nil
-	}
-	var ok bool
-	s.storage, ok = msg.(*storage)
-	log.Lvl3("After mesg")
-	if !ok {
-		return errors.New("Data of wrong type")
-	}
-	return nil
+	var err error
+	s.storage, err = s.db.loadKeys()
+	return err
 }
 
 // newService receives the context that holds information about the node it's
@@ -119,16 +328,26 @@ func (s *Service) tryLoad() error {
 // be stored in memory for tests and simulations, and on disk for real deployments.
 func newCentralizedCalypsoService(c *onet.Context) (onet.Service, error) {
 	db, bucket := c.GetAdditionalBucket([]byte("centralizedcalypsotransactions"))
+	cdb, err := NewCentralizedCalypsoDB(db, bucket)
+	if err != nil {
+		return nil, err
+	}
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
-		db:               NewCentralizedCalypsoDB(db, bucket),
+		db:               cdb,
+		closing:          make(chan bool),
 	}
-	if err := s.RegisterHandlers(s.Write, s.Read); err != nil {
+	if err := s.RegisterHandlers(s.Write, s.Read, s.UpdatePolicy, s.Revoke, s.GetAuditLog,
+		s.ListWrites, s.CountWrites, s.Delete, s.GetKey, s.RotateKey,
+		s.BeginUpload, s.UploadChunk, s.UploadStatus, s.FinishUpload, s.GetChunkInfo, s.GetChunk,
+		s.WriteBatch, s.ReadBatch, s.SetWriter, s.GetWriter); err != nil {
 		return nil, errors.New("Couldn't register messages")
 	}
 	if err := s.tryLoad(); err != nil {
 		log.Error(err)
 		return nil, err
 	}
+	s.wg.Add(1)
+	go s.sweep()
 	return s, nil
 }
@@ -3,12 +3,15 @@ package service
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"time"
 
 	"github.com/ceyhunalp/calypso_experiments/util"
 	bolt "github.com/coreos/bbolt"
 	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/darc/expression"
 	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/onet/log"
@@ -17,7 +20,21 @@ import (
 
 type CentralizedCalypsoDB struct {
 	*bolt.DB
-	bucketName []byte
+	bucketName  []byte
+	nonceBucket []byte
+	auditBucket []byte
+	// readerBucket and timeBucket index the writes by reader and by
+	// WriteTime.
+	readerBucket []byte
+	timeBucket   []byte
+	// expiryBucket indexes the writes that have a TTL by ExpireTime.
+	expiryBucket []byte
+	// keyBucket holds the encryption keys of the service.
+	keyBucket []byte
+	// chunks holds the data of the writes that were uploaded in chunks.
+	chunks *util.ChunkStore
+	// writers holds the registered writers and their quotas.
+	writers *util.WriterStore
 }
 
 type WriteRequest struct {
@@ -27,48 +44,504 @@ type WriteRequest struct {
 	C         kyber.Point
 	Reader    kyber.Point
 	EncReader []byte
+	// Replicas is set when the write is replicated across the roster. Every
+	// server picks the entry encrypted to its own key and stores it as K, C.
+	Replicas []*util.ReplicaKey
+	// Owner is the public key of the writer. Only the owner can change the
+	// read policy of a stored write.
+	Owner kyber.Point
+	// Policy is an optional darc expression over reader identities. If it
+	// is set, it replaces Reader as the read policy.
+	Policy expression.Expr
+	// Version and Revoked are maintained by the server and are reset when
+	// the write is stored.
+	Version int
+	Revoked bool
+	// WriteTime is the unix time at which the server stored the write.
+	WriteTime int64
+	// TTL is the number of seconds the write is kept. If it is 0, the write
+	// is kept until the owner deletes it. ExpireTime is set by the server.
+	TTL        int64
+	ExpireTime int64
+	// ServerKey is the encryption key of the server that K and C are
+	// encrypted to. If it is nil, they are encrypted to the identity key.
+	ServerKey kyber.Point
+	// WriteKey is the server key the writer encrypted K and C to, and
+	// Rewraps are the re-encryptions to the later keys of the server. Both
+	// are set by the server.
+	WriteKey kyber.Point
+	Rewraps  []*util.Rewrap
+	// Chunked is set by the server if EncData was uploaded in chunks and
+	// is stored separately.
+	Chunked bool
+	// Charged is the number of bytes the server charged to the quota of
+	// Owner for the write, which are released when it is deleted.
+	Charged int64
+	// Ubar, E and F prove that the writer knows the randomness of K, see
+	// util.EncryptWithProof.
+	Ubar kyber.Point
+	E    kyber.Scalar
+	F    kyber.Scalar
+	// Timestamp and Sig authenticate the write by Owner, see WriteDigest
+	// and util.WriteMessage. They are required once writers are registered.
+	Timestamp int64
+	Sig       []byte
 }
 
 type WriteReply struct {
 	WriteID string
 }
 
-type ReadRequest struct {
+// WriteDigest returns the digest of the write request that its owner signs,
+// which covers all of it but Sig.
+func WriteDigest(wr *WriteRequest) ([]byte, error) {
+	req := *wr
+	req.Sig = nil
+	return util.RequestDigest(&req)
+}
+
+// UpdatePolicyRequest replaces the reader and the policy of a stored write.
+// Sig is the signature of the owner over PolicyUpdateMessage.
+type UpdatePolicyRequest struct {
+	WriteID string
+	Version int
+	Reader  kyber.Point
+	Policy  expression.Expr
+	Sig     []byte
+}
+
+type UpdatePolicyReply struct {
+	Version int
+}
+
+// RevokeRequest revokes all read access to a stored write. Sig is the
+// signature of the owner over RevokeMessage.
+type RevokeRequest struct {
+	WriteID string
+	Version int
+	Sig     []byte
+}
+
+type RevokeReply struct {
+	Version int
+}
+
+// DeleteRequest removes a stored write. Sig is the signature of the owner
+// over DeleteMessage.
+type DeleteRequest struct {
 	WriteID string
+	Version int
 	Sig     []byte
 }
 
+type DeleteReply struct{}
+
+// BeginUploadRequest starts the upload of Size bytes of data in chunks of
+// util.ChunkSize. ChunkHashes are the sha256 hashes of the chunks. Write is
+// the signed write request that the data is stored with, whose DataHash
+// has to be the Merkle root of the chunks. It authenticates the upload.
+type BeginUploadRequest struct {
+	Size        int64
+	ChunkHashes [][]byte
+	Write       *WriteRequest
+}
+
+type BeginUploadReply struct {
+	SessionID string
+}
+
+// UploadChunkRequest sends the chunk with the given index.
+type UploadChunkRequest struct {
+	SessionID string
+	Index     int
+	Data      []byte
+	// Sig is the signature of the writer over util.ChunkMessage. It is
+	// required once writers are registered.
+	Sig []byte
+}
+
+type UploadChunkReply struct{}
+
+// UploadStatusRequest asks which chunks of an upload are still missing, so
+// that an interrupted upload can be resumed.
+type UploadStatusRequest struct {
+	SessionID string
+}
+
+type UploadStatusReply struct {
+	Missing []int
+}
+
+// FinishUploadRequest stores Write with the data of a complete upload.
+// The EncData of Write is empty and its DataHash is the Merkle root of the
+// chunks.
+type FinishUploadRequest struct {
+	SessionID string
+	Write     *WriteRequest
+}
+
+// GetChunkInfoRequest asks for the size and the chunk hashes of the data of
+// a write.
+type GetChunkInfoRequest struct {
+	WriteID string
+}
+
+type GetChunkInfoReply struct {
+	Size        int64
+	ChunkHashes [][]byte
+}
+
+// GetChunkRequest asks for one chunk of the data of a write.
+type GetChunkRequest struct {
+	WriteID string
+	Index   int
+}
+
+// GetChunkReply holds the chunk together with its Merkle path and the size
+// of the data, see util.VerifyChunk.
+type GetChunkReply struct {
+	Data []byte
+	Path [][]byte
+	Size int64
+}
+
+// GetKeyRequest asks a server for its current encryption key.
+type GetKeyRequest struct{}
+
+// GetKeyReply holds the encryption key of the server and the signature of
+// its identity key over util.KeyMessage.
+type GetKeyReply struct {
+	Public kyber.Point
+	Sig    []byte
+}
+
+// RotateKeyRequest makes the server replace its encryption key. Sig is the
+// signature of the identity key of the server over util.AdminMessage, with
+// the current encryption key as data, so that the request cannot be
+// replayed after the rotation.
+type RotateKeyRequest struct {
+	Timestamp int64
+	Sig       []byte
+}
+
+// RotateKeyReply holds the new encryption key and the number of writes
+// whose keys were re-encrypted to it.
+type RotateKeyReply struct {
+	Public    kyber.Point
+	Rewrapped int
+}
+
+// SetWriterRequest registers Writer with the given quota, or removes it.
+// Version is the version of the writers of the server the request applies
+// to, see GetWriterReply. Sig is the signature of the identity key of the
+// server over util.AdminMessage with util.WriterData.
+type SetWriterRequest struct {
+	Writer    kyber.Point
+	Quota     util.Quota
+	Remove    bool
+	Version   int64
+	Timestamp int64
+	Sig       []byte
+}
+
+// SetWriterReply holds the number of bytes the writer has stored.
+type SetWriterReply struct {
+	Used int64
+}
+
+// GetWriterRequest asks for the registration of Writer.
+type GetWriterRequest struct {
+	Writer kyber.Point
+}
+
+// GetWriterReply holds the quota of the writer and the bytes it has stored,
+// if it is Registered, and the version of the writers of the server, which
+// increases with every SetWriterRequest.
+type GetWriterReply struct {
+	Registered bool
+	Quota      util.Quota
+	Used       int64
+	Version    int64
+}
+
+// ReadRequest asks for the re-encryption of the key of a write. All
+// signatures are over ReadMessage, which binds them to the fresh Nonce, to
+// the Timestamp, a unix time in seconds, and to the Reader.
+type ReadRequest struct {
+	WriteID   string
+	Nonce     []byte
+	Timestamp int64
+	Sig       []byte
+	// Reader and Signatures are used for writes with a policy: the key is
+	// re-encrypted to Reader, who signs with Sig, and Signatures hold the
+	// signatures of the co-signers.
+	Reader     kyber.Point
+	Signatures []*PolicySignature
+	// If IncludeData is set, the reply also holds the encrypted data,
+	// starting at byte Offset. Length limits the number of bytes returned,
+	// 0 means up to the end or MaxReadLength.
+	IncludeData bool
+	Offset      int64
+	Length      int64
+}
+
+// ReadReply holds the key re-encrypted to the reader. If the data was
+// requested, EncData holds the bytes of the encrypted data starting at
+// Offset, Size is the size of all of it and DataHash is its hash.
+//
+// WriteKey is the server key the writer encrypted to and Rewraps lead from
+// the ciphertext of the writer to the one the server holds now. Proof shows
+// that K and C hold the same key as the latter, see util.VerifyRewraps and
+// util.VerifyReencryption.
 type ReadReply struct {
-	K kyber.Point
-	C kyber.Point
+	K        kyber.Point
+	C        kyber.Point
+	WriteKey kyber.Point
+	Rewraps  []*util.Rewrap
+	Proof    *util.ReencryptProof
+	EncData  []byte
+	Offset   int64
+	Size     int64
+	DataHash []byte
+}
+
+// WriteBatchRequest stores many writes in a single transaction.
+type WriteBatchRequest struct {
+	Writes []*WriteRequest
+}
+
+// WriteBatchReply holds the outcome of every write of a batch, in the order
+// of the request. If Errors[i] is empty, write i was stored under
+// WriteIDs[i].
+type WriteBatchReply struct {
+	WriteIDs []string
+	Errors   []string
+}
+
+// ReadBatchRequest asks for the re-encryption of many keys at once.
+type ReadBatchRequest struct {
+	Reads []*ReadRequest
+}
+
+// ReadBatchReply holds the outcome of every read of a batch, in the order
+// of the request. If Errors[i] is not empty, Replies[i] is empty.
+type ReadBatchReply struct {
+	Replies []*ReadReply
+	Errors  []string
+}
+
+// AuditEntry records one successful read. Hash covers all other fields, and
+// PrevHash is the Hash of the previous entry, so that the entries form a
+// hash chain.
+type AuditEntry struct {
+	Index     int
+	Reader    kyber.Point
+	WriteID   string
+	Timestamp int64
+	PrevHash  []byte
+	Hash      []byte
+}
+
+// GetAuditLogRequest asks for Count entries of the audit log of a server,
+// starting at index Start.
+type GetAuditLogRequest struct {
+	Start int
+	Count int
+}
+
+// GetAuditLogReply holds the requested entries together with the current
+// length of the log and the hash of its last entry.
+type GetAuditLogReply struct {
+	Entries []*AuditEntry
+	Length  int
+	Head    []byte
+}
+
+// ListWritesRequest asks for at most Limit writes that can be read by
+// Reader, sorted by the time they were stored. If Reader is nil, all writes
+// are listed. Cursor is the Next value of the previous reply, or empty for
+// the first page. Sig is the signature of Reader, or of the identity key of
+// the server if Reader is nil, over ReaderMessage at Timestamp.
+type ListWritesRequest struct {
+	Reader    kyber.Point
+	Cursor    []byte
+	Limit     int
+	Timestamp int64
+	Sig       []byte
+}
+
+// ListWritesReply holds one page of writes. Next is empty if there are no
+// more writes.
+type ListWritesReply struct {
+	Writes []*WriteInfo
+	Next   []byte
+}
+
+// WriteInfo describes a stored write without its data.
+type WriteInfo struct {
+	WriteID   string
+	WriteTime int64
+	Owner     kyber.Point
+	Version   int
+	Revoked   bool
+}
+
+// CountWritesRequest asks for the number of writes that can be read by
+// Reader, or of all writes if Reader is nil. It is signed like a
+// ListWritesRequest.
+type CountWritesRequest struct {
+	Reader    kyber.Point
+	Timestamp int64
+	Sig       []byte
+}
+
+type CountWritesReply struct {
+	Count int
+}
+
+// PolicyUpdateMessage returns the message the owner signs to give access
+// to a new reader or policy. The version prevents old updates from being
+// replayed.
+func PolicyUpdateMessage(wID string, version int, reader kyber.Point, policy expression.Expr) ([]byte, error) {
+	var data []byte
+	if reader != nil {
+		readerBytes, err := reader.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, readerBytes...)
+	}
+	data = append(data, policy...)
+	return policyMessage(wID, "update", version, data)
+}
+
+// RevokeMessage returns the message the owner signs to revoke access.
+func RevokeMessage(wID string, version int) ([]byte, error) {
+	return policyMessage(wID, "revoke", version, nil)
+}
+
+func policyMessage(wID string, action string, version int, data []byte) ([]byte, error) {
+	widBytes, err := hex.DecodeString(wID)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write(widBytes)
+	h.Write([]byte(action))
+	binary.Write(h, binary.LittleEndian, int64(version))
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+// ReadMessage returns the message that is signed by the readers of rr. It
+// includes rr.Reader, so that the co-signers agree on who gets the key.
+func ReadMessage(rr *ReadRequest) ([]byte, error) {
+	widBytes, err := hex.DecodeString(rr.WriteID)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write(widBytes)
+	h.Write(rr.Nonce)
+	binary.Write(h, binary.LittleEndian, rr.Timestamp)
+	if rr.Reader != nil {
+		readerBytes, err := rr.Reader.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		h.Write(readerBytes)
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyFreshness checks that the read request has a nonce and that its
+// timestamp is within ReadWindow of now.
+func verifyFreshness(rr *ReadRequest, now time.Time) error {
+	if len(rr.Nonce) < NonceLen {
+		return errors.New("Nonce is too short")
+	}
+	ts := time.Unix(rr.Timestamp, 0)
+	if ts.Before(now.Add(-ReadWindow)) || ts.After(now.Add(ReadWindow)) {
+		return errors.New("Read request timestamp is outside of the window")
+	}
+	return nil
+}
+
+// verifyOwner checks that the request applies to the current version of
+// the write and that it is signed by the owner.
+func verifyOwner(sw *WriteRequest, version int, msg []byte, sig []byte) error {
+	if sw.Owner == nil {
+		return errors.New("Write has no owner")
+	}
+	if version != sw.Version {
+		return errors.New("Policy version does not match")
+	}
+	return schnorr.Verify(cothority.Suite, sw.Owner, msg, sig)
+}
+
+// verifyReadPolicy checks that the signatures of the read request satisfy
+// the read policy of the write and returns the key of the reader.
+func verifyReadPolicy(rr *ReadRequest, sw *WriteRequest, msg []byte) (kyber.Point, error) {
+	if len(sw.Policy) > 0 {
+		if err := verifyPolicy(sw.Policy, rr.Reader, msg, rr.Sig, rr.Signatures); err != nil {
+			return nil, err
+		}
+		return rr.Reader, nil
+	}
+	if err := schnorr.Verify(cothority.Suite, sw.Reader, msg, rr.Sig); err != nil {
+		return nil, err
+	}
+	return sw.Reader, nil
 }
 
-func reencryptData(rr *ReadRequest, sw *WriteRequest, sk kyber.Scalar) (kyber.Point, kyber.Point, error) {
+// reencryptData checks the read request and re-encrypts the key of the
+// write to the reader, together with a proof of the re-encryption.
+func reencryptData(rr *ReadRequest, sw *WriteRequest, sk kyber.Scalar) (kyber.Point, kyber.Point, *util.ReencryptProof, error) {
+	if sw.Revoked {
+		log.Errorf("reencryptData error: access has been revoked")
+		return nil, nil, nil, errors.New("Access has been revoked")
+	}
+	if sw.expired(time.Now()) {
+		log.Errorf("reencryptData error: write has expired")
+		return nil, nil, nil, errors.New("Write has expired")
+	}
 	// Check that the writeIDs match
 	widBytes, err := hex.DecodeString(rr.WriteID)
 	if err != nil {
 		log.Errorf("reencryptData error: %v", err)
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	ok := bytes.Compare(widBytes, sw.DataHash)
 	if ok != 0 {
 		log.Errorf("reencryptData error: %v", err)
-		return nil, nil, errors.New("WriteIDs do not match")
+		return nil, nil, nil, errors.New("WriteIDs do not match")
 	}
 
-	// Verify the signature on read request against the policy in WR
-	err = schnorr.Verify(cothority.Suite, sw.Reader, widBytes, rr.Sig)
+	// Check that the request is fresh
+	err = verifyFreshness(rr, time.Now())
+	if err != nil {
+		log.Errorf("reencryptData error: %v", err)
+		return nil, nil, nil, err
+	}
+	msg, err := ReadMessage(rr)
 	if err != nil {
 		log.Errorf("reencryptData error: %v", err)
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	// Get the symmetric key
-	symKey, err := util.ElGamalDecrypt(sk, sw.K, sw.C)
+	// Verify the signature on read request against the policy in WR
+	reader, err := verifyReadPolicy(rr, sw, msg)
 	if err != nil {
 		log.Errorf("reencryptData error: %v", err)
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
+
+	// Get the symmetric key
+	//symKey, err := util.ElGamalDecrypt(sk, sw.K, sw.C)
+	//if err != nil {
+	//log.Errorf("reencryptData error: %v", err)
+	//return nil, nil, err
+	//}
 	// Check that the reader is "the reader"
 	//decReader, err := util.AeadOpen(symKey, sw.EncReader)
 	//if err != nil {
@@ -86,8 +559,12 @@ func reencryptData(rr *ReadRequest, sw *WriteRequest, sk kyber.Scalar) (kyber.Po
 	//return nil, nil, errors.New("Reader public key does not match")
 	//}
 	// Reencrypt the symmetric key for the reader
-	k, c, _ := util.ElGamalEncrypt(sw.Reader, symKey)
-	return k, c, nil
+	k, c, proof, err := util.Reencrypt(sk, sw.K, sw.C, reader)
+	if err != nil {
+		log.Errorf("reencryptData error: %v", err)
+		return nil, nil, nil, err
+	}
+	return k, c, proof, nil
 }
 
 func (cdb *CentralizedCalypsoDB) getFromTx(tx *bolt.Tx, key []byte) (*WriteRequest, error) {
@@ -126,41 +603,214 @@ func (cdb *CentralizedCalypsoDB) GetWrite(wID string) (*WriteRequest, error) {
 	return result, err
 }
 
-func (cdb *CentralizedCalypsoDB) StoreWrite(req *WriteRequest) (string, error) {
-	dataHash := sha256.Sum256(req.EncData)
-	if bytes.Compare(dataHash[:], req.DataHash) != 0 {
-		log.Errorf("StoreWrite error: Hashes do not match")
-		return "", errors.New("Hashes do not match")
-	}
-	val, err := network.Marshal(req)
+// UpdateWrite loads the write with the given ID, applies update to it and
+// stores the result, all within one transaction. If update returns an
+// error, nothing is changed.
+func (cdb *CentralizedCalypsoDB) UpdateWrite(wID string, update func(*WriteRequest) error) (*WriteRequest, error) {
+	var result *WriteRequest
+	key, err := hex.DecodeString(wID)
 	if err != nil {
-		log.Errorf("StoreWrite error: Cannot marshal write request")
-		return "", errors.New("Cannot marshal write request")
+		log.Errorf("UpdateWrite error: %v", err)
+		return nil, err
 	}
 	err = cdb.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(cdb.bucketName)
-		v := b.Get(dataHash[:])
-		if v != nil {
-			log.Errorf("StoreWrite error: Key already exists")
-			return errors.New("Key already exists")
+		old, err := cdb.getFromTx(tx, key)
+		if err != nil {
+			return err
 		}
-		err := b.Put(dataHash[:], val)
+		v, err := cdb.getFromTx(tx, key)
 		if err != nil {
-			log.Errorf("StoreWrite error: Cannot store the value")
-			return errors.New("Cannot store the value")
+			return err
 		}
+		if err = update(v); err != nil {
+			return err
+		}
+		if err = cdb.reindexReadersTx(tx, old, v, key); err != nil {
+			return err
+		}
+		if err = cdb.putTx(tx, key, v); err != nil {
+			return err
+		}
+		result = v
 		return nil
 	})
 	if err != nil {
+		log.Errorf("UpdateWrite error: %v", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// putTx replaces the stored write under key.
+func (cdb *CentralizedCalypsoDB) putTx(tx *bolt.Tx, key []byte, sw *WriteRequest) error {
+	val, err := network.Marshal(sw)
+	if err != nil {
+		return errors.New("Cannot marshal write request")
+	}
+	if err = tx.Bucket(cdb.bucketName).Put(key, val); err != nil {
+		return errors.New("Cannot store the value")
+	}
+	return nil
+}
+
+func (cdb *CentralizedCalypsoDB) StoreWrite(req *WriteRequest) (string, error) {
+	if err := checkDataHash(req); err != nil {
 		log.Errorf("StoreWrite error: %v", err)
 		return "", err
 	}
-	return hex.EncodeToString(dataHash[:]), nil
+	req.Chunked = false
+	return cdb.storeWrite(req, int64(len(req.EncData)), nil)
 }
 
-func NewCentralizedCalypsoDB(db *bolt.DB, bn []byte) *CentralizedCalypsoDB {
-	return &CentralizedCalypsoDB{
-		DB:         db,
-		bucketName: bn,
+// checkDataHash makes sure that the DataHash of a write with inline data
+// matches EncData.
+func checkDataHash(req *WriteRequest) error {
+	if !bytes.Equal(util.DataHash(req.EncData), req.DataHash) {
+		return errors.New("Hashes do not match")
+	}
+	return nil
+}
+
+// StoreChunkedWrite stores a write whose data of size bytes was uploaded in
+// chunks in the given upload session. The DataHash of the write has to be
+// the Merkle root of the chunks.
+func (cdb *CentralizedCalypsoDB) StoreChunkedWrite(req *WriteRequest, sessionID string, size int64) (string, error) {
+	if len(req.EncData) > 0 {
+		log.Errorf("StoreChunkedWrite error: Data is sent in chunks")
+		return "", errors.New("Data is sent in chunks")
+	}
+	req.Chunked = true
+	// The upload has reserved its bytes, which are charged to the write.
+	return cdb.storeWrite(req, size, func(tx *bolt.Tx) error {
+		cd, unreserved, err := cdb.chunks.FinishUploadTx(tx, sessionID, req.DataHash, req.Owner)
+		if err != nil {
+			return err
+		}
+		if cd.Size != size {
+			return errors.New("Wrong size of the uploaded data")
+		}
+		return cdb.writers.ChargeTx(tx, req.Owner, unreserved)
+	})
+}
+
+// storeWrite checks and stores the write under its DataHash, which is
+// charged with size bytes. The inline data is charged here, and chunked
+// data has to be charged by finish. If it is not nil, finish is called
+// within the same transaction.
+func (cdb *CentralizedCalypsoDB) storeWrite(req *WriteRequest, size int64, finish func(*bolt.Tx) error) (string, error) {
+	val, err := prepareWrite(req, size)
+	if err != nil {
+		log.Errorf("StoreWrite error: %v", err)
+		return "", err
+	}
+	err = cdb.DB.Update(func(tx *bolt.Tx) error {
+		if err := cdb.checkNewTx(tx, req.DataHash); err != nil {
+			return err
+		}
+		if err := cdb.writers.ChargeTx(tx, req.Owner, int64(len(req.EncData))); err != nil {
+			return err
+		}
+		if finish != nil {
+			if err := finish(tx); err != nil {
+				return err
+			}
+		}
+		return cdb.storeWriteTx(tx, req, val)
+	})
+	if err != nil {
+		log.Errorf("StoreWrite error: %v", err)
+		return "", err
+	}
+	return hex.EncodeToString(req.DataHash), nil
+}
+
+// prepareWrite checks a new write that is charged with the given number of
+// bytes, sets the fields that are managed by the server and returns the
+// marshalled write.
+func prepareWrite(req *WriteRequest, charged int64) ([]byte, error) {
+	if len(req.Policy) > 0 {
+		if err := verifyPolicyExpr(req.Policy); err != nil {
+			return nil, errors.New("Invalid policy: " + err.Error())
+		}
+	} else if req.Reader == nil {
+		return nil, errors.New("Missing reader")
+	}
+	if req.TTL < 0 {
+		return nil, errors.New("Negative TTL")
+	}
+	req.Version = 0
+	req.Revoked = false
+	req.Charged = charged
+	req.WriteTime = time.Now().Unix()
+	req.ExpireTime = 0
+	if req.TTL > 0 {
+		req.ExpireTime = req.WriteTime + req.TTL
+	}
+	val, err := network.Marshal(req)
+	if err != nil {
+		return nil, errors.New("Cannot marshal write request")
+	}
+	return val, nil
+}
+
+// checkNewTx fails if a write is already stored under key.
+func (cdb *CentralizedCalypsoDB) checkNewTx(tx *bolt.Tx, key []byte) error {
+	if tx.Bucket(cdb.bucketName).Get(key) != nil {
+		return errors.New("Key already exists")
+	}
+	return nil
+}
+
+// storeWriteTx stores a write prepared by prepareWrite under its DataHash
+// and indexes it.
+func (cdb *CentralizedCalypsoDB) storeWriteTx(tx *bolt.Tx, req *WriteRequest, val []byte) error {
+	key := req.DataHash
+	if err := tx.Bucket(cdb.bucketName).Put(key, val); err != nil {
+		return errors.New("Cannot store the value")
+	}
+	if req.ExpireTime > 0 {
+		err := tx.Bucket(cdb.expiryBucket).Put(timeKey(req.ExpireTime, key), key)
+		if err != nil {
+			return err
+		}
+	}
+	return cdb.indexWriteTx(tx, req, key)
+}
+
+func NewCentralizedCalypsoDB(db *bolt.DB, bn []byte) (*CentralizedCalypsoDB, error) {
+	cdb := &CentralizedCalypsoDB{
+		DB:           db,
+		bucketName:   bn,
+		nonceBucket:  append(append([]byte{}, bn...), []byte("_nonces")...),
+		auditBucket:  append(append([]byte{}, bn...), []byte("_audit")...),
+		readerBucket: append(append([]byte{}, bn...), []byte("_byreader")...),
+		timeBucket:   append(append([]byte{}, bn...), []byte("_bytime")...),
+		expiryBucket: append(append([]byte{}, bn...), []byte("_expiry")...),
+		keyBucket:    append(append([]byte{}, bn...), []byte("_keys")...),
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{cdb.nonceBucket, cdb.auditBucket, cdb.readerBucket,
+			cdb.timeBucket, cdb.expiryBucket, cdb.keyBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("NewCentralizedCalypsoDB error: %v", err)
+		return nil, err
+	}
+	cdb.chunks, err = util.NewChunkStore(db, bn)
+	if err != nil {
+		log.Errorf("NewCentralizedCalypsoDB error: %v", err)
+		return nil, err
+	}
+	cdb.writers, err = util.NewWriterStore(db, bn)
+	if err != nil {
+		log.Errorf("NewCentralizedCalypsoDB error: %v", err)
+		return nil, err
 	}
+	cdb.chunks.Writers = cdb.writers
+	return cdb, nil
 }
@@ -0,0 +1,192 @@
+package service
+
+/*
+The upload.go lets clients upload and download the data of large writes
+in chunks of util.ChunkSize, so that it does not have to fit in one
+message.
+*/
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	"github.com/dedis/onet/log"
+)
+
+// MaxReadLength is the maximum number of bytes of data returned by a read
+// request. Larger data has to be downloaded in chunks.
+const MaxReadLength = 16 * util.ChunkSize
+
+// BeginUpload starts a new upload session.
+func (s *Service) BeginUpload(req *BeginUploadRequest) (*BeginUploadReply, error) {
+	if req.Write == nil {
+		return nil, errors.New("Missing write request")
+	}
+	if !bytes.Equal(req.Write.DataHash, util.MerkleRoot(req.ChunkHashes)) {
+		return nil, errors.New("Data hash is not the root of the chunks")
+	}
+	if err := s.authWrite(req.Write, req.Size, time.Now()); err != nil {
+		log.Errorf("BeginUpload error: %v", err)
+		return nil, err
+	}
+	id, err := s.db.chunks.BeginUpload(req.Size, req.ChunkHashes, req.Write.Owner, time.Now())
+	if err != nil {
+		log.Errorf("BeginUpload error: %v", err)
+		return nil, err
+	}
+	return &BeginUploadReply{SessionID: id}, nil
+}
+
+// UploadChunk stores one chunk of an upload session.
+func (s *Service) UploadChunk(req *UploadChunkRequest) (*UploadChunkReply, error) {
+	if err := s.db.chunks.PutChunk(req.SessionID, req.Index, req.Data, req.Sig); err != nil {
+		return nil, err
+	}
+	return &UploadChunkReply{}, nil
+}
+
+// UploadStatus returns the chunks that are missing in an upload session.
+func (s *Service) UploadStatus(req *UploadStatusRequest) (*UploadStatusReply, error) {
+	missing, err := s.db.chunks.MissingChunks(req.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadStatusReply{Missing: missing}, nil
+}
+
+// FinishUpload stores a write whose data was uploaded in chunks.
+func (s *Service) FinishUpload(req *FinishUploadRequest) (*WriteReply, error) {
+	if req.Write == nil {
+		return nil, errors.New("Missing write request")
+	}
+	wr := req.Write
+	// The bytes reserved by BeginUpload are already charged, only the
+	// rest has to fit in the quota.
+	size, reserved, err := s.db.chunks.SessionSize(req.SessionID)
+	if err != nil {
+		log.Errorf("FinishUpload error: %v", err)
+		return nil, err
+	}
+	if err = s.authWrite(wr, size-reserved, time.Now()); err != nil {
+		log.Errorf("FinishUpload error: %v", err)
+		return nil, err
+	}
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+	if err = s.checkWrite(wr); err != nil {
+		log.Errorf("FinishUpload error: %v", err)
+		return nil, err
+	}
+	storedKey, err := s.db.StoreChunkedWrite(wr, req.SessionID, size)
+	if err != nil {
+		log.Errorf("FinishUpload error: %v", err)
+		return nil, err
+	}
+	return &WriteReply{WriteID: storedKey}, nil
+}
+
+// GetChunkInfo returns the size and the chunk hashes of the data of a
+// write.
+func (s *Service) GetChunkInfo(req *GetChunkInfoRequest) (*GetChunkInfoReply, error) {
+	sw, key, err := s.chunkedWrite(req.WriteID)
+	if err != nil {
+		return nil, err
+	}
+	if !sw.Chunked {
+		return &GetChunkInfoReply{Size: int64(len(sw.EncData)), ChunkHashes: util.ChunkHashes(sw.EncData)}, nil
+	}
+	cd, err := s.db.chunks.GetChunkedData(key)
+	if err != nil {
+		log.Errorf("GetChunkInfo error: %v", err)
+		return nil, err
+	}
+	return &GetChunkInfoReply{Size: cd.Size, ChunkHashes: cd.ChunkHashes}, nil
+}
+
+// GetChunk returns one chunk of the data of a write with its Merkle path.
+func (s *Service) GetChunk(req *GetChunkRequest) (*GetChunkReply, error) {
+	sw, key, err := s.chunkedWrite(req.WriteID)
+	if err != nil {
+		return nil, err
+	}
+	if !sw.Chunked {
+		if req.Index < 0 || req.Index >= util.NumChunks(int64(len(sw.EncData))) {
+			return nil, fmt.Errorf("Invalid chunk index %d", req.Index)
+		}
+		return &GetChunkReply{Data: util.DataChunk(sw.EncData, req.Index),
+			Path: util.MerklePath(util.ChunkHashes(sw.EncData), req.Index), Size: int64(len(sw.EncData))}, nil
+	}
+	cd, err := s.db.chunks.GetChunkedData(key)
+	if err != nil {
+		log.Errorf("GetChunk error: %v", err)
+		return nil, err
+	}
+	chunk, err := s.db.chunks.GetChunk(key, req.Index)
+	if err != nil {
+		log.Errorf("GetChunk error: %v", err)
+		return nil, err
+	}
+	return &GetChunkReply{Data: chunk, Path: util.MerklePath(cd.ChunkHashes, req.Index), Size: cd.Size}, nil
+}
+
+// readData fills the reply to a read request with length bytes of the
+// data of the write, starting at offset.
+func (s *Service) readData(sw *WriteRequest, offset, length int64, reply *ReadReply) error {
+	size := int64(len(sw.EncData))
+	if sw.Chunked {
+		cd, err := s.db.chunks.GetChunkedData(sw.DataHash)
+		if err != nil {
+			return err
+		}
+		size = cd.Size
+	}
+	if offset < 0 || offset > size || length < 0 {
+		return errors.New("Invalid range")
+	}
+	if length == 0 || length > MaxReadLength {
+		length = MaxReadLength
+	}
+	end := offset + length
+	if end > size {
+		end = size
+	}
+	reply.Offset = offset
+	reply.Size = size
+	reply.DataHash = sw.DataHash
+	if !sw.Chunked {
+		reply.EncData = sw.EncData[offset:end]
+		return nil
+	}
+	var data []byte
+	first := offset / util.ChunkSize
+	for i := first; i*util.ChunkSize < end; i++ {
+		chunk, err := s.db.chunks.GetChunk(sw.DataHash, int(i))
+		if err != nil {
+			return err
+		}
+		data = append(data, chunk...)
+	}
+	start := offset - first*util.ChunkSize
+	reply.EncData = data[start : start+end-offset]
+	return nil
+}
+
+// chunkedWrite returns the write with the given ID, if it has not expired.
+func (s *Service) chunkedWrite(wID string) (*WriteRequest, []byte, error) {
+	key, err := hex.DecodeString(wID)
+	if err != nil {
+		return nil, nil, err
+	}
+	sw, err := s.db.GetWrite(wID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sw.expired(time.Now()) {
+		return nil, nil, errors.New("Write has expired")
+	}
+	return sw, key, nil
+}
@@ -37,6 +37,10 @@ type SimulationService struct {
 	NumWriteTransactions int
 	NumReadTransactions  int
 	NumBlocks            int
+	Quorum               int
+	// Batched sends all writes and all reads of a round in one request
+	// each, like AddReadBatch and DecryptKeyBatch on byzcoin.
+	Batched bool
 }
 
 // NewSimulationService returns the new simulation, where all fields are
@@ -185,7 +189,7 @@ func (s *SimulationService) runCentralizedByzgen(config *onet.SimulationConfig)
 				writeIdx++
 			} else {
 				rt := monitor.NewTimeMeasure("ReadTxn")
-				readKList[readIdx], readCList[readIdx], err = centralized.CreateReadTxn(config.Roster, wdList[lastWriteIdx].StoredKey, rSk)
+				readKList[readIdx], readCList[readIdx], err = centralized.CreateReadTxn(config.Roster, wdList[lastWriteIdx], rSk)
 				if err != nil {
 					return err
 				}
@@ -238,7 +242,7 @@ func (s *SimulationService) runDecrypt(config *onet.SimulationConfig) error {
 			}
 		}
 		for i := 0; i < s.BatchSize; i++ {
-			readKList[i], readCList[i], err = centralized.CreateReadTxn(config.Roster, wdList[i].StoredKey, rSk)
+			readKList[i], readCList[i], err = centralized.CreateReadTxn(config.Roster, wdList[i], rSk)
 			if err != nil {
 				log.Errorf("CreateReadTxn failed: %v", err)
 				return err
@@ -301,7 +305,7 @@ func (s *SimulationService) runMicrobenchmark(config *onet.SimulationConfig) err
 
 		crt := monitor.NewTimeMeasure("CreateReadTxn")
 		for i := 0; i < s.BatchSize; i++ {
-			readKList[i], readCList[i], err = centralized.CreateReadTxn(config.Roster, wdList[i].StoredKey, rSk)
+			readKList[i], readCList[i], err = centralized.CreateReadTxn(config.Roster, wdList[i], rSk)
 			if err != nil {
 				log.Errorf("CreateReadTxn failed: %v", err)
 				return err
@@ -318,12 +322,129 @@ func (s *SimulationService) runMicrobenchmark(config *onet.SimulationConfig) err
 	return nil
 }
 
+func (s *SimulationService) runReplicated(config *onet.SimulationConfig) error {
+	var err error
+	log.Info("Write quorum is:", s.Quorum)
+	serverKeys := config.Roster.Publics()
+	wdList := make([]*util.WriteData, s.BatchSize)
+	readKList := make([]kyber.Point, s.BatchSize)
+	readCList := make([]kyber.Point, s.BatchSize)
+	for round := 0; round < s.Rounds; round++ {
+		log.Lvl1("Starting round", round)
+
+		rSk := cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
+		rPk := cothority.Suite.Point().Mul(rSk, nil)
+
+		for i := 0; i < s.BatchSize; i++ {
+			data := make([]byte, DATA_SIZE)
+			rand.Read(data)
+			wdList[i], err = util.CreateReplicatedWriteData(data, rPk, serverKeys, false)
+			if err != nil {
+				log.Errorf("CreateReplicatedWriteData failed: %v", err)
+				return err
+			}
+		}
+		cwt := monitor.NewTimeMeasure("ReplicatedWriteTxn")
+		for i := 0; i < s.BatchSize; i++ {
+			wdList[i], err = centralized.CreateReplicatedWriteTxn(config.Roster, wdList[i], s.Quorum)
+			if err != nil {
+				log.Errorf("CreateReplicatedWriteTxn failed: %v", err)
+				return err
+			}
+		}
+		cwt.Record()
+		crt := monitor.NewTimeMeasure("ReplicatedReadTxn")
+		for i := 0; i < s.BatchSize; i++ {
+			readKList[i], readCList[i], err = centralized.CreateReplicatedReadTxn(config.Roster, wdList[i], rSk, s.Quorum)
+			if err != nil {
+				log.Errorf("CreateReplicatedReadTxn failed: %v", err)
+				return err
+			}
+			_, err := util.RecoverData(wdList[i].Data, rSk, readKList[i], readCList[i])
+			if err != nil {
+				log.Errorf("RecoverData failed: %v", err)
+				return err
+			}
+		}
+		crt.Record()
+	}
+	return nil
+}
+
+func (s *SimulationService) runBatched(config *onet.SimulationConfig) error {
+	var err error
+	log.Info("Batch size is:", s.BatchSize)
+	serverKeys := config.Roster.Publics()
+	wdList := make([]*util.WriteData, s.BatchSize)
+	for round := 0; round < s.Rounds; round++ {
+		log.Lvl1("Starting round", round)
+
+		rSk := cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
+		rPk := cothority.Suite.Point().Mul(rSk, nil)
+
+		for i := 0; i < s.BatchSize; i++ {
+			data := make([]byte, DATA_SIZE)
+			rand.Read(data)
+			if s.Quorum > 0 {
+				wdList[i], err = util.CreateReplicatedWriteData(data, rPk, serverKeys, false)
+			} else {
+				wdList[i], err = util.CreateWriteData(data, rPk, serverKeys[0], false)
+			}
+			if err != nil {
+				log.Errorf("CreateWriteData failed: %v", err)
+				return err
+			}
+		}
+		cwt := monitor.NewTimeMeasure("WriteBatchTxn")
+		errs, err := centralized.CreateWriteBatchTxn(config.Roster, wdList, s.Quorum)
+		if err != nil {
+			log.Errorf("CreateWriteBatchTxn failed: %v", err)
+			return err
+		}
+		cwt.Record()
+		for i := range wdList {
+			if errs[i] != nil {
+				log.Errorf("CreateWriteBatchTxn failed: %v", errs[i])
+				return errs[i]
+			}
+		}
+		crt := monitor.NewTimeMeasure("ReadBatchTxn")
+		readKList, readCList, errs, err := centralized.CreateReadBatchTxn(config.Roster, wdList, rSk, s.Quorum)
+		if err != nil {
+			log.Errorf("CreateReadBatchTxn failed: %v", err)
+			return err
+		}
+		crt.Record()
+		rvt := monitor.NewTimeMeasure("Recoverdata")
+		for i := range wdList {
+			if errs[i] != nil {
+				log.Errorf("CreateReadBatchTxn failed: %v", errs[i])
+				return errs[i]
+			}
+			_, err := util.RecoverData(wdList[i].Data, rSk, readKList[i], readCList[i])
+			if err != nil {
+				log.Errorf("RecoverData failed: %v", err)
+				return err
+			}
+		}
+		rvt.Record()
+	}
+	return nil
+}
+
 // Run is used on the destination machines and runs a number of
 // rounds
 func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 	//err := s.runMicrobenchmark(config)
 	//err := s.runCentralizedByzgen(config)
-	err := s.runDecrypt(config)
+	var err error
+	if s.Batched {
+		err = s.runBatched(config)
+	} else if s.Quorum > 0 {
+		err = s.runReplicated(config)
+	} else {
+		err = s.runDecrypt(config)
+	}
 	if err != nil {
 		log.Errorf("RunCentralized error: %v", err)
 	}
@@ -1,7 +1,8 @@
 package semicentralized
 
 import (
-	"encoding/hex"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/ceyhunalp/calypso_experiments/util"
@@ -14,6 +15,7 @@ import (
 	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
 	"github.com/dedis/protobuf"
 )
 
@@ -22,6 +24,13 @@ const ServiceName = "SemiCentralizedService"
 type SCClient struct {
 	BcClient *byzcoin.Client
 	c        *onet.Client
+	// replicas is the number of roster members the data is stored on. If
+	// it is 0, only the first member is used.
+	replicas int
+	// keys caches the signed encryption keys of the servers, see
+	// signedKey.
+	keys     map[network.ServerIdentityID][]kyber.Point
+	keysLock sync.Mutex
 }
 
 func NewClient(bc *byzcoin.Client) *SCClient {
@@ -30,7 +39,7 @@ func NewClient(bc *byzcoin.Client) *SCClient {
 
 func SetupByzcoin(r *onet.Roster, blockInterval int) (cl *byzcoin.Client, admin darc.Signer, gDarc darc.Darc, err error) {
 	admin = darc.NewSignerEd25519(nil, nil)
-	gMsg, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, r, []string{"spawn:" + byzcoin.ContractDarcID, "spawn:" + calypso.ContractSemiWriteID, "spawn:" + calypso.ContractReadID}, admin.Identity())
+	gMsg, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, r, []string{"spawn:" + byzcoin.ContractDarcID, "spawn:" + calypso.ContractSemiWriteID, "spawn:" + calypso.ContractWriteID, "spawn:" + calypso.ContractReadID}, admin.Identity())
 	if err != nil {
 		log.Errorf("Setting up byzcoin dfailed error: %v", err)
 		return
@@ -56,6 +65,10 @@ func (scCl *SCClient) SetupDarcs() (darc.Signer, darc.Signer, *darc.Darc, error)
 	if err != nil {
 		return writer, reader, nil, err
 	}
+	err = writeDarc.Rules.AddRule(darc.Action("spawn:"+calypso.ContractWriteID), expression.InitOrExpr(writer.Identity().String()))
+	if err != nil {
+		return writer, reader, nil, err
+	}
 	err = writeDarc.Rules.AddRule(darc.Action("spawn:"+calypso.ContractReadID), expression.InitOrExpr(reader.Identity().String()))
 	if err != nil {
 		return writer, reader, nil, err
@@ -97,17 +110,102 @@ func (scCl *SCClient) StoreData(data []byte, dataHash []byte) (*StoreReply, erro
 	sr := &StoreRequest{
 		Data:     data,
 		DataHash: dataHash,
+		SCID:     scCl.BcClient.ID,
 	}
 	//dest := r.List[0]
 	//log.Lvl3("Sending message to", dest)
-	reply := &StoreReply{}
-	//err := scCl.c.SendProtobuf(dest, sr, reply)
-	err := scCl.c.SendProtobuf(scCl.BcClient.Roster.List[0], sr, reply)
+	reply, err := scCl.sendAll(sr, func() interface{} { return &StoreReply{} })
 	if err != nil {
 		log.Errorf("Storing encrypted data failed: %v", err)
 		return nil, err
 	}
-	return reply, nil
+	return reply.(*StoreReply), nil
+}
+
+// StoreWriteData stores the encrypted data of wd, together with its owner
+// and TTL, on all store nodes. If wd has Replicas, every node keeps the
+// copy of the key that is encrypted to it. If wd is Chunked, the data is
+// uploaded with StoreChunkedData.
+func (scCl *SCClient) StoreWriteData(wd *util.WriteData) (*StoreReply, error) {
+	if wd.Chunked {
+		return scCl.StoreChunkedData(wd)
+	}
+	sr, err := scCl.newStoreRequest(wd)
+	if err != nil {
+		log.Errorf("Storing encrypted data failed: %v", err)
+		return nil, err
+	}
+	if err = signStore(sr, wd.WriterSk); err != nil {
+		log.Errorf("Storing encrypted data failed: %v", err)
+		return nil, err
+	}
+	reply, err := scCl.sendAll(sr, func() interface{} { return &StoreReply{} })
+	if err != nil {
+		log.Errorf("Storing encrypted data failed: %v", err)
+		return nil, err
+	}
+	return reply.(*StoreReply), nil
+}
+
+// newStoreRequest returns the request that stores the data of wd until
+// its write shows up on the byzcoin of the client. It still has to be
+// signed with signStore.
+func (scCl *SCClient) newStoreRequest(wd *util.WriteData) (*StoreRequest, error) {
+	sr := &StoreRequest{
+		Data:     wd.Data,
+		DataHash: wd.DataHash,
+		Owner:    wd.Owner,
+		TTL:      int64(wd.TTL / time.Second),
+		Replicas: wd.Replicas,
+		SCID:     scCl.BcClient.ID,
+	}
+	if wd.WriterSk != nil && sr.Owner == nil {
+		sr.Owner = cothority.Suite.Point().Mul(wd.WriterSk, nil)
+	}
+	return sr, nil
+}
+
+// signStore signs sr with the key of the writer, if there is one. It has to
+// be called once sr is complete, as the signature covers all of it.
+func signStore(sr *StoreRequest, sk kyber.Scalar) error {
+	if sk == nil {
+		return nil
+	}
+	sr.Timestamp = time.Now().Unix()
+	sr.Sig = nil
+	digest, err := StoreDigest(sr)
+	if err != nil {
+		return err
+	}
+	sr.Sig, err = util.SignWrite(sk, sr.Timestamp, digest)
+	return err
+}
+
+// DeleteData removes the data stored under key from all store nodes. ownerSk is the private key
+// of the owner given when the data was stored.
+func (scCl *SCClient) DeleteData(key string, ownerSk kyber.Scalar) error {
+	ts := time.Now().Unix()
+	msg, err := DeleteMessage(key, ts)
+	if err != nil {
+		log.Errorf("Deleting data failed: %v", err)
+		return err
+	}
+	sig, err := schnorr.Sign(cothority.Suite, ownerSk, msg)
+	if err != nil {
+		log.Errorf("Deleting data failed: %v", err)
+		return err
+	}
+	dr := &DeleteRequest{
+		Key:       key,
+		Timestamp: ts,
+		Sig:       sig,
+	}
+	_, err = scCl.sendAll(dr, func() interface{} { return &DeleteReply{} })
+	if err != nil {
+		log.Errorf("Deleting data failed: %v", err)
+		return err
+	}
+	return nil
 }
 
 func (scCl *SCClient) AddWriteTransaction(wd *util.WriteData, signer darc.Signer, darc darc.Darc, wait int) (*TransactionReply, error) {
@@ -198,32 +296,118 @@ func (scCl *SCClient) GetProof(id byzcoin.InstanceID) (*byzcoin.GetProofResponse
 	return scCl.BcClient.GetProof(id.Slice())
 }
 
+// WaitForInstance waits up to timeout for the instance to be on byzcoin and
+// returns its verified proof, see util.WaitForInstance.
+func (scCl *SCClient) WaitForInstance(id byzcoin.InstanceID, timeout time.Duration) (*byzcoin.Proof, error) {
+	return util.WaitForInstance(scCl.BcClient, id, timeout)
+}
+
+// AddWriteAndProve adds the write transaction of wd and returns its proof
+// once it is on byzcoin.
+func (scCl *SCClient) AddWriteAndProve(wd *util.WriteData, signer darc.Signer, darc darc.Darc, timeout time.Duration) (*byzcoin.Proof, error) {
+	reply, err := scCl.AddWriteTransaction(wd, signer, darc, 0)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := scCl.WaitForInstance(reply.InstanceID, timeout)
+	if err != nil {
+		log.Errorf("Adding write transaction failed: %v", err)
+		return nil, err
+	}
+	return proof, nil
+}
+
+// AddReadAndProve adds a read of the write with the given proof and returns
+// the proof of the read once it is on byzcoin.
+func (scCl *SCClient) AddReadAndProve(proof *byzcoin.Proof, signer darc.Signer, darc darc.Darc, timeout time.Duration) (*byzcoin.Proof, error) {
+	reply, err := scCl.AddReadTransaction(proof, signer, darc, 0)
+	if err != nil {
+		return nil, err
+	}
+	rProof, err := scCl.WaitForInstance(reply.InstanceID, timeout)
+	if err != nil {
+		log.Errorf("Adding read transaction failed: %v", err)
+		return nil, err
+	}
+	return rProof, nil
+}
+
 //func (scCl *SCClient) Decrypt(r *onet.Roster, wrProof *byzcoin.Proof, rProof *byzcoin.Proof, key string, sk kyber.Scalar) (*DecryptReply, error) {
 func (scCl *SCClient) Decrypt(wrProof *byzcoin.Proof, rProof *byzcoin.Proof, key string, sk kyber.Scalar) (*DecryptReply, error) {
-	keyBytes, err := hex.DecodeString(key)
+	dr, write, err := scCl.newDecryptRequest(wrProof, rProof, key, sk)
 	if err != nil {
 		log.Errorf("Decrypt failed: %v", err)
 		return nil, err
 	}
-	sig, err := schnorr.Sign(cothority.Suite, sk, keyBytes)
+	reader := cothority.Suite.Point().Mul(sk, nil)
+	var reply *DecryptReply
+	err = scCl.tryAll(func(si *network.ServerIdentity) error {
+		r := &DecryptReply{}
+		if err := scCl.c.SendProtobuf(si, dr, r); err != nil {
+			return err
+		}
+		serverKey, err := scCl.signedKey(si, r.ServerKey)
+		if err != nil {
+			return err
+		}
+		if err := verifyDecryptReply(r, write, reader, serverKey); err != nil {
+			return err
+		}
+		reply = r
+		return nil
+	})
 	if err != nil {
 		log.Errorf("Decrypt failed: %v", err)
 		return nil, err
 	}
-	dr := &DecryptRequest{
-		Write: wrProof,
-		Read:  rProof,
-		SCID:  scCl.BcClient.ID,
-		Key:   key,
-		Sig:   sig,
+	return reply, nil
+}
+
+// newDecryptRequest returns the strict decrypt request of the reader with
+// the private key sk, together with the write it is for.
+func (scCl *SCClient) newDecryptRequest(wrProof *byzcoin.Proof, rProof *byzcoin.Proof, key string, sk kyber.Scalar) (*DecryptRequest, *calypso.SemiWrite, error) {
+	msg, err := DecryptMessage(key, rProof.InclusionProof.Key, rProof.Latest.Hash)
+	if err != nil {
+		return nil, nil, err
 	}
-	//dest := r.List[0]
-	//log.Lvl3("Sending message to", dest)
-	reply := &DecryptReply{}
-	err = scCl.c.SendProtobuf(scCl.BcClient.Roster.List[0], dr, reply)
+	sig, err := schnorr.Sign(cothority.Suite, sk, msg)
 	if err != nil {
-		log.Errorf("Decrypt failed: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
-	return reply, err
+	var write calypso.SemiWrite
+	if err = wrProof.ContractValue(cothority.Suite, calypso.ContractSemiWriteID, &write); err != nil {
+		return nil, nil, err
+	}
+	dr := &DecryptRequest{
+		Write:  wrProof,
+		Read:   rProof,
+		SCID:   scCl.BcClient.ID,
+		Key:    key,
+		Sig:    sig,
+		Strict: true,
+	}
+	return dr, &write, nil
+}
+
+// verifyDecryptReply checks that the data of the reply belongs to the write
+// and that the key was correctly re-encrypted to reader, either from the
+// write itself or from the copy of the key held by the replica. serverKey
+// is the key of the server as signed by its identity, and not the one in
+// the reply.
+func verifyDecryptReply(reply *DecryptReply, write *calypso.SemiWrite, reader, serverKey kyber.Point) error {
+	if len(reply.Data) > 0 && !util.VerifyDataHash(reply.Data, write.DataHash) {
+		return errors.New("Data does not match the write")
+	}
+	k, c := write.K, write.C
+	if rk := reply.Replica; rk != nil {
+		if rk.Server == nil || !rk.Server.Equal(serverKey) {
+			return errors.New("Replica key is not for this server")
+		}
+		err := util.VerifyWriteProof(serverKey, rk.K, rk.C, rk.Ubar, rk.E, rk.F, write.Reader, write.DataHash)
+		if err != nil {
+			return err
+		}
+		k, c = rk.K, rk.C
+	}
+	return util.VerifyReencryption(serverKey, k, c, reader, reply.K, reply.C, reply.Proof)
 }
@@ -0,0 +1,123 @@
+package semicentralized
+
+/*
+The audit.go lets a writer or an auditor check that the storage servers
+still hold the data. The verifier picks a random nonce, from which the
+server derives the chunks it has to return, and checks them with their
+Merkle paths against the root of the chunks, which the server committed to
+in the StoreReply.
+*/
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	"github.com/dedis/kyber/util/random"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// MaxSamples is the largest number of chunks a challenge can ask for.
+const MaxSamples = 64
+
+// Challenge returns the chunks of stored data sampled with the nonce of
+// the request, together with their Merkle paths.
+func (s *Service) Challenge(req *ChallengeRequest) (*ChallengeReply, error) {
+	if req.Samples < 1 || req.Samples > MaxSamples {
+		return nil, errors.New("Invalid number of samples")
+	}
+	sr, key, err := s.storedChunks(req.Key)
+	if err != nil {
+		log.Errorf("Challenge error: %v", err)
+		return nil, err
+	}
+	size := int64(len(sr.Data))
+	hashes := util.ChunkHashes(sr.Data)
+	get := func(i int) ([]byte, error) {
+		return util.DataChunk(sr.Data, i), nil
+	}
+	if sr.Chunked {
+		cd, err := s.db.chunks.GetChunkedData(key)
+		if err != nil {
+			log.Errorf("Challenge error: %v", err)
+			return nil, err
+		}
+		size = cd.Size
+		hashes = cd.ChunkHashes
+		get = func(i int) ([]byte, error) {
+			return s.db.chunks.GetChunk(key, i)
+		}
+	}
+	proofs, err := util.ProveChunks(req.Nonce, req.Samples, size, hashes, get)
+	if err != nil {
+		log.Errorf("Challenge error: %v", err)
+		return nil, err
+	}
+	return &ChallengeReply{Proofs: proofs}, nil
+}
+
+// AuditTarget is the data a verifier checks. Root is the Merkle root of
+// the chunks and Size the size of the encrypted data.
+type AuditTarget struct {
+	Key  string
+	Root []byte
+	Size int64
+}
+
+// NewAuditTarget returns the target for the encrypted data stored under
+// key, which only the writer knows.
+func NewAuditTarget(key string, data []byte) *AuditTarget {
+	return &AuditTarget{Key: key, Root: util.DataHash(data), Size: int64(len(data))}
+}
+
+// Challenge asks si to prove that it stores the data of t, by returning
+// samples random chunks of it.
+func (scCl *SCClient) Challenge(si *network.ServerIdentity, t *AuditTarget, samples int) error {
+	nonce := make([]byte, 32)
+	random.Bytes(nonce, random.New())
+	reply := &ChallengeReply{}
+	req := &ChallengeRequest{Key: t.Key, Nonce: nonce, Samples: samples}
+	if err := scCl.c.SendProtobuf(si, req, reply); err != nil {
+		return err
+	}
+	return util.VerifyChunks(t.Root, t.Size, nonce, samples, reply.Proofs)
+}
+
+// Audit challenges every store node for every target, logs the failures
+// and returns their number.
+func (scCl *SCClient) Audit(targets []*AuditTarget, samples int) (int, error) {
+	nodes, err := scCl.storeNodes()
+	if err != nil {
+		return 0, err
+	}
+	failed := 0
+	for _, t := range targets {
+		for _, si := range nodes {
+			if err := scCl.Challenge(si, t, samples); err != nil {
+				log.Errorf("Audit of %s on %v failed: %v", t.Key, si, err)
+				failed++
+			}
+		}
+	}
+	return failed, nil
+}
+
+// RunAuditor audits the targets every interval until stop is closed.
+func (scCl *SCClient) RunAuditor(targets []*AuditTarget, samples int, interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		failed, err := scCl.Audit(targets, samples)
+		if err != nil {
+			log.Errorf("Audit error: %v", err)
+		} else {
+			log.Lvlf1("Audit done: %d failures", failed)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package semicentralized
+
+/*
+The blobs.go keeps the stored data outside of the bolt database, in a blob
+store that is chosen when the conode starts. The entries in bolt only hold
+the metadata of the data and the Size of the blob, which is stored under the
+same key as the entry. Entries that were stored before still hold their data
+themselves.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/onet/log"
+)
+
+// The blob store backends.
+const (
+	BlobBolt = "bolt"
+	BlobFS   = "fs"
+	BlobS3   = "s3"
+)
+
+// BlobConfig selects the blob store of the service. Dir is the directory
+// of the fs backend and S3 the bucket of the s3 backend. Every conode keeps
+// its blobs in a directory, or under a prefix, named by its public key.
+type BlobConfig struct {
+	Backend string
+	Dir     string
+	S3      util.S3Config
+}
+
+// Blobs is the blob store configuration used when the service starts. The
+// conode sets it from its flags, else it is read from the environment.
+var Blobs = BlobConfigFromEnv()
+
+// BlobConfigFromEnv reads the blob store configuration from the
+// environment variables SC_BLOBSTORE, SC_BLOBSTORE_DIR, SC_S3_ENDPOINT,
+// SC_S3_REGION, SC_S3_BUCKET, SC_S3_PREFIX, SC_S3_ACCESS_KEY and
+// SC_S3_SECRET_KEY.
+func BlobConfigFromEnv() BlobConfig {
+	return BlobConfig{
+		Backend: os.Getenv("SC_BLOBSTORE"),
+		Dir:     os.Getenv("SC_BLOBSTORE_DIR"),
+		S3: util.S3Config{
+			Endpoint:  os.Getenv("SC_S3_ENDPOINT"),
+			Region:    os.Getenv("SC_S3_REGION"),
+			Bucket:    os.Getenv("SC_S3_BUCKET"),
+			Prefix:    os.Getenv("SC_S3_PREFIX"),
+			AccessKey: os.Getenv("SC_S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("SC_S3_SECRET_KEY"),
+		},
+	}
+}
+
+// openBlobStore returns the blob store of cfg for the conode with the given
+// name. The bolt backend uses a bucket of db prefixed with bn.
+func openBlobStore(cfg BlobConfig, name string, db *bolt.DB, bn []byte) (util.BlobStore, error) {
+	switch cfg.Backend {
+	case "", BlobBolt:
+		return util.NewBoltBlobStore(db, bn)
+	case BlobFS:
+		if cfg.Dir == "" {
+			return nil, errors.New("Missing directory of the blob store")
+		}
+		return util.NewFSBlobStore(filepath.Join(cfg.Dir, name))
+	case BlobS3:
+		s3 := cfg.S3
+		s3.Prefix += name + "/"
+		return util.NewS3BlobStore(s3)
+	}
+	return nil, fmt.Errorf("Unknown blob store %q", cfg.Backend)
+}
+
+// claimBlob reserves key for the caller, so that a blob is not deleted
+// while it is stored again. It returns false if key is already reserved.
+func (sdb *SemiCentralizedDB) claimBlob(key []byte) bool {
+	sdb.blobLock.Lock()
+	defer sdb.blobLock.Unlock()
+	if sdb.claimed[string(key)] {
+		return false
+	}
+	sdb.claimed[string(key)] = true
+	return true
+}
+
+func (sdb *SemiCentralizedDB) releaseBlob(key []byte) {
+	sdb.blobLock.Lock()
+	defer sdb.blobLock.Unlock()
+	delete(sdb.claimed, string(key))
+}
+
+// putBlob stores data under key, unless there is an entry with key in
+// bucket. On success, the caller has to call releaseBlob once the entry is
+// stored.
+func (sdb *SemiCentralizedDB) putBlob(bucket, key []byte, data []byte) error {
+	if !sdb.claimBlob(key) {
+		return errors.New("Key already exists")
+	}
+	if sdb.hasEntry(bucket, key) {
+		sdb.releaseBlob(key)
+		return errors.New("Key already exists")
+	}
+	if err := sdb.blobs.Put(key, data); err != nil {
+		sdb.releaseBlob(key)
+		log.Errorf("putBlob error: %v", err)
+		return errors.New("Cannot store the value")
+	}
+	return nil
+}
+
+// dropBlob removes the blob under key once its entry in bucket was
+// deleted. It is called after the deletion is committed, and leaves the
+// blob alone if the data is being stored again.
+func (sdb *SemiCentralizedDB) dropBlob(bucket, key []byte) {
+	if !sdb.claimBlob(key) {
+		return
+	}
+	defer sdb.releaseBlob(key)
+	if sdb.hasEntry(bucket, key) {
+		return
+	}
+	if err := sdb.blobs.Delete(key); err != nil && err != util.ErrBlobNotFound {
+		log.Error("Couldn't delete blob:", err)
+	}
+}
+
+// loadBlob sets the data of sr from the blob under key, if it is stored in
+// the blob store.
+func (sdb *SemiCentralizedDB) loadBlob(key []byte, sr *StoreRequest) error {
+	if sr.Size == 0 || len(sr.Data) > 0 {
+		return nil
+	}
+	data, err := sdb.blobs.Get(key)
+	if err != nil {
+		log.Errorf("loadBlob error: %v", err)
+		return errors.New("Stored data is missing")
+	}
+	if int64(len(data)) != sr.Size {
+		return errors.New("Stored data has the wrong size")
+	}
+	sr.Data = data
+	return nil
+}
+
+func (sdb *SemiCentralizedDB) hasEntry(bucket, key []byte) bool {
+	found := false
+	sdb.DB.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(bucket).Get(key) != nil
+		return nil
+	})
+	return found
+}
+
+// metadata returns the entry of req that is stored in bolt, without the
+// data, which is kept in the blob store.
+func metadata(req *StoreRequest) *StoreRequest {
+	meta := *req
+	meta.Data = nil
+	meta.Size = int64(len(req.Data))
+	return &meta
+}
@@ -1,24 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	sc "github.com/ceyhunalp/calypso_experiments/semi_centralized"
 	"github.com/ceyhunalp/calypso_experiments/util"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso"
 	"github.com/dedis/kyber"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 )
 
-func runSemiCentralized(r *onet.Roster, serverKey kyber.Point, interval int) error {
+func runSemiCentralized(r *onet.Roster, serverKey kyber.Point, interval int, replicas int, audit time.Duration) error {
 	byzCl, admin, gDarc, err := sc.SetupByzcoin(r, interval)
 	if err != nil {
 		return err
 	}
-	scCl := sc.NewClient(byzCl)
+	scCl := sc.NewReplicatedClient(byzCl, replicas)
 	writer, reader, wDarc, err := scCl.SetupDarcs()
 	if err != nil {
 		return err
@@ -28,63 +32,104 @@ func runSemiCentralized(r *onet.Roster, serverKey kyber.Point, interval int) err
 		return err
 	}
 	data := []byte("On Wisconsin!")
-	wd, err := util.CreateWriteData(data, reader.Ed25519.Point, serverKey, true)
+	var wd *util.WriteData
+	var reply *sc.StoreReply
+	if replicas > 1 {
+		var serverKeys []kyber.Point
+		serverKeys, err = scCl.GetServerKeys()
+		if err != nil {
+			return err
+		}
+		wd, err = util.CreateReplicatedWriteData(data, reader.Ed25519.Point, serverKeys, true)
+		if err != nil {
+			return err
+		}
+		reply, err = scCl.StoreWriteData(wd)
+	} else {
+		wd, err = util.CreateWriteData(data, reader.Ed25519.Point, serverKey, true)
+		if err != nil {
+			return err
+		}
+		//reply, err := scCl.StoreData(r, wd.Data, wd.DataHash)
+		reply, err = scCl.StoreData(wd.Data, wd.DataHash)
+	}
 	if err != nil {
 		return err
 	}
-	//reply, err := scCl.StoreData(r, wd.Data, wd.DataHash)
-	reply, err := scCl.StoreData(wd.Data, wd.DataHash)
+	wd.StoredKey = reply.StoredKey
+
+	timeout := time.Duration(5*interval) * time.Second
+	wrProof, err := scCl.AddWriteAndProve(wd, writer, *wDarc, timeout)
+	if err != nil {
+		return err
+	}
+	rProof, err := scCl.AddReadAndProve(wrProof, reader, *wDarc, timeout)
 	if err != nil {
 		return err
 	}
-	wd.StoredKey = reply.StoredKey
 
-	writeTxn, err := scCl.AddWriteTransaction(wd, writer, *wDarc, 5)
+	//dr, err := scCl.Decrypt(r, &wrProof, &rProof, wd.StoredKey, reader.Ed25519.Secret)
+	dr, err := scCl.Decrypt(wrProof, rProof, wd.StoredKey, reader.Ed25519.Secret)
 	if err != nil {
 		return err
 	}
-	wrProofResponse, err := scCl.GetProof(writeTxn.InstanceID)
+	recvData, err := util.RecoverData(dr.Data, reader.Ed25519.Secret, dr.K, dr.C)
 	if err != nil {
 		return err
 	}
-	wrProof := wrProofResponse.Proof
-	if !wrProof.InclusionProof.Match() {
-		return errors.New("Write inclusion proof does not match")
+	fmt.Println("Recovered data is:", string(recvData[:]))
+	if audit > 0 {
+		target := sc.NewAuditTarget(wd.StoredKey, wd.Data)
+		if !bytes.Equal(reply.Root, target.Root) {
+			return errors.New("Storage server committed to the wrong root")
+		}
+		scCl.RunAuditor([]*sc.AuditTarget{target}, 8, audit, nil)
 	}
-	//wrProof, err := byzd.WaitProof(writeTxn.InstanceID, time.Second, nil)
-	//if err != nil {
-	//return err
-	//}
-	//if !wrProof.InclusionProof.Match() {
-	//return errors.New("Write inclusion proof does not match")
-	//}
-	readTxn, err := scCl.AddReadTransaction(&wrProof, reader, *wDarc, 5)
+	return nil
+}
+
+// runThreshold stores the data off-chain with its key held by the LTS of
+// the roster, and reads it back.
+func runThreshold(r *onet.Roster, interval int, replicas int) error {
+	byzCl, admin, gDarc, err := sc.SetupByzcoin(r, interval)
 	if err != nil {
 		return err
 	}
-	rProofResponse, err := scCl.GetProof(readTxn.InstanceID)
+	scCl := sc.NewReplicatedClient(byzCl, replicas)
+	writer, reader, wDarc, err := scCl.SetupDarcs()
 	if err != nil {
 		return err
 	}
-	rProof := rProofResponse.Proof
-	if !rProof.InclusionProof.Match() {
-		return errors.New("Read inclusion proof does not match")
+	_, err = scCl.SpawnDarc(admin, *wDarc, gDarc, 0)
+	if err != nil {
+		return err
 	}
-
-	//rProof, err := byzd.WaitProof(readTxn.InstanceID, time.Second, nil)
-	//if err != nil {
-	//return err
-	//}
-	//if !rProof.InclusionProof.Match() {
-	//return errors.New("Read inclusion proof does not match")
-	//}
-
-	//dr, err := scCl.Decrypt(r, &wrProof, &rProof, wd.StoredKey, reader.Ed25519.Secret)
-	dr, err := scCl.Decrypt(&wrProof, &rProof, wd.StoredKey, reader.Ed25519.Secret)
+	ltsReply, err := calypso.NewClient(byzCl).CreateLTS()
 	if err != nil {
 		return err
 	}
-	recvData, err := util.RecoverData(dr.Data, reader.Ed25519.Secret, dr.K, dr.C)
+	wd, write, err := sc.CreateThresholdWrite([]byte("On Wisconsin!"), ltsReply, wDarc.GetBaseID())
+	if err != nil {
+		return err
+	}
+	reply, err := scCl.StoreWriteData(wd)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(5*interval) * time.Second
+	writeTxn, err := scCl.AddThresholdWriteTransaction(write, writer, *wDarc, 0)
+	if err != nil {
+		return err
+	}
+	wrProof, err := scCl.WaitForInstance(writeTxn.InstanceID, timeout)
+	if err != nil {
+		return err
+	}
+	rProof, err := scCl.AddReadAndProve(wrProof, reader, *wDarc, timeout)
+	if err != nil {
+		return err
+	}
+	recvData, err := scCl.DecryptThreshold(wrProof, rProof, reply.StoredKey, reader.Ed25519.Secret)
 	if err != nil {
 		return err
 	}
@@ -92,11 +137,34 @@ func runSemiCentralized(r *onet.Roster, serverKey kyber.Point, interval int) err
 	return nil
 }
 
+// rotateKey rotates the encryption key of the storage server and publishes
+// the new key in pkFile.
+func rotateKey(r *onet.Roster, privFile string, pkFile string) error {
+	adminSk, err := util.ReadPrivateKey(privFile)
+	if err != nil {
+		return err
+	}
+	scCl := sc.NewClient(byzcoin.NewClient(nil, *r))
+	pk, err := scCl.RotateKey(adminSk)
+	if err != nil {
+		return err
+	}
+	fmt.Println("New server key:", pk)
+	if pkFile == "" {
+		return nil
+	}
+	return util.WriteServerKey(pkFile, pk)
+}
+
 func main() {
 	intervalPtr := flag.Int("i", 10, "block interval value")
 	pkPtr := flag.String("p", "", "pk.txt file")
 	dbgPtr := flag.Int("d", 0, "debug level")
 	filePtr := flag.String("r", "", "roster.toml file")
+	replicasPtr := flag.Int("k", 1, "number of roster members that store the data")
+	auditPtr := flag.Duration("audit", 0, "audit the stored data at this interval until interrupted")
+	thresholdPtr := flag.Bool("t", false, "encrypt the key to the LTS of the roster instead of the storage conode")
+	rotatePtr := flag.String("rotate", "", "private.toml of the storage conode: rotate its key and write it to the pk file")
 	flag.Parse()
 	log.SetDebugVisible(*dbgPtr)
 
@@ -105,12 +173,25 @@ func main() {
 		log.Errorf("Reading roster failed: %v", err)
 		os.Exit(1)
 	}
+	if *rotatePtr != "" {
+		if err = rotateKey(roster, *rotatePtr, *pkPtr); err != nil {
+			log.Errorf("Rotating key failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *thresholdPtr {
+		if err = runThreshold(roster, *intervalPtr, *replicasPtr); err != nil {
+			log.Errorf("Run threshold SemiCentralized failed: %v", err)
+		}
+		return
+	}
 	serverKey, err := util.GetServerKey(pkPtr)
 	if err != nil {
 		log.Errorf("Get server key failed: %v", err)
 		os.Exit(1)
 	}
-	err = runSemiCentralized(roster, serverKey, *intervalPtr)
+	err = runSemiCentralized(roster, serverKey, *intervalPtr, *replicasPtr, *auditPtr)
 	if err != nil {
 		log.Errorf("Run SemiCentralized failed: %v", err)
 	}
@@ -2,48 +2,139 @@ package semicentralized
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"time"
 
+	"github.com/ceyhunalp/calypso_experiments/util"
 	bolt "github.com/coreos/bbolt"
 	"github.com/dedis/cothority"
 	"github.com/dedis/onet/log"
 	"github.com/dedis/onet/network"
 )
 
-func NewSemiCentralizedDB(db *bolt.DB, bn []byte) *SemiCentralizedDB {
-	return &SemiCentralizedDB{
-		DB:         db,
-		bucketName: bn,
+func NewSemiCentralizedDB(db *bolt.DB, bn []byte, blobs util.BlobStore) (*SemiCentralizedDB, error) {
+	sdb := &SemiCentralizedDB{
+		DB:           db,
+		bucketName:   bn,
+		blobs:        blobs,
+		claimed:      make(map[string]bool),
+		expiryBucket: append(append([]byte{}, bn...), []byte("_expiry")...),
+		shardBucket:  append(append([]byte{}, bn...), []byte("_shards")...),
 	}
+	sdb.pendingBucket = append(append([]byte{}, bn...), []byte("_pending")...)
+	sdb.writesBucket = append(append([]byte{}, bn...), []byte("_writes")...)
+	sdb.scanBucket = append(append([]byte{}, bn...), []byte("_scan")...)
+	sdb.readsBucket = append(append([]byte{}, bn...), []byte("_reads")...)
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{sdb.expiryBucket, sdb.shardBucket, sdb.pendingBucket, sdb.writesBucket, sdb.scanBucket,
+			sdb.readsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("NewSemiCentralizedDB error: %v", err)
+		return nil, err
+	}
+	sdb.chunks, err = util.NewChunkStore(db, bn)
+	if err != nil {
+		log.Errorf("NewSemiCentralizedDB error: %v", err)
+		return nil, err
+	}
+	sdb.writers, err = util.NewWriterStore(db, bn)
+	if err != nil {
+		log.Errorf("NewSemiCentralizedDB error: %v", err)
+		return nil, err
+	}
+	sdb.chunks.Writers = sdb.writers
+	return sdb, nil
 }
 
 func (sdb *SemiCentralizedDB) StoreData(req *StoreRequest) (key string, err error) {
-	dataHash := sha256.Sum256(req.Data)
-	if bytes.Compare(dataHash[:], req.DataHash) != 0 {
+	if !bytes.Equal(util.DataHash(req.Data), req.DataHash) {
 		return key, errors.New("Hashes do not match")
 	}
-	val, err := network.Marshal(req)
+	req.Chunked = false
+	return sdb.storeData(req, nil)
+}
+
+// StoreChunkedData stores the data uploaded in chunks in the given upload
+// session. The DataHash of req has to be the Merkle root of the chunks.
+func (sdb *SemiCentralizedDB) StoreChunkedData(req *StoreRequest, sessionID string) (string, error) {
+	if len(req.Data) > 0 {
+		return "", errors.New("Data is sent in chunks")
+	}
+	req.Chunked = true
+	return sdb.storeData(req, func(tx *bolt.Tx) error {
+		_, unreserved, err := sdb.chunks.FinishUploadTx(tx, sessionID, req.DataHash, req.Owner)
+		if err != nil {
+			return err
+		}
+		return sdb.writers.ChargeTx(tx, req.Owner, unreserved)
+	})
+}
+
+// storeData stores req under its DataHash. If it is not nil, finish is
+// called within the same transaction.
+func (sdb *SemiCentralizedDB) storeData(req *StoreRequest, finish func(*bolt.Tx) error) (key string, err error) {
+	dataHash := req.DataHash
+	if req.TTL < 0 {
+		return key, errors.New("Negative TTL")
+	}
+	req.ExpireTime = 0
+	if req.TTL > 0 {
+		req.ExpireTime = time.Now().Unix() + req.TTL
+	}
+	req.Deadline = 0
+	if len(req.SCID) > 0 {
+		req.Deadline = time.Now().Add(WriteGrace).Unix()
+	}
+	meta := metadata(req)
+	val, err := network.Marshal(meta)
 	if err != nil {
 		return key, errors.New("Cannot marshal store request")
 	}
+	if meta.Size > 0 {
+		if err = sdb.putBlob(sdb.bucketName, dataHash, req.Data); err != nil {
+			return key, err
+		}
+		defer sdb.releaseBlob(dataHash)
+	}
 	err = sdb.DB.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(sdb.bucketName)
-		v := b.Get(dataHash[:])
+		v := b.Get(dataHash)
 		if v != nil {
 			return errors.New("Key already exists")
 		}
-		err := b.Put(dataHash[:], val)
+		if err := sdb.writers.ChargeTx(tx, req.Owner, int64(len(val))+meta.Size); err != nil {
+			return err
+		}
+		if finish != nil {
+			if err := finish(tx); err != nil {
+				return err
+			}
+		}
+		err := b.Put(dataHash, val)
 		if err != nil {
 			return errors.New("Cannot store the value")
 		}
-		return nil
+		if req.ExpireTime > 0 {
+			if err := tx.Bucket(sdb.expiryBucket).Put(expiryKey(req.ExpireTime, dataHash), dataHash); err != nil {
+				return err
+			}
+		}
+		return sdb.addPendingTx(tx, req)
 	})
 	if err != nil {
+		if meta.Size > 0 {
+			sdb.blobs.Delete(dataHash)
+		}
 		return key, err
 	}
-	return hex.EncodeToString(dataHash[:]), nil
+	return hex.EncodeToString(dataHash), nil
 }
 
 func (sdb *SemiCentralizedDB) GetStoredData(key string) (*StoreRequest, error) {
@@ -61,9 +152,17 @@ func (sdb *SemiCentralizedDB) GetStoredData(key string) (*StoreRequest, error) {
 		result = v
 		return nil
 	})
-	return result, err
+	if err != nil {
+		return nil, err
+	}
+	if err = sdb.loadBlob(keyByte, result); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
+// getFromTx returns the entry stored under key. Its data is not loaded
+// from the blob store.
 func (sdb *SemiCentralizedDB) getFromTx(tx *bolt.Tx, key []byte) (*StoreRequest, error) {
 	val := tx.Bucket([]byte(sdb.bucketName)).Get(key)
 	if val == nil {
@@ -0,0 +1,228 @@
+package semicentralized
+
+/*
+The expiry.go removes stored data from the database, either because the
+owner deletes it or because its TTL ran out.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/log"
+)
+
+// SweepInterval is how often the service purges expired data.
+var SweepInterval = time.Minute
+
+// DeleteWindow is how far the timestamp of a delete request may be from the
+// time of the server.
+const DeleteWindow = 5 * time.Minute
+
+// expired returns true if the data has a TTL that ran out before now.
+func (sr *StoreRequest) expired(now time.Time) bool {
+	return sr.ExpireTime > 0 && now.Unix() >= sr.ExpireTime
+}
+
+// DeleteMessage returns the message the owner signs to delete the data
+// stored under key. The timestamp prevents the request from being replayed
+// later.
+func DeleteMessage(key string, ts int64) ([]byte, error) {
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write(keyBytes)
+	h.Write([]byte("delete"))
+	binary.Write(h, binary.LittleEndian, ts)
+	return h.Sum(nil), nil
+}
+
+// verifyDelete checks that the delete request is fresh and signed by the
+// owner of the stored data.
+func verifyDelete(req *DeleteRequest, sr *StoreRequest, now time.Time) error {
+	if sr.Owner == nil {
+		return errors.New("Data has no owner")
+	}
+	ts := time.Unix(req.Timestamp, 0)
+	if ts.Before(now.Add(-DeleteWindow)) || ts.After(now.Add(DeleteWindow)) {
+		return errors.New("Delete request timestamp is outside of the window")
+	}
+	msg, err := DeleteMessage(req.Key, req.Timestamp)
+	if err != nil {
+		return err
+	}
+	return schnorr.Verify(cothority.Suite, sr.Owner, msg, req.Sig)
+}
+
+func expiryKey(ts int64, key []byte) []byte {
+	k := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(k, uint64(ts))
+	copy(k[8:], key)
+	return k
+}
+
+// DeleteData removes the data stored under key, if check returns no error
+// for it. It returns the number of bytes freed.
+func (sdb *SemiCentralizedDB) DeleteData(key string, check func(*StoreRequest) error) (int, error) {
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil {
+		log.Errorf("DeleteData error: %v", err)
+		return 0, err
+	}
+	var size int
+	err = sdb.DB.Update(func(tx *bolt.Tx) error {
+		sr, err := sdb.getFromTx(tx, keyBytes)
+		if err != nil {
+			return err
+		}
+		if err = check(sr); err != nil {
+			return err
+		}
+		size, err = sdb.deleteTx(tx, sr, keyBytes)
+		return err
+	})
+	if err != nil {
+		log.Errorf("DeleteData error: %v", err)
+		return 0, err
+	}
+	return size, nil
+}
+
+// deleteTx removes the data with the given key and its index entries and
+// returns the size of the stored value.
+func (sdb *SemiCentralizedDB) deleteTx(tx *bolt.Tx, sr *StoreRequest, key []byte) (int, error) {
+	b := tx.Bucket(sdb.bucketName)
+	size := len(b.Get(key)) + int(sr.Size)
+	if err := b.Delete(key); err != nil {
+		return 0, err
+	}
+	if sr.Size > 0 {
+		key := append([]byte{}, key...)
+		tx.OnCommit(func() { sdb.dropBlob(sdb.bucketName, key) })
+	}
+	chunkSize, err := sdb.chunks.DeleteTx(tx, key)
+	if err != nil {
+		return 0, err
+	}
+	size += chunkSize
+	if err := sdb.writers.ReleaseTx(tx, sr.Owner, int64(size)); err != nil {
+		return 0, err
+	}
+	if sr.ExpireTime > 0 {
+		if err := tx.Bucket(sdb.expiryBucket).Delete(expiryKey(sr.ExpireTime, key)); err != nil {
+			return 0, err
+		}
+	}
+	if err := sdb.removePendingTx(tx, sr); err != nil {
+		return 0, err
+	}
+	if err := sdb.pruneReadsTx(tx, key); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// PurgeExpired removes all data that expired before now. It returns the
+// number of entries removed and the number of bytes freed.
+func (sdb *SemiCentralizedDB) PurgeExpired(now time.Time) (int, int, error) {
+	var count, size int
+	limit := make([]byte, 8)
+	binary.BigEndian.PutUint64(limit, uint64(now.Unix()))
+	err := sdb.DB.Update(func(tx *bolt.Tx) error {
+		var expired [][]byte
+		c := tx.Bucket(sdb.expiryBucket).Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k[:8], limit) <= 0; k, v = c.Next() {
+			expired = append(expired, append([]byte{}, v...))
+		}
+		for _, key := range expired {
+			sr, err := sdb.getFromTx(tx, key)
+			if err != nil {
+				return err
+			}
+			n, err := sdb.deleteTx(tx, sr, key)
+			if err != nil {
+				return err
+			}
+			count++
+			size += n
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("PurgeExpired error: %v", err)
+		return 0, 0, err
+	}
+	return count, size, nil
+}
+
+// sweep periodically purges the expired data and upload sessions until the
+// service is closed.
+func (s *Service) sweep() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			count, size, err := s.db.PurgeExpired(time.Now())
+			if err != nil {
+				log.Error("Couldn't purge expired data:", err)
+				continue
+			}
+			if count > 0 {
+				log.Lvlf1("%s: purged %d expired entries, reclaimed %d bytes",
+					s.ServerIdentity(), count, size)
+			}
+			s.collectGarbage()
+			if jobs := s.jobs.purge(time.Now()); jobs > 0 {
+				log.Lvlf2("%s: dropped %d decrypt results that were not polled", s.ServerIdentity(), jobs)
+			}
+			sessions, err := s.db.chunks.PurgeSessions(time.Now())
+			if err != nil {
+				log.Error("Couldn't purge upload sessions:", err)
+			} else if sessions > 0 {
+				log.Lvlf2("%s: purged %d unfinished uploads", s.ServerIdentity(), sessions)
+			}
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// Delete removes stored data. The request has to be signed by the owner
+// of the data.
+func (s *Service) Delete(req *DeleteRequest) (*DeleteReply, error) {
+	check := func(sr *StoreRequest) error {
+		return verifyDelete(req, sr, time.Now())
+	}
+	size, err := s.db.DeleteData(req.Key, check)
+	if err != nil {
+		// The server might only hold shards of the data.
+		if n, serr := s.db.DeleteShards(req.Key, check); serr == nil {
+			size, err = n, nil
+		}
+	}
+	if err != nil {
+		log.Errorf("Delete error: %v", err)
+		return nil, err
+	}
+	log.Lvlf2("%s: deleted %s, reclaimed %d bytes", s.ServerIdentity(), req.Key, size)
+	return &DeleteReply{}, nil
+}
+
+// Close is called by onet when the conode shuts down. It stops the sweeper
+// and the decrypt workers of the service and waits for them to return.
+func (s *Service) Close() error {
+	s.closeOnce.Do(func() { close(s.closing) })
+	s.wg.Wait()
+	return nil
+}
@@ -0,0 +1,246 @@
+package semicentralized
+
+/*
+The gc.go removes data whose write never made it to byzcoin, e.g. because
+the writer crashed after storing the data. Data that names the skipchain of
+its write waits in the pending bucket until its deadline. The sweeper scans
+the new blocks of that skipchain for writes and removes the pending data
+that no write refers to once the deadline passed.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// WriteGrace is how long stored data may wait for its write on byzcoin.
+var WriteGrace = time.Hour
+
+func writeKey(scid skipchain.SkipBlockID, dataHash []byte) []byte {
+	return append(append([]byte{}, scid...), dataHash...)
+}
+
+// addPendingTx adds req to the pending data, unless its write is already
+// known.
+func (sdb *SemiCentralizedDB) addPendingTx(tx *bolt.Tx, req *StoreRequest) error {
+	if req.Deadline == 0 {
+		return nil
+	}
+	if tx.Bucket(sdb.writesBucket).Get(writeKey(req.SCID, req.DataHash)) != nil {
+		return nil
+	}
+	return tx.Bucket(sdb.pendingBucket).Put(expiryKey(req.Deadline, req.DataHash), req.SCID)
+}
+
+func (sdb *SemiCentralizedDB) removePendingTx(tx *bolt.Tx, sr *StoreRequest) error {
+	if sr.Deadline == 0 {
+		return nil
+	}
+	return tx.Bucket(sdb.pendingBucket).Delete(expiryKey(sr.Deadline, sr.DataHash))
+}
+
+// PendingChains returns the skipchains pending data waits for a write on.
+func (sdb *SemiCentralizedDB) PendingChains() ([]skipchain.SkipBlockID, error) {
+	var chains []skipchain.SkipBlockID
+	seen := make(map[string]bool)
+	err := sdb.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sdb.pendingBucket).ForEach(func(k, v []byte) error {
+			if !seen[string(v)] {
+				seen[string(v)] = true
+				chains = append(chains, append(skipchain.SkipBlockID{}, v...))
+			}
+			return nil
+		})
+	})
+	return chains, err
+}
+
+// scanCursor returns the last block of scid that was scanned for writes,
+// or nil if none was.
+func (sdb *SemiCentralizedDB) scanCursor(scid skipchain.SkipBlockID) skipchain.SkipBlockID {
+	var cur skipchain.SkipBlockID
+	sdb.DB.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(sdb.scanBucket).Get(scid); v != nil {
+			cur = append(skipchain.SkipBlockID{}, v...)
+		}
+		return nil
+	})
+	return cur
+}
+
+// AddWrites records the DataHashes of the writes found on scid up to the
+// block last.
+func (sdb *SemiCentralizedDB) AddWrites(scid skipchain.SkipBlockID, last skipchain.SkipBlockID, hashes [][]byte) error {
+	return sdb.DB.Update(func(tx *bolt.Tx) error {
+		wb := tx.Bucket(sdb.writesBucket)
+		for _, h := range hashes {
+			if err := wb.Put(writeKey(scid, h), []byte{1}); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(sdb.scanBucket).Put(scid, last)
+	})
+}
+
+// PurgeUnreferenced removes the pending data whose deadline passed before
+// now and that no write refers to. Only data waiting on one of the scanned
+// skipchains is removed. It returns the number of entries removed and the
+// number of bytes freed.
+func (sdb *SemiCentralizedDB) PurgeUnreferenced(now time.Time, scanned map[string]bool) (int, int, error) {
+	var count, size int
+	limit := make([]byte, 8)
+	binary.BigEndian.PutUint64(limit, uint64(now.Unix()))
+	err := sdb.DB.Update(func(tx *bolt.Tx) error {
+		type entry struct{ key, scid []byte }
+		var due []entry
+		pb := tx.Bucket(sdb.pendingBucket)
+		c := pb.Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k[:8], limit) <= 0; k, v = c.Next() {
+			due = append(due, entry{append([]byte{}, k...), append([]byte{}, v...)})
+		}
+		for _, e := range due {
+			dataHash := e.key[8:]
+			if tx.Bucket(sdb.writesBucket).Get(writeKey(e.scid, dataHash)) == nil {
+				if !scanned[string(e.scid)] {
+					continue
+				}
+				n, err := sdb.deleteUnreferencedTx(tx, dataHash)
+				if err != nil {
+					return err
+				}
+				if n > 0 {
+					count++
+					size += n
+				}
+			}
+			if err := pb.Delete(e.key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("PurgeUnreferenced error: %v", err)
+		return 0, 0, err
+	}
+	return count, size, nil
+}
+
+// deleteUnreferencedTx removes the data or the shards stored under
+// dataHash, if there are any.
+func (sdb *SemiCentralizedDB) deleteUnreferencedTx(tx *bolt.Tx, dataHash []byte) (int, error) {
+	if tx.Bucket(sdb.bucketName).Get(dataHash) != nil {
+		sr, err := sdb.getFromTx(tx, dataHash)
+		if err != nil {
+			return 0, err
+		}
+		return sdb.deleteTx(tx, sr, dataHash)
+	}
+	n, err := sdb.deleteShardsTx(tx, hex.EncodeToString(dataHash), func(*StoreRequest) error { return nil })
+	if err != nil {
+		// The shards were already removed with an earlier entry.
+		return 0, nil
+	}
+	return n, nil
+}
+
+// collectGarbage scans byzcoin for the writes of the pending data and
+// removes the data whose write did not show up in time.
+func (s *Service) collectGarbage() {
+	chains, err := s.db.PendingChains()
+	if err != nil {
+		log.Error("Couldn't get pending data:", err)
+		return
+	}
+	scanned := make(map[string]bool)
+	for _, scid := range chains {
+		if err := s.scanWrites(scid); err != nil {
+			log.Lvlf2("%s: couldn't scan %x for writes: %v", s.ServerIdentity(), scid, err)
+			continue
+		}
+		scanned[string(scid)] = true
+	}
+	count, size, err := s.db.PurgeUnreferenced(time.Now(), scanned)
+	if err != nil {
+		log.Error("Couldn't purge unreferenced data:", err)
+		return
+	}
+	if count > 0 {
+		log.Lvlf1("%s: purged %d entries without a write, reclaimed %d bytes",
+			s.ServerIdentity(), count, size)
+	}
+}
+
+// scanWrites records the writes in the blocks of scid that were added
+// since the last scan. The blocks are taken from the skipchain service of
+// this conode, so it has to be part of the roster of byzcoin.
+func (s *Service) scanWrites(scid skipchain.SkipBlockID) error {
+	db := s.Service(skipchain.ServiceName).(*skipchain.Service).GetDB()
+	var sb *skipchain.SkipBlock
+	var hashes [][]byte
+	if cur := s.db.scanCursor(scid); cur != nil {
+		if sb = db.GetByID(cur); sb == nil {
+			return errors.New("Last scanned block is missing")
+		}
+	} else {
+		if sb = db.GetByID(scid); sb == nil {
+			return errors.New("Unknown skipchain")
+		}
+		hashes = writeHashes(sb)
+	}
+	for len(sb.ForwardLink) > 0 {
+		next := db.GetByID(sb.ForwardLink[0].To)
+		if next == nil {
+			break
+		}
+		hashes = append(hashes, writeHashes(next)...)
+		sb = next
+	}
+	return s.db.AddWrites(scid, sb.Hash, hashes)
+}
+
+// writeHashes returns the DataHashes of the accepted writes in sb, for the
+// semi-centralized and the threshold writes.
+func writeHashes(sb *skipchain.SkipBlock) [][]byte {
+	var body byzcoin.DataBody
+	if err := protobuf.DecodeWithConstructors(sb.Payload, &body, network.DefaultConstructors(cothority.Suite)); err != nil {
+		return nil
+	}
+	var hashes [][]byte
+	for _, tr := range body.TxResults {
+		if !tr.Accepted {
+			continue
+		}
+		for _, instr := range tr.ClientTransaction.Instructions {
+			if instr.Spawn == nil {
+				continue
+			}
+			buf := instr.Spawn.Args.Search("write")
+			switch instr.Spawn.ContractID {
+			case calypso.ContractSemiWriteID:
+				var write calypso.SemiWrite
+				if protobuf.DecodeWithConstructors(buf, &write, network.DefaultConstructors(cothority.Suite)) == nil {
+					hashes = append(hashes, write.DataHash)
+				}
+			case calypso.ContractWriteID:
+				var write calypso.Write
+				if protobuf.DecodeWithConstructors(buf, &write, network.DefaultConstructors(cothority.Suite)) == nil && len(write.ExtraData) > 0 {
+					hashes = append(hashes, write.ExtraData)
+				}
+			}
+		}
+	}
+	return hashes
+}
@@ -0,0 +1,335 @@
+package semicentralized
+
+/*
+The jobs.go runs decrypt requests asynchronously. A request is queued and
+handled by a fixed number of workers, and the client polls for the result,
+so that many requests can be in flight without holding a connection open
+for each of them.
+*/
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/random"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// The states of a decrypt job.
+const (
+	JobQueued = iota
+	JobRunning
+	JobDone
+	JobFailed
+)
+
+// DecryptWorkers is the number of decrypt jobs that run at the same time.
+var DecryptWorkers = 4
+
+// DecryptQueueSize is the number of decrypt jobs that can wait for a
+// worker. Further jobs are rejected.
+var DecryptQueueSize = 256
+
+// JobRetention is how long the result of a finished job is kept if it is
+// not polled.
+var JobRetention = 10 * time.Minute
+
+type decryptJob struct {
+	id       string
+	req      *DecryptRequest
+	status   int
+	reply    *DecryptReply
+	err      error
+	finished time.Time
+	// cancelled is set if the job was removed before it finished.
+	cancelled bool
+}
+
+// jobPool holds the decrypt jobs and their statistics.
+type jobPool struct {
+	sync.Mutex
+	workers   int
+	jobs      map[string]*decryptJob
+	queue     chan *decryptJob
+	queued    int
+	running   int
+	maxQueued int
+	submitted int64
+	rejected  int64
+	succeeded int64
+	failed    int64
+	cancelled int64
+}
+
+func newJobPool(workers int, size int) *jobPool {
+	return &jobPool{
+		workers: workers,
+		jobs:    make(map[string]*decryptJob),
+		queue:   make(chan *decryptJob, size),
+	}
+}
+
+func (p *jobPool) submit(req *DecryptRequest) (string, error) {
+	id := make([]byte, 16)
+	random.Bytes(id, random.New())
+	j := &decryptJob{id: hex.EncodeToString(id), req: req, status: JobQueued}
+	p.Lock()
+	defer p.Unlock()
+	select {
+	case p.queue <- j:
+	default:
+		p.rejected++
+		return "", errors.New("Decrypt queue is full")
+	}
+	p.jobs[j.id] = j
+	p.submitted++
+	p.queued++
+	if p.queued > p.maxQueued {
+		p.maxQueued = p.queued
+	}
+	return j.id, nil
+}
+
+// start marks j as running. It returns false if j was cancelled while it
+// was queued.
+func (p *jobPool) start(j *decryptJob) bool {
+	p.Lock()
+	defer p.Unlock()
+	p.queued--
+	if j.cancelled {
+		return false
+	}
+	j.status = JobRunning
+	p.running++
+	return true
+}
+
+func (p *jobPool) finish(j *decryptJob, reply *DecryptReply, err error) {
+	p.Lock()
+	defer p.Unlock()
+	p.running--
+	if j.cancelled {
+		return
+	}
+	j.finished = time.Now()
+	if err != nil {
+		j.status = JobFailed
+		j.err = err
+		p.failed++
+		return
+	}
+	j.status = JobDone
+	j.reply = reply
+	p.succeeded++
+}
+
+func (p *jobPool) poll(id string) (*PollDecryptReply, error) {
+	p.Lock()
+	defer p.Unlock()
+	j, ok := p.jobs[id]
+	if !ok {
+		return nil, errors.New("Unknown decrypt job")
+	}
+	reply := &PollDecryptReply{Status: j.status, Reply: j.reply}
+	if j.err != nil {
+		reply.Error = j.err.Error()
+	}
+	if j.status == JobDone || j.status == JobFailed {
+		delete(p.jobs, id)
+	}
+	return reply, nil
+}
+
+func (p *jobPool) cancel(id string) error {
+	p.Lock()
+	defer p.Unlock()
+	j, ok := p.jobs[id]
+	if !ok {
+		return errors.New("Unknown decrypt job")
+	}
+	if j.status == JobQueued || j.status == JobRunning {
+		j.cancelled = true
+		p.cancelled++
+	}
+	delete(p.jobs, id)
+	return nil
+}
+
+// purge removes the results that were not polled within JobRetention and
+// returns their number.
+func (p *jobPool) purge(now time.Time) int {
+	p.Lock()
+	defer p.Unlock()
+	n := 0
+	for id, j := range p.jobs {
+		if (j.status == JobDone || j.status == JobFailed) && now.Sub(j.finished) > JobRetention {
+			delete(p.jobs, id)
+			n++
+		}
+	}
+	return n
+}
+
+func (p *jobPool) stats() *DecryptStatsReply {
+	p.Lock()
+	defer p.Unlock()
+	finished := 0
+	for _, j := range p.jobs {
+		if j.status == JobDone || j.status == JobFailed {
+			finished++
+		}
+	}
+	return &DecryptStatsReply{
+		Workers:   p.workers,
+		Capacity:  cap(p.queue),
+		Queued:    p.queued,
+		Running:   p.running,
+		Finished:  finished,
+		MaxQueued: p.maxQueued,
+		Submitted: p.submitted,
+		Rejected:  p.rejected,
+		Succeeded: p.succeeded,
+		Failed:    p.failed,
+		Cancelled: p.cancelled,
+	}
+}
+
+// decryptWorker handles queued decrypt jobs until the service is closed.
+func (s *Service) decryptWorker() {
+	defer s.wg.Done()
+	for {
+		select {
+		case j := <-s.jobs.queue:
+			if !s.jobs.start(j) {
+				continue
+			}
+			reply, err := s.Decrypt(j.req)
+			s.jobs.finish(j, reply, err)
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// SubmitDecrypt queues a decrypt request and returns the ID of its job.
+func (s *Service) SubmitDecrypt(req *SubmitDecryptRequest) (*SubmitDecryptReply, error) {
+	if req.Decrypt == nil {
+		return nil, errors.New("Missing decrypt request")
+	}
+	id, err := s.jobs.submit(req.Decrypt)
+	if err != nil {
+		log.Errorf("SubmitDecrypt error: %v", err)
+		return nil, err
+	}
+	return &SubmitDecryptReply{JobID: id}, nil
+}
+
+// PollDecrypt returns the state of a decrypt job, and its result if it is
+// finished.
+func (s *Service) PollDecrypt(req *PollDecryptRequest) (*PollDecryptReply, error) {
+	return s.jobs.poll(req.JobID)
+}
+
+// CancelDecrypt removes a decrypt job.
+func (s *Service) CancelDecrypt(req *CancelDecryptRequest) (*CancelDecryptReply, error) {
+	if err := s.jobs.cancel(req.JobID); err != nil {
+		return nil, err
+	}
+	return &CancelDecryptReply{}, nil
+}
+
+// DecryptStats returns the statistics of the decrypt jobs.
+func (s *Service) DecryptStats(req *DecryptStatsRequest) (*DecryptStatsReply, error) {
+	return s.jobs.stats(), nil
+}
+
+// DecryptJob is a decrypt request that runs on Server.
+type DecryptJob struct {
+	ID     string
+	Server *network.ServerIdentity
+	write  *calypso.SemiWrite
+	reader kyber.Point
+}
+
+// SubmitDecrypt queues the decrypt request on the first member of the
+// roster that accepts it, and returns the job to poll.
+func (scCl *SCClient) SubmitDecrypt(wrProof *byzcoin.Proof, rProof *byzcoin.Proof, key string, sk kyber.Scalar) (*DecryptJob, error) {
+	dr, write, err := scCl.newDecryptRequest(wrProof, rProof, key, sk)
+	if err != nil {
+		log.Errorf("Submitting decrypt failed: %v", err)
+		return nil, err
+	}
+	job := &DecryptJob{write: write, reader: cothority.Suite.Point().Mul(sk, nil)}
+	err = scCl.tryAll(func(si *network.ServerIdentity) error {
+		reply := &SubmitDecryptReply{}
+		if err := scCl.c.SendProtobuf(si, &SubmitDecryptRequest{Decrypt: dr}, reply); err != nil {
+			return err
+		}
+		job.ID = reply.JobID
+		job.Server = si
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Submitting decrypt failed: %v", err)
+		return nil, err
+	}
+	return job, nil
+}
+
+// PollDecrypt returns the verified reply of the job once it is finished.
+// As long as the job is queued or running, it returns false.
+func (scCl *SCClient) PollDecrypt(job *DecryptJob) (*DecryptReply, bool, error) {
+	reply := &PollDecryptReply{}
+	if err := scCl.c.SendProtobuf(job.Server, &PollDecryptRequest{JobID: job.ID}, reply); err != nil {
+		return nil, false, err
+	}
+	switch reply.Status {
+	case JobQueued, JobRunning:
+		return nil, false, nil
+	case JobFailed:
+		return nil, true, errors.New(reply.Error)
+	}
+	if reply.Reply == nil {
+		return nil, true, errors.New("Missing decrypt reply")
+	}
+	serverKey, err := scCl.signedKey(job.Server, reply.Reply.ServerKey)
+	if err != nil {
+		return nil, true, err
+	}
+	if err := verifyDecryptReply(reply.Reply, job.write, job.reader, serverKey); err != nil {
+		return nil, true, err
+	}
+	return reply.Reply, true, nil
+}
+
+// WaitDecrypt polls the job every interval until it is finished.
+func (scCl *SCClient) WaitDecrypt(job *DecryptJob, interval time.Duration) (*DecryptReply, error) {
+	for {
+		reply, done, err := scCl.PollDecrypt(job)
+		if done || err != nil {
+			return reply, err
+		}
+		time.Sleep(interval)
+	}
+}
+
+// CancelDecrypt removes the job from its server.
+func (scCl *SCClient) CancelDecrypt(job *DecryptJob) error {
+	return scCl.c.SendProtobuf(job.Server, &CancelDecryptRequest{JobID: job.ID}, &CancelDecryptReply{})
+}
+
+// DecryptStats returns the statistics of the decrypt jobs of si.
+func (scCl *SCClient) DecryptStats(si *network.ServerIdentity) (*DecryptStatsReply, error) {
+	reply := &DecryptStatsReply{}
+	if err := scCl.c.SendProtobuf(si, &DecryptStatsRequest{}, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
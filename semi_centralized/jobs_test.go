@@ -0,0 +1,127 @@
+package semicentralized
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJobQueueFull(t *testing.T) {
+	p := newJobPool(1, 2)
+	for i := 0; i < 2; i++ {
+		if _, err := p.submit(&DecryptRequest{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := p.submit(&DecryptRequest{}); err == nil {
+		t.Fatal("Job was queued in a full queue")
+	}
+	// A job that leaves the queue makes room for another one.
+	p.start(<-p.queue)
+	if _, err := p.submit(&DecryptRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	st := p.stats()
+	if st.Submitted != 3 || st.Rejected != 1 || st.Queued != 2 || st.Running != 1 || st.MaxQueued != 2 {
+		t.Fatalf("Wrong statistics %+v", st)
+	}
+}
+
+func TestJobLifecycle(t *testing.T) {
+	fail := errors.New("Decrypt failed")
+	tests := []struct {
+		name string
+		// cancel is the state in which the job is cancelled, or -1.
+		cancel int
+		err    error
+		status int
+	}{
+		{"done", -1, nil, JobDone},
+		{"failed", -1, fail, JobFailed},
+		{"cancelled while queued", JobQueued, nil, -1},
+		{"cancelled while running", JobRunning, nil, -1},
+		{"cancelled when done", JobDone, nil, -1},
+	}
+	for _, tt := range tests {
+		p := newJobPool(1, 1)
+		id, err := p.submit(&DecryptRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		j := <-p.queue
+		if tt.cancel == JobQueued {
+			p.cancel(id)
+		}
+		if started := p.start(j); started != (tt.cancel != JobQueued) {
+			t.Fatalf("%s: cancelled job was started", tt.name)
+		}
+		if tt.cancel == JobRunning {
+			p.cancel(id)
+		}
+		if tt.cancel != JobQueued {
+			p.finish(j, &DecryptReply{}, tt.err)
+		}
+		if tt.cancel == JobDone {
+			p.cancel(id)
+		}
+
+		reply, err := p.poll(id)
+		if tt.status == -1 {
+			if err == nil {
+				t.Errorf("%s: cancelled job can be polled", tt.name)
+			}
+		} else if err != nil || reply.Status != tt.status || (tt.err != nil) != (reply.Error != "") {
+			t.Errorf("%s: wrong reply %+v: %v", tt.name, reply, err)
+		} else if _, err = p.poll(id); err == nil {
+			t.Errorf("%s: result can be polled twice", tt.name)
+		}
+		if err = p.cancel(id); err == nil {
+			t.Errorf("%s: removed job can be cancelled", tt.name)
+		}
+
+		st := p.stats()
+		cancelled := int64(0)
+		if tt.cancel == JobQueued || tt.cancel == JobRunning {
+			cancelled = 1
+		}
+		if st.Queued != 0 || st.Running != 0 || st.Finished != 0 || st.Cancelled != cancelled {
+			t.Errorf("%s: wrong statistics %+v", tt.name, st)
+		}
+	}
+}
+
+func TestJobPurge(t *testing.T) {
+	p := newJobPool(1, 4)
+	now := time.Now()
+	tests := []struct {
+		name     string
+		finished time.Duration
+		running  bool
+		purged   bool
+	}{
+		{"old result", -JobRetention - time.Second, false, true},
+		{"recent result", -JobRetention + time.Second, false, false},
+		{"running job", -JobRetention - time.Second, true, false},
+	}
+	ids := make([]string, len(tests))
+	for i, tt := range tests {
+		var err error
+		if ids[i], err = p.submit(&DecryptRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		j := <-p.queue
+		p.start(j)
+		if !tt.running {
+			p.finish(j, &DecryptReply{}, nil)
+		}
+		j.finished = now.Add(tt.finished)
+	}
+	if n := p.purge(now); n != 1 {
+		t.Fatalf("Purged %d jobs", n)
+	}
+	for i, tt := range tests {
+		if _, err := p.poll(ids[i]); (err != nil) != tt.purged {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package semicentralized
+
+/*
+The keys.go manages the key the symmetric keys of the writes are encrypted
+to. It is separate from the identity key of the conode so that it can be
+rotated. Until the first rotation, the identity key is used.
+
+The encrypted keys of the writes are stored on byzcoin, so they cannot be
+re-encrypted when the key is rotated. The previous keys are therefore
+retired: they are not published anymore, but still used to decrypt the
+writes that were created before the rotation.
+*/
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// rotateAction is the action signed by the admin to rotate the key.
+const rotateAction = "rotate"
+
+// rotateData returns the data of the admin message that rotates the
+// encryption key current. As the key changes with the rotation, a request
+// can rotate the key only once.
+func rotateData(current kyber.Point) ([]byte, error) {
+	return current.MarshalBinary()
+}
+
+// decryptionKeys returns the current encryption key followed by the
+// retired ones.
+func (s *Service) decryptionKeys() []kyber.Scalar {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	cur := s.storage.EncKey
+	if cur == nil {
+		cur = s.ServerIdentity().GetPrivate()
+	}
+	return append([]kyber.Scalar{cur}, s.storage.RetiredKeys...)
+}
+
+// EncPublic returns the public encryption key of the service.
+func (s *Service) EncPublic() kyber.Point {
+	return cothority.Suite.Point().Mul(s.decryptionKeys()[0], nil)
+}
+
+// GetKey returns the current encryption key, signed with the identity key.
+func (s *Service) GetKey(req *GetKeyRequest) (*GetKeyReply, error) {
+	pub := s.EncPublic()
+	msg, err := util.KeyMessage(pub)
+	if err != nil {
+		log.Errorf("GetKey error: %v", err)
+		return nil, err
+	}
+	sig, err := schnorr.Sign(cothority.Suite, s.ServerIdentity().GetPrivate(), msg)
+	if err != nil {
+		log.Errorf("GetKey error: %v", err)
+		return nil, err
+	}
+	reply := &GetKeyReply{Public: pub, Sig: sig}
+	keys := s.decryptionKeys()
+	for _, sk := range keys[1:] {
+		reply.Retired = append(reply.Retired, cothority.Suite.Point().Mul(sk, nil))
+	}
+	if msg, err = RetiredKeysMessage(reply.Retired); err != nil {
+		log.Errorf("GetKey error: %v", err)
+		return nil, err
+	}
+	reply.RetiredSig, err = schnorr.Sign(cothority.Suite, s.ServerIdentity().GetPrivate(), msg)
+	if err != nil {
+		log.Errorf("GetKey error: %v", err)
+		return nil, err
+	}
+	return reply, nil
+}
+
+// RetiredKeysMessage returns the message the identity key signs over the
+// retired encryption keys.
+func RetiredKeysMessage(retired []kyber.Point) ([]byte, error) {
+	var buf []byte
+	for _, pub := range retired {
+		b, err := pub.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b...)
+	}
+	return util.AdminMessage("retired", 0, buf), nil
+}
+
+// RotateKey creates a new encryption key and retires the current one. The
+// request has to be signed with the identity key of the conode, over the
+// current encryption key.
+func (s *Service) RotateKey(req *RotateKeyRequest) (*RotateKeyReply, error) {
+	// The key cannot change between the check of the request and the
+	// rotation.
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	oldKey, oldRetired := s.storage.EncKey, s.storage.RetiredKeys
+	cur := oldKey
+	if cur == nil {
+		cur = s.ServerIdentity().GetPrivate()
+	}
+	data, err := rotateData(cothority.Suite.Point().Mul(cur, nil))
+	if err != nil {
+		log.Errorf("RotateKey error: %v", err)
+		return nil, err
+	}
+	err = util.VerifyAdminRequest(s.ServerIdentity().Public, rotateAction, req.Timestamp, data, req.Sig, time.Now())
+	if err != nil {
+		log.Errorf("RotateKey error: %v", err)
+		return nil, err
+	}
+	newKey := cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
+	s.storage.RetiredKeys = append([]kyber.Scalar{cur}, oldRetired...)
+	s.storage.EncKey = newKey
+	if err = s.Save(storageID, s.storage); err != nil {
+		s.storage.EncKey = oldKey
+		s.storage.RetiredKeys = oldRetired
+		log.Errorf("RotateKey error: %v", err)
+		return nil, err
+	}
+	newPub := cothority.Suite.Point().Mul(newKey, nil)
+	log.Lvlf1("%s: rotated encryption key, %d keys retired", s.ServerIdentity(), len(s.storage.RetiredKeys))
+	return &RotateKeyReply{Public: newPub}, nil
+}
+
+// GetServerKey returns the encryption key of the storage server, after
+// checking that it is signed by its identity key.
+func (scCl *SCClient) GetServerKey() (kyber.Point, error) {
+	return scCl.getServerKey(scCl.BcClient.Roster.List[0])
+}
+
+func (scCl *SCClient) getServerKey(si *network.ServerIdentity) (kyber.Point, error) {
+	reply, err := scCl.getKey(si)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Public, nil
+}
+
+// getKey fetches the keys of si and checks their signatures.
+func (scCl *SCClient) getKey(si *network.ServerIdentity) (*GetKeyReply, error) {
+	reply := &GetKeyReply{}
+	err := scCl.c.SendProtobuf(si, &GetKeyRequest{}, reply)
+	if err != nil {
+		log.Errorf("Getting server key failed: %v", err)
+		return nil, err
+	}
+	msg, err := util.KeyMessage(reply.Public)
+	if err != nil {
+		return nil, err
+	}
+	if err = schnorr.Verify(cothority.Suite, si.Public, msg, reply.Sig); err != nil {
+		return nil, errors.New("Invalid signature on server key: " + err.Error())
+	}
+	if msg, err = RetiredKeysMessage(reply.Retired); err != nil {
+		return nil, err
+	}
+	if err = schnorr.Verify(cothority.Suite, si.Public, msg, reply.RetiredSig); err != nil {
+		return nil, errors.New("Invalid signature on retired keys: " + err.Error())
+	}
+	return reply, nil
+}
+
+// signedKey returns the signed encryption key of si, current or retired,
+// that equals pub. The keys are cached and fetched again if pub is not
+// among them, as the server may have rotated its key.
+func (scCl *SCClient) signedKey(si *network.ServerIdentity, pub kyber.Point) (kyber.Point, error) {
+	if pub == nil {
+		return nil, errors.New("Missing server key")
+	}
+	scCl.keysLock.Lock()
+	defer scCl.keysLock.Unlock()
+	for fetched := false; ; fetched = true {
+		for _, k := range scCl.keys[si.ID] {
+			if k.Equal(pub) {
+				return k, nil
+			}
+		}
+		if fetched {
+			return nil, errors.New("Server key is not signed by the server")
+		}
+		reply, err := scCl.getKey(si)
+		if err != nil {
+			return nil, err
+		}
+		if scCl.keys == nil {
+			scCl.keys = make(map[network.ServerIdentityID][]kyber.Point)
+		}
+		scCl.keys[si.ID] = append([]kyber.Point{reply.Public}, reply.Retired...)
+	}
+}
+
+// RotateKey makes the storage server replace its encryption key. adminSk is
+// the identity key of the server. The request is bound to the current key
+// of the server, so that it cannot be replayed.
+func (scCl *SCClient) RotateKey(adminSk kyber.Scalar) (kyber.Point, error) {
+	si := scCl.BcClient.Roster.List[0]
+	current, err := scCl.getServerKey(si)
+	if err != nil {
+		return nil, err
+	}
+	data, err := rotateData(current)
+	if err != nil {
+		return nil, err
+	}
+	ts := time.Now().Unix()
+	sig, err := schnorr.Sign(cothority.Suite, adminSk, util.AdminMessage(rotateAction, ts, data))
+	if err != nil {
+		return nil, err
+	}
+	reply := &RotateKeyReply{}
+	err = scCl.c.SendProtobuf(si, &RotateKeyRequest{Timestamp: ts, Sig: sig}, reply)
+	if err != nil {
+		log.Errorf("Rotating server key failed: %v", err)
+		return nil, err
+	}
+	return reply.Public, nil
+}
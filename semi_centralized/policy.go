@@ -0,0 +1,200 @@
+package semicentralized
+
+/*
+The policy.go binds decrypt requests to the read they use. In strict mode
+the reader signs the key together with the instance ID of the read and the
+latest block of the read proof, with the key of the read, so a signature
+cannot be replayed with another read. Servers can also be configured to
+accept every read only once.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/calypso"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// policyAction is the action signed by the admin to change the decrypt
+// policy.
+const policyAction = "decryptpolicy"
+
+// DecryptMessage returns the message the reader signs in a strict decrypt
+// request for the data stored under key, using the read with the given
+// instance ID and a read proof up to the block with the given hash.
+func DecryptMessage(key string, readID []byte, blockID []byte) ([]byte, error) {
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte("decrypt"))
+	h.Write(keyBytes)
+	h.Write(readID)
+	h.Write(blockID)
+	return h.Sum(nil), nil
+}
+
+// verifyStrictDecrypt checks that the reader of the write is the one of the
+// read, and that the request is signed by it over DecryptMessage.
+func verifyStrictDecrypt(req *DecryptRequest, read *calypso.Read, write *calypso.SemiWrite) error {
+	if read.Xc == nil || !read.Xc.Equal(write.Reader) {
+		return errors.New("Reader of the read does not match the write")
+	}
+	msg, err := DecryptMessage(req.Key, req.Read.InclusionProof.Key, req.Read.Latest.Hash)
+	if err != nil {
+		return err
+	}
+	return schnorr.Verify(cothority.Suite, read.Xc, msg, req.Sig)
+}
+
+// ConsumeRead marks the read with the given instance ID of the data stored
+// under dataKey as used. It fails if it was used before. The mark is only
+// kept by this server, so a read of data stored on k servers can be used k
+// times in all. It is removed together with the data, see pruneReadsTx.
+func (sdb *SemiCentralizedDB) ConsumeRead(dataKey []byte, readID []byte) error {
+	key := append(append([]byte{}, dataKey...), readID...)
+	return sdb.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sdb.readsBucket)
+		if b.Get(key) != nil {
+			return errors.New("Read has already been used")
+		}
+		ts := make([]byte, 8)
+		binary.BigEndian.PutUint64(ts, uint64(time.Now().Unix()))
+		return b.Put(key, ts)
+	})
+}
+
+// pruneReadsTx removes the marks of the used reads of the data stored under
+// dataKey, once the data is deleted.
+func (sdb *SemiCentralizedDB) pruneReadsTx(tx *bolt.Tx, dataKey []byte) error {
+	c := tx.Bucket(sdb.readsBucket).Cursor()
+	for k, _ := c.Seek(dataKey); k != nil && bytes.HasPrefix(k, dataKey); k, _ = c.Seek(dataKey) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) decryptPolicy() DecryptPolicy {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	return s.storage.Policy
+}
+
+// policyData returns the data of the admin message that replaces the
+// policy with the given version by p.
+func policyData(p DecryptPolicy, version int) []byte {
+	data := make([]byte, 10)
+	if p.Strict {
+		data[0] = 1
+	}
+	if p.SingleUse {
+		data[1] = 1
+	}
+	binary.LittleEndian.PutUint64(data[2:], uint64(version))
+	return data
+}
+
+// SetDecryptPolicy changes how decrypt requests are checked. The request
+// has to be signed with the identity key of the conode and apply to the
+// current version of the policy.
+func (s *Service) SetDecryptPolicy(req *SetDecryptPolicyRequest) (*SetDecryptPolicyReply, error) {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	if req.Version != s.storage.PolicyVersion {
+		log.Errorf("SetDecryptPolicy error: version %d does not match %d", req.Version, s.storage.PolicyVersion)
+		return nil, errors.New("Decrypt policy version does not match")
+	}
+	err := util.VerifyAdminRequest(s.ServerIdentity().Public, policyAction, req.Timestamp,
+		policyData(req.Policy, req.Version), req.Sig, time.Now())
+	if err != nil {
+		log.Errorf("SetDecryptPolicy error: %v", err)
+		return nil, err
+	}
+	old := s.storage.Policy
+	s.storage.Policy = req.Policy
+	s.storage.PolicyVersion++
+	if err = s.Save(storageID, s.storage); err != nil {
+		s.storage.Policy = old
+		s.storage.PolicyVersion--
+		log.Errorf("SetDecryptPolicy error: %v", err)
+		return nil, err
+	}
+	log.Lvlf1("%s: decrypt policy is now %+v", s.ServerIdentity(), req.Policy)
+	return &SetDecryptPolicyReply{Version: s.storage.PolicyVersion}, nil
+}
+
+// GetDecryptPolicy returns the decrypt policy and its version.
+func (s *Service) GetDecryptPolicy(req *GetDecryptPolicyRequest) (*GetDecryptPolicyReply, error) {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	return &GetDecryptPolicyReply{Policy: s.storage.Policy, Version: s.storage.PolicyVersion}, nil
+}
+
+// SetDecryptPolicy changes the decrypt policy of every store node, so that
+// all copies of the data are checked the same way. adminSks holds the
+// identity keys of the store nodes, in the order of the roster. Every
+// request is bound to the current version of the policy of its node. The
+// policy is sent to all of them even if some fail, and the error lists the
+// ones that did not apply it.
+func (scCl *SCClient) SetDecryptPolicy(adminSks []kyber.Scalar, p DecryptPolicy) error {
+	nodes, err := scCl.storeNodes()
+	if err != nil {
+		return err
+	}
+	if len(adminSks) != len(nodes) {
+		return fmt.Errorf("Got %d admin keys for %d store nodes", len(adminSks), len(nodes))
+	}
+	ts := time.Now().Unix()
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, si := range nodes {
+		wg.Add(1)
+		go func(i int, si *network.ServerIdentity) {
+			defer wg.Done()
+			cur := &GetDecryptPolicyReply{}
+			if err := scCl.c.SendProtobuf(si, &GetDecryptPolicyRequest{}, cur); err != nil {
+				errs[i] = err
+				return
+			}
+			sig, err := schnorr.Sign(cothority.Suite, adminSks[i],
+				util.AdminMessage(policyAction, ts, policyData(p, cur.Version)))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			req := &SetDecryptPolicyRequest{Policy: p, Version: cur.Version, Timestamp: ts, Sig: sig}
+			errs[i] = scCl.c.SendProtobuf(si, req, &SetDecryptPolicyReply{})
+		}(i, si)
+	}
+	wg.Wait()
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", nodes[i], err))
+		}
+	}
+	if len(failed) > 0 {
+		err = fmt.Errorf("Decrypt policy not set on %d of %d store nodes: %s",
+			len(failed), len(nodes), strings.Join(failed, "; "))
+		log.Errorf("Setting decrypt policy failed: %v", err)
+		return err
+	}
+	return nil
+}
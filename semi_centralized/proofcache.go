@@ -0,0 +1,155 @@
+package semicentralized
+
+/*
+The proofcache.go remembers the skipblocks whose forward links were
+verified, per skipchain. A proof then only needs its links after the last
+known block to be verified, instead of all links from the genesis block, and
+repeated decrypt requests on the same chain skip most of the signature
+checks.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// MaxCachedBlocks is the number of verified blocks kept per skipchain. If
+// a chain has more, its cache is started again.
+var MaxCachedBlocks = 4096
+
+// verifiedChain maps the hash of a verified block of a chain to the keys
+// that sign its forward links.
+type verifiedChain map[string][]kyber.Point
+
+// proofCache holds the verified blocks of every skipchain, and how many
+// links were taken from it or had to be verified.
+type proofCache struct {
+	sync.Mutex
+	chains map[string]verifiedChain
+	hits   int64
+	misses int64
+}
+
+func newProofCache() *proofCache {
+	return &proofCache{chains: make(map[string]verifiedChain)}
+}
+
+// Verify checks p like byzcoin.Proof.Verify, but only verifies the forward
+// links that lead to blocks that are not in the cache yet.
+func (pc *proofCache) Verify(p *byzcoin.Proof, scid skipchain.SkipBlockID) error {
+	if !p.InclusionProof.Consistent() {
+		return errors.New("Inclusion proof is not consistent")
+	}
+	var header byzcoin.DataHeader
+	if err := protobuf.Decode(p.Latest.Data, &header); err != nil {
+		return err
+	}
+	if !bytes.Equal(p.InclusionProof.TreeRootHash(), header.CollectionRoot) {
+		return errors.New("Inclusion proof does not match the latest block")
+	}
+	if !p.Latest.CalculateHash().Equal(p.Latest.Hash) {
+		return errors.New("Latest block has an invalid hash")
+	}
+	if len(p.Links) == 0 {
+		return errors.New("Missing skipchain links")
+	}
+	if !p.Links[len(p.Links)-1].To.Equal(p.Latest.Hash) {
+		return errors.New("Links do not lead to the latest block")
+	}
+
+	start, publics := pc.lookup(p.Links, scid)
+	if start == 0 {
+		first := p.Links[0]
+		if !first.To.Equal(scid) || first.NewRoster == nil {
+			return errors.New("First link does not point to the genesis block")
+		}
+		publics = first.NewRoster.Publics()
+	}
+	verified := map[string][]kyber.Point{string(p.Links[start].To): publics}
+	for i := start + 1; i < len(p.Links); i++ {
+		l := p.Links[i]
+		if !l.From.Equal(p.Links[i-1].To) {
+			return errors.New("Links are not consecutive")
+		}
+		if err := l.Verify(cothority.Suite, publics); err != nil {
+			return errors.New("Invalid forward link: " + err.Error())
+		}
+		if l.NewRoster != nil {
+			publics = l.NewRoster.Publics()
+		}
+		verified[string(l.To)] = publics
+	}
+	pc.add(scid, verified, int64(start), int64(len(p.Links)-1-start))
+	return nil
+}
+
+// lookup returns the index of the last link that leads to a known block of
+// scid, and the keys of that block. It returns 0 and nil if there is none.
+func (pc *proofCache) lookup(links []skipchain.ForwardLink, scid skipchain.SkipBlockID) (int, []kyber.Point) {
+	pc.Lock()
+	defer pc.Unlock()
+	chain := pc.chains[string(scid)]
+	for i := len(links) - 1; i > 0; i-- {
+		if publics, ok := chain[string(links[i].To)]; ok {
+			return i, publics
+		}
+	}
+	return 0, nil
+}
+
+func (pc *proofCache) add(scid skipchain.SkipBlockID, verified map[string][]kyber.Point, hits, misses int64) {
+	pc.Lock()
+	defer pc.Unlock()
+	chain := pc.chains[string(scid)]
+	if chain == nil || len(chain)+len(verified) > MaxCachedBlocks {
+		chain = make(verifiedChain)
+		pc.chains[string(scid)] = chain
+	}
+	for id, publics := range verified {
+		chain[id] = publics
+	}
+	pc.hits += hits
+	pc.misses += misses
+}
+
+func (pc *proofCache) stats() *ProofCacheStatsReply {
+	pc.Lock()
+	defer pc.Unlock()
+	blocks := 0
+	for _, chain := range pc.chains {
+		blocks += len(chain)
+	}
+	return &ProofCacheStatsReply{Chains: len(pc.chains), Blocks: blocks, Hits: pc.hits, Misses: pc.misses}
+}
+
+// HitRate returns the share of the links of the verified proofs that were
+// found in the cache.
+func (r *ProofCacheStatsReply) HitRate() float64 {
+	if r.Hits+r.Misses == 0 {
+		return 0
+	}
+	return float64(r.Hits) / float64(r.Hits+r.Misses)
+}
+
+// ProofCacheStats returns the statistics of the cache of verified blocks.
+func (s *Service) ProofCacheStats(req *ProofCacheStatsRequest) (*ProofCacheStatsReply, error) {
+	return s.proofs.stats(), nil
+}
+
+// ProofCacheStats returns the statistics of the cache of verified blocks
+// of si.
+func (scCl *SCClient) ProofCacheStats(si *network.ServerIdentity) (*ProofCacheStatsReply, error) {
+	reply := &ProofCacheStatsReply{}
+	if err := scCl.c.SendProtobuf(si, &ProofCacheStatsRequest{}, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
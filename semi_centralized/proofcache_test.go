@@ -0,0 +1,103 @@
+package semicentralized
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet"
+)
+
+// forgeLink returns a copy of p whose last forward link has an invalid
+// signature.
+func forgeLink(p *byzcoin.Proof) *byzcoin.Proof {
+	f := *p
+	f.Links = append([]skipchain.ForwardLink{}, p.Links...)
+	last := &f.Links[len(f.Links)-1]
+	last.Signature.Sig = append([]byte{}, last.Signature.Sig...)
+	last.Signature.Sig[0] ^= 1
+	return &f
+}
+
+func TestProofCache(t *testing.T) {
+	local := onet.NewTCPTest(cothority.Suite)
+	defer local.CloseAll()
+	_, roster, _ := local.GenTree(3, true)
+	cl, admin, gDarc, err := SetupByzcoin(roster, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scCl := NewClient(cl)
+	// addBlock adds a block to the chain by spawning a darc.
+	n := 0
+	addBlock := func() {
+		n++
+		d := darc.NewDarc(darc.InitRules([]darc.Identity{admin.Identity()}, []darc.Identity{admin.Identity()}),
+			[]byte(fmt.Sprintf("darc %d", n)))
+		if _, err := scCl.SpawnDarc(admin, *d, gDarc, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getProof := func() *byzcoin.Proof {
+		resp, err := cl.GetProof(gDarc.GetBaseID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &resp.Proof
+	}
+	addBlock()
+	addBlock()
+	p1 := getProof()
+
+	pc := newProofCache()
+	if err = pc.Verify(forgeLink(p1), cl.ID); err == nil {
+		t.Fatal("Forged link was accepted")
+	}
+	tests := []struct {
+		name   string
+		hits   int64
+		misses int64
+	}{
+		// Only the genesis block is known at first.
+		{"empty cache", 0, int64(len(p1.Links) - 1)},
+		{"cached proof", int64(len(p1.Links) - 1), 0},
+	}
+	for _, tt := range tests {
+		before := pc.stats()
+		if err = pc.Verify(p1, cl.ID); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		st := pc.stats()
+		if st.Hits-before.Hits != tt.hits || st.Misses-before.Misses != tt.misses {
+			t.Fatalf("%s: %d hits and %d misses", tt.name, st.Hits-before.Hits, st.Misses-before.Misses)
+		}
+	}
+
+	// A forged link after the cached blocks is still verified, and the
+	// block it leads to is not cached.
+	addBlock()
+	p2 := getProof()
+	if p2.Latest.Index <= p1.Latest.Index {
+		t.Fatal("No new block")
+	}
+	if err = pc.Verify(forgeLink(p2), cl.ID); err == nil {
+		t.Fatal("Forged link after cached blocks was accepted")
+	}
+	before := pc.stats()
+	if err = pc.Verify(p2, cl.ID); err != nil {
+		t.Fatal(err)
+	}
+	st := pc.stats()
+	if st.Hits == before.Hits || st.Misses == before.Misses {
+		t.Fatalf("Got %d hits and %d misses for the new block", st.Hits-before.Hits, st.Misses-before.Misses)
+	}
+	if st.Chains != 1 {
+		t.Fatalf("Cache holds %d chains", st.Chains)
+	}
+	if err = pc.Verify(p2, skipchain.SkipBlockID("other chain")); err == nil {
+		t.Fatal("Proof was accepted for another chain")
+	}
+}
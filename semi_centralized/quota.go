@@ -0,0 +1,111 @@
+package semicentralized
+
+/*
+The quota.go lets the administrator of the conode register writers and
+limit how much they can store and how fast they can write. As long as no
+writer is registered, the service accepts data from anyone.
+*/
+
+import (
+	"time"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/log"
+)
+
+// authStore checks that the store request is signed by its owner, who has
+// to be a registered writer within its limits, and has room for size more
+// bytes.
+func (s *Service) authStore(req *StoreRequest, size int64, now time.Time) error {
+	digest, err := StoreDigest(req)
+	if err != nil {
+		return err
+	}
+	return s.db.writers.Authenticate(req.Owner, req.Timestamp, digest, req.Sig, size, now)
+}
+
+// SetWriter registers a writer or changes its quota, or removes it. The
+// request has to be signed with the identity key of the conode.
+func (s *Service) SetWriter(req *SetWriterRequest) (*SetWriterReply, error) {
+	data, err := util.WriterData(req.Writer, req.Quota, req.Remove, req.Version)
+	if err != nil {
+		log.Errorf("SetWriter error: %v", err)
+		return nil, err
+	}
+	err = util.VerifyAdminRequest(s.ServerIdentity().Public, util.WriterAction, req.Timestamp, data, req.Sig, time.Now())
+	if err != nil {
+		log.Errorf("SetWriter error: %v", err)
+		return nil, err
+	}
+	if req.Remove {
+		if err = s.db.writers.RemoveWriter(req.Writer, req.Version); err != nil {
+			return nil, err
+		}
+		return &SetWriterReply{}, nil
+	}
+	wi, err := s.db.writers.SetWriter(req.Writer, req.Quota, req.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &SetWriterReply{Used: wi.Used}, nil
+}
+
+// GetWriter returns the registration of a writer and the version of the
+// writers.
+func (s *Service) GetWriter(req *GetWriterRequest) (*GetWriterReply, error) {
+	wi, version, err := s.db.writers.GetWriter(req.Writer)
+	if err != nil {
+		log.Errorf("GetWriter error: %v", err)
+		return nil, err
+	}
+	reply := &GetWriterReply{Version: version}
+	if wi != nil {
+		reply.Registered = true
+		reply.Quota = wi.Quota
+		reply.Used = wi.Used
+	}
+	return reply, nil
+}
+
+// SetWriter registers writer on the storage server with quota q, or
+// removes it, and returns the number of bytes the writer has stored.
+// adminSk is the identity key of the server. The request is bound to the
+// current version of the writers of the server, so that it cannot be
+// replayed after a later change.
+func (scCl *SCClient) SetWriter(adminSk kyber.Scalar, writer kyber.Point, q util.Quota, remove bool) (int64, error) {
+	cur, err := scCl.GetWriter(writer)
+	if err != nil {
+		return 0, err
+	}
+	data, err := util.WriterData(writer, q, remove, cur.Version)
+	if err != nil {
+		return 0, err
+	}
+	ts := time.Now().Unix()
+	sig, err := schnorr.Sign(cothority.Suite, adminSk, util.AdminMessage(util.WriterAction, ts, data))
+	if err != nil {
+		return 0, err
+	}
+	reply := &SetWriterReply{}
+	req := &SetWriterRequest{Writer: writer, Quota: q, Remove: remove, Version: cur.Version, Timestamp: ts, Sig: sig}
+	err = scCl.c.SendProtobuf(scCl.BcClient.Roster.List[0], req, reply)
+	if err != nil {
+		log.Errorf("Setting writer quota failed: %v", err)
+		return 0, err
+	}
+	return reply.Used, nil
+}
+
+// GetWriter returns the registration of writer on the storage server.
+func (scCl *SCClient) GetWriter(writer kyber.Point) (*GetWriterReply, error) {
+	reply := &GetWriterReply{}
+	err := scCl.c.SendProtobuf(scCl.BcClient.Roster.List[0], &GetWriterRequest{Writer: writer}, reply)
+	if err != nil {
+		log.Errorf("Getting writer failed: %v", err)
+		return nil, err
+	}
+	return reply, nil
+}
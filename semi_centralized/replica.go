@@ -0,0 +1,178 @@
+package semicentralized
+
+/*
+The replica.go stores the off-chain data on several members of the roster,
+so that it can still be decrypted if some of them are down. Every replica
+keeps its own copy of the symmetric key, encrypted to its own key, which is
+bound to the write on byzcoin by the proof of the ciphertext and by the
+encrypted reader.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso"
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// pickReplicaKey keeps the entry of req.Replicas that is encrypted to one of
+// the keys of this server. Entries that are missing a part of the
+// ciphertext or of its proof are rejected.
+func (s *Service) pickReplicaKey(req *StoreRequest) error {
+	if len(req.Replicas) == 0 {
+		req.Key = nil
+		return nil
+	}
+	for _, rk := range req.Replicas {
+		if !completeReplicaKey(rk) {
+			return errors.New("Incomplete replica key")
+		}
+	}
+	for _, sk := range s.decryptionKeys() {
+		pub := cothority.Suite.Point().Mul(sk, nil)
+		for _, rk := range req.Replicas {
+			if rk.Server.Equal(pub) {
+				req.Key = rk
+				req.Replicas = nil
+				return nil
+			}
+		}
+	}
+	if req.Shard != nil {
+		// Shards can also be kept by servers that cannot decrypt.
+		req.Key = nil
+		req.Replicas = nil
+		return nil
+	}
+	return errors.New("No replica key for this server")
+}
+
+// completeReplicaKey returns true if rk has all the points and scalars of
+// the ciphertext and its proof.
+func completeReplicaKey(rk *util.ReplicaKey) bool {
+	return rk != nil && rk.Server != nil && rk.K != nil && rk.C != nil &&
+		rk.Ubar != nil && rk.E != nil && rk.F != nil
+}
+
+// replicaWrite returns the write with K and C replaced by the copy of the
+// key stored on this server, after checking that the copy belongs to the
+// write.
+func replicaWrite(wt *calypso.SemiWrite, sr *StoreRequest) (*calypso.SemiWrite, error) {
+	rk := sr.Key
+	if rk == nil {
+		return wt, nil
+	}
+	if !completeReplicaKey(rk) {
+		return nil, errors.New("Incomplete replica key")
+	}
+	if rk.K.Equal(wt.K) && rk.C.Equal(wt.C) {
+		return wt, nil
+	}
+	err := util.VerifyWriteProof(rk.Server, rk.K, rk.C, rk.Ubar, rk.E, rk.F, wt.Reader, wt.DataHash)
+	if err != nil {
+		return nil, errors.New("Invalid replica key: " + err.Error())
+	}
+	rw := *wt
+	rw.K = rk.K
+	rw.C = rk.C
+	return &rw, nil
+}
+
+// NewReplicatedClient returns a client that stores the data on the first k
+// members of the roster of bc and reads it from any member that has it.
+func NewReplicatedClient(bc *byzcoin.Client, k int) *SCClient {
+	scCl := NewClient(bc)
+	scCl.replicas = k
+	return scCl
+}
+
+// storeNodes returns the roster members that store the data.
+func (scCl *SCClient) storeNodes() ([]*network.ServerIdentity, error) {
+	list := scCl.BcClient.Roster.List
+	if len(list) == 0 {
+		return nil, errors.New("Empty roster")
+	}
+	k := scCl.replicas
+	if k == 0 {
+		k = 1
+	}
+	if k < 0 || k > len(list) {
+		return nil, fmt.Errorf("Invalid number of replicas %d for a roster of size %d", k, len(list))
+	}
+	return list[:k], nil
+}
+
+// GetServerKeys returns the encryption keys of the roster members that
+// store the data, to be passed to util.CreateReplicatedWriteData.
+func (scCl *SCClient) GetServerKeys() ([]kyber.Point, error) {
+	nodes, err := scCl.storeNodes()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]kyber.Point, len(nodes))
+	for i, si := range nodes {
+		if keys[i], err = scCl.getServerKey(si); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// storeAll calls f for every store node in parallel and returns the
+// result of the first one. It fails if f fails for any of them.
+func (scCl *SCClient) storeAll(f func(*network.ServerIdentity) (interface{}, error)) (interface{}, error) {
+	nodes, err := scCl.storeNodes()
+	if err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, si := range nodes {
+		wg.Add(1)
+		go func(i int, si *network.ServerIdentity) {
+			defer wg.Done()
+			replies[i], errs[i] = f(si)
+		}(i, si)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("Replica %v failed: %v", nodes[i], err)
+		}
+	}
+	return replies[0], nil
+}
+
+// sendAll sends msg to every store node and returns the first reply.
+func (scCl *SCClient) sendAll(msg interface{}, newReply func() interface{}) (interface{}, error) {
+	return scCl.storeAll(func(si *network.ServerIdentity) (interface{}, error) {
+		reply := newReply()
+		err := scCl.c.SendProtobuf(si, msg, reply)
+		return reply, err
+	})
+}
+
+// tryAll calls f for the members of the roster in turn, starting with the
+// store nodes, until it succeeds for one of them.
+func (scCl *SCClient) tryAll(f func(*network.ServerIdentity) error) error {
+	list := scCl.BcClient.Roster.List
+	if len(list) == 0 {
+		return errors.New("Empty roster")
+	}
+	var err error
+	for _, si := range list {
+		if err = f(si); err == nil {
+			return nil
+		}
+		log.Lvlf2("Replica %v failed: %v", si, err)
+	}
+	return err
+}
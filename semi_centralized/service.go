@@ -10,6 +10,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/ceyhunalp/calypso_experiments/util"
 	"github.com/dedis/cothority"
@@ -29,7 +30,19 @@ func init() {
 	var err error
 	templateID, err = onet.RegisterNewService(ServiceName, newSemiCentralizedService)
 	log.ErrFatal(err)
-	network.RegisterMessages(&storage{}, &StoreRequest{}, &StoreReply{}, &DecryptRequest{}, &DecryptReply{})
+	network.RegisterMessages(&storage{}, &StoreRequest{}, &StoreReply{}, &DecryptRequest{}, &DecryptReply{},
+		&DeleteRequest{}, &DeleteReply{}, &GetKeyRequest{}, &GetKeyReply{},
+		&RotateKeyRequest{}, &RotateKeyReply{},
+		&BeginUploadRequest{}, &BeginUploadReply{}, &UploadChunkRequest{}, &UploadChunkReply{},
+		&UploadStatusRequest{}, &UploadStatusReply{}, &FinishUploadRequest{},
+		&GetChunkInfoRequest{}, &GetChunkInfoReply{}, &GetChunkRequest{}, &GetChunkReply{},
+		&SetWriterRequest{}, &SetWriterReply{}, &GetWriterRequest{}, &GetWriterReply{},
+		&ListShardsRequest{}, &ListShardsReply{}, &GetShardRequest{}, &GetShardReply{},
+		&ReleaseRequest{}, &ReleaseReply{}, &ChallengeRequest{}, &ChallengeReply{},
+		&SetDecryptPolicyRequest{}, &SetDecryptPolicyReply{}, &GetDecryptPolicyRequest{}, &GetDecryptPolicyReply{},
+		&SubmitDecryptRequest{}, &SubmitDecryptReply{}, &PollDecryptRequest{}, &PollDecryptReply{},
+		&CancelDecryptRequest{}, &CancelDecryptReply{}, &DecryptStatsRequest{}, &DecryptStatsReply{},
+		&ProofCacheStatsRequest{}, &ProofCacheStatsReply{})
 }
 
 // Service is our template-service
@@ -39,6 +52,15 @@ type Service struct {
 	*onet.ServiceProcessor
 	db      *SemiCentralizedDB
 	storage *storage
+	// closing stops the sweeper of expired data and the decrypt workers,
+	// and wg waits for them to return.
+	closing   chan bool
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	// jobs holds the asynchronous decrypt requests.
+	jobs *jobPool
+	// proofs holds the skipblocks that were verified in requests.
+	proofs *proofCache
 }
 
 // storageID reflects the data we're storing - we could store more
@@ -48,68 +70,138 @@ var storageID = []byte("SemiCentralized")
 // storage is used to save our data.
 type storage struct {
 	//Suite *edwards25519.SuiteEd25519
+	// EncKey is the key the symmetric keys of the writes are encrypted to.
+	// It is nil until the first rotation, and the identity key is used.
+	EncKey kyber.Scalar
+	// RetiredKeys are the previous encryption keys, newest first.
+	RetiredKeys []kyber.Scalar
+	// Policy is how strictly decrypt requests are checked, and
+	// PolicyVersion the number of times it has been changed.
+	Policy        DecryptPolicy
+	PolicyVersion int
 	sync.Mutex
 }
 
 func (s *Service) StoreData(req *StoreRequest) (*StoreReply, error) {
-	storedKey, err := s.db.StoreData(req)
+	err := s.authStore(req, int64(len(req.Data)), time.Now())
+	if err != nil {
+		log.Errorf("StoreData error: %v", err)
+		return nil, err
+	}
+	if err = s.pickReplicaKey(req); err != nil {
+		log.Errorf("StoreData error: %v", err)
+		return nil, err
+	}
+	var storedKey string
+	if req.Shard != nil {
+		storedKey, err = s.db.StoreShard(req)
+	} else {
+		storedKey, err = s.db.StoreData(req)
+	}
 	if err != nil {
 		return nil, err
 	}
 	reply := &StoreReply{
 		StoredKey: storedKey,
 	}
+	if req.Shard == nil {
+		reply.Root = req.DataHash
+	}
 	return reply, nil
 }
 
 func (s *Service) Decrypt(req *DecryptRequest) (*DecryptReply, error) {
-	sk := s.ServerIdentity().GetPrivate()
+	keys := s.decryptionKeys()
 	storedData, err := s.db.GetStoredData(req.Key)
 	if err != nil {
+		// Servers that only hold a shard of the data can still decrypt the
+		// key, and the data is reconstructed by the client.
+		if storedData, err = s.db.AnyShard(req.Key); err != nil {
+			return nil, err
+		}
+	}
+	if storedData.expired(time.Now()) {
+		return nil, errors.New("Data has expired")
+	}
+	policy := s.decryptPolicy()
+	writeTxn, err := verifyDecryptRequest(req, storedData, policy.Strict, s.proofs)
+	if err != nil {
+		log.Errorf("getDecryptedData error: %v", err)
 		return nil, err
 	}
-	writeTxn, err := verifyDecryptRequest(req, storedData, sk)
+	replicaTxn, err := replicaWrite(writeTxn, storedData)
 	if err != nil {
 		log.Errorf("getDecryptedData error: %v", err)
 		return nil, err
 	}
-	k, c, err := reencryptData(writeTxn, sk)
+	k, c, proof, serverKey, err := reencryptData(replicaTxn, keys)
 	if err != nil {
 		log.Errorf("getDecryptedData error: %v", err)
 		return nil, err
 	}
-	return &DecryptReply{Data: storedData.Data, DataHash: storedData.DataHash, K: k, C: c}, nil
+	reply := &DecryptReply{Data: storedData.Data, DataHash: storedData.DataHash, K: k, C: c,
+		ServerKey: serverKey, Proof: proof}
+	if storedData.Shard != nil {
+		reply.Data = nil
+	}
+	if policy.SingleUse {
+		if err = s.db.ConsumeRead(storedData.DataHash, req.Read.InclusionProof.Key); err != nil {
+			log.Errorf("getDecryptedData error: %v", err)
+			return nil, err
+		}
+	}
+	if replicaTxn != writeTxn {
+		reply.Replica = storedData.Key
+	}
+	return reply, nil
 	//return getDecryptedData(req, storedData, sk)
 }
 
-func reencryptData(wt *calypso.SemiWrite, sk kyber.Scalar) (kyber.Point, kyber.Point, error) {
-	symKey, err := util.ElGamalDecrypt(sk, wt.K, wt.C)
-	if err != nil {
-		log.Errorf("reencryptData error: %v", err)
-		return nil, nil, err
+// reencryptData decrypts the symmetric key of the write with the first of
+// keys for which the encrypted reader can be opened, and re-encrypts it to
+// the reader. It also returns the proof of the re-encryption and the
+// public key it was made with.
+func reencryptData(wt *calypso.SemiWrite, keys []kyber.Scalar) (kyber.Point, kyber.Point, *util.ReencryptProof, kyber.Point, error) {
+	var symKey, decReader []byte
+	var sk kyber.Scalar
+	var err error
+	for _, sk = range keys {
+		symKey, err = util.ElGamalDecrypt(sk, wt.K, wt.C)
+		if err != nil {
+			continue
+		}
+		decReader, err = util.AeadOpen(symKey, wt.EncReader)
+		if err == nil {
+			break
+		}
 	}
-
-	decReader, err := util.AeadOpen(symKey, wt.EncReader)
 	if err != nil {
 		log.Errorf("reencryptData error: %v", err)
-		return nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
 	ok, err := util.CompareKeys(wt.Reader, decReader)
 	if err != nil {
 		log.Errorf("reencryptData error: %v", err)
-		return nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 	if ok != 0 {
 		log.Errorf("reencryptData error: %v", err)
-		return nil, nil, errors.New("Reader public key does not match")
+		return nil, nil, nil, nil, errors.New("Reader public key does not match")
 	}
 
-	k, c, _ := util.ElGamalEncrypt(wt.Reader, symKey)
-	return k, c, nil
+	k, c, proof, err := util.Reencrypt(sk, wt.K, wt.C, wt.Reader)
+	if err != nil {
+		log.Errorf("reencryptData error: %v", err)
+		return nil, nil, nil, nil, err
+	}
+	return k, c, proof, cothority.Suite.Point().Mul(sk, nil), nil
 }
 
-func verifyDecryptRequest(req *DecryptRequest, storedData *StoreRequest, sk kyber.Scalar) (*calypso.SemiWrite, error) {
+// verifyDecryptRequest checks the proofs of the request against the stored
+// data. If strict is set, the request has to be signed with the key of the
+// read over DecryptMessage. The proofs are verified with the blocks in pc.
+func verifyDecryptRequest(req *DecryptRequest, storedData *StoreRequest, strict bool, pc *proofCache) (*calypso.SemiWrite, error) {
 	log.Lvl2("Re-encrypt the key to the public key of the reader")
 
 	var read calypso.Read
@@ -126,11 +218,11 @@ func verifyDecryptRequest(req *DecryptRequest, storedData *StoreRequest, sk kybe
 		log.Errorf("verifyDecryptRequest error: read doesn't point to passed write")
 		return nil, errors.New("read doesn't point to passed write")
 	}
-	if err := req.Read.Verify(req.SCID); err != nil {
+	if err := pc.Verify(req.Read, req.SCID); err != nil {
 		log.Errorf("verifyDecryptRequest error: read proof cannot be verified to come from scID" + err.Error())
 		return nil, errors.New("read proof cannot be verified to come from scID: " + err.Error())
 	}
-	if err := req.Write.Verify(req.SCID); err != nil {
+	if err := pc.Verify(req.Write, req.SCID); err != nil {
 		log.Errorf("verifyDecryptRequest error: write proof cannot be verified to come from scID" + err.Error())
 		return nil, errors.New("write proof cannot be verified to come from scID: " + err.Error())
 	}
@@ -145,7 +237,19 @@ func verifyDecryptRequest(req *DecryptRequest, storedData *StoreRequest, sk kybe
 		log.Errorf("verifyDecryptRequest error: Keys do not match")
 		return nil, errors.New("Keys do not match")
 	}
-	err = schnorr.Verify(cothority.Suite, write.Reader, keyBytes, req.Sig)
+	if !bytes.Equal(write.DataHash, storedData.DataHash) {
+		log.Errorf("verifyDecryptRequest error: Stored data does not belong to the write")
+		return nil, errors.New("Stored data does not belong to the write")
+	}
+	if !storedData.Chunked && storedData.Shard == nil && !util.VerifyDataHash(storedData.Data, write.DataHash) {
+		log.Errorf("verifyDecryptRequest error: Stored data does not match its hash")
+		return nil, errors.New("Stored data does not match its hash")
+	}
+	if strict || req.Strict {
+		err = verifyStrictDecrypt(req, &read, &write)
+	} else {
+		err = schnorr.Verify(cothority.Suite, write.Reader, keyBytes, req.Sig)
+	}
 	if err != nil {
 		log.Errorf("verifyDecryptRequest error: %v", err)
 		return nil, err
@@ -192,16 +296,37 @@ func (s *Service) tryLoad() error {
 // be stored in memory for tests and simulations, and on disk for real deployments.
 func newSemiCentralizedService(c *onet.Context) (onet.Service, error) {
 	db, bucket := c.GetAdditionalBucket([]byte("semicentralizedtransactions"))
+	blobs, err := openBlobStore(Blobs, c.ServerIdentity().Public.String(), db, bucket)
+	if err != nil {
+		log.Errorf("Couldn't open blob store: %v", err)
+		return nil, err
+	}
+	sdb, err := NewSemiCentralizedDB(db, bucket, blobs)
+	if err != nil {
+		return nil, err
+	}
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
-		db:               NewSemiCentralizedDB(db, bucket),
+		db:               sdb,
+		closing:          make(chan bool),
+		jobs:             newJobPool(DecryptWorkers, DecryptQueueSize),
+		proofs:           newProofCache(),
 	}
-	if err := s.RegisterHandlers(s.StoreData, s.Decrypt); err != nil {
+	if err := s.RegisterHandlers(s.StoreData, s.Decrypt, s.Delete, s.GetKey, s.RotateKey,
+		s.BeginUpload, s.UploadChunk, s.UploadStatus, s.FinishUpload, s.GetChunkInfo, s.GetChunk,
+		s.SetWriter, s.GetWriter, s.ListShards, s.GetShard, s.ReleaseData,
+		s.Challenge, s.SetDecryptPolicy, s.GetDecryptPolicy,
+		s.SubmitDecrypt, s.PollDecrypt, s.CancelDecrypt, s.DecryptStats, s.ProofCacheStats); err != nil {
 		return nil, errors.New("Couldn't register messages")
 	}
 	if err := s.tryLoad(); err != nil {
 		log.Error(err)
 		return nil, err
 	}
+	s.wg.Add(1 + s.jobs.workers)
+	go s.sweep()
+	for i := 0; i < s.jobs.workers; i++ {
+		go s.decryptWorker()
+	}
 	return s, nil
 }
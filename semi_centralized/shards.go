@@ -0,0 +1,436 @@
+package semicentralized
+
+/*
+The shards.go stores erasure coded data: the client splits the encrypted
+data into N shards, any K of which reconstruct it, and stores them on
+different members of the roster. The DataHash of the write on byzcoin is
+the root of the layout of the shards, so every shard can be verified on
+its own. This costs N/K times the size of the data, instead of k times for
+k full replicas.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+func shardKey(root []byte, index int) []byte {
+	key := make([]byte, len(root)+4)
+	copy(key, root)
+	binary.BigEndian.PutUint32(key[len(root):], uint32(index))
+	return key
+}
+
+// StoreShard stores one shard of erasure coded data, after checking it
+// against its layout.
+func (sdb *SemiCentralizedDB) StoreShard(req *StoreRequest) (string, error) {
+	sl := req.Shard
+	if err := sl.Check(); err != nil {
+		return "", err
+	}
+	if !bytes.Equal(sl.Root(), req.DataHash) {
+		return "", errors.New("Data hash is not the root of the shards")
+	}
+	if err := sl.VerifyShard(req.ShardIndex, req.Data); err != nil {
+		return "", err
+	}
+	if req.TTL != 0 {
+		return "", errors.New("Erasure coded data cannot have a TTL")
+	}
+	req.ExpireTime = 0
+	req.Chunked = false
+	req.Deadline = 0
+	if len(req.SCID) > 0 {
+		req.Deadline = time.Now().Add(WriteGrace).Unix()
+	}
+	meta := metadata(req)
+	val, err := network.Marshal(meta)
+	if err != nil {
+		return "", errors.New("Cannot marshal store request")
+	}
+	key := shardKey(req.DataHash, req.ShardIndex)
+	if err = sdb.putBlob(sdb.shardBucket, key, req.Data); err != nil {
+		log.Errorf("StoreShard error: %v", err)
+		return "", err
+	}
+	defer sdb.releaseBlob(key)
+	err = sdb.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sdb.shardBucket)
+		if b.Get(key) != nil {
+			return errors.New("Shard already exists")
+		}
+		if err := sdb.writers.ChargeTx(tx, req.Owner, int64(len(val))+meta.Size); err != nil {
+			return err
+		}
+		if err := b.Put(key, val); err != nil {
+			return err
+		}
+		return sdb.addPendingTx(tx, req)
+	})
+	if err != nil {
+		sdb.blobs.Delete(key)
+		log.Errorf("StoreShard error: %v", err)
+		return "", err
+	}
+	return hex.EncodeToString(req.DataHash), nil
+}
+
+// forShards calls f for every shard of the data with the given key.
+func (sdb *SemiCentralizedDB) forShards(tx *bolt.Tx, key string, f func(k []byte, sr *StoreRequest) error) error {
+	root, err := hex.DecodeString(key)
+	if err != nil {
+		return err
+	}
+	c := tx.Bucket(sdb.shardBucket).Cursor()
+	for k, v := c.Seek(root); k != nil && bytes.HasPrefix(k, root) && len(k) == len(root)+4; k, v = c.Next() {
+		_, msg, err := network.Unmarshal(append([]byte{}, v...), cothority.Suite)
+		if err != nil {
+			return err
+		}
+		if err = f(append([]byte{}, k...), msg.(*StoreRequest)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetShards returns the shards of the data with the given key held by this
+// server.
+func (sdb *SemiCentralizedDB) GetShards(key string) ([]*StoreRequest, error) {
+	var shards []*StoreRequest
+	err := sdb.DB.View(func(tx *bolt.Tx) error {
+		return sdb.forShards(tx, key, func(_ []byte, sr *StoreRequest) error {
+			shards = append(shards, sr)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, sr := range shards {
+		if err = sdb.loadBlob(shardKey(sr.DataHash, sr.ShardIndex), sr); err != nil {
+			return nil, err
+		}
+	}
+	return shards, nil
+}
+
+// AnyShard returns one of the shards of the data with the given key.
+func (sdb *SemiCentralizedDB) AnyShard(key string) (*StoreRequest, error) {
+	shards, err := sdb.GetShards(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, sr := range shards {
+		if sr.Key != nil {
+			return sr, nil
+		}
+	}
+	if len(shards) == 0 {
+		return nil, errors.New("Key does not exist")
+	}
+	return shards[0], nil
+}
+
+// DeleteShards removes all shards of the data with the given key, if check
+// returns no error for them. It returns the number of bytes freed.
+func (sdb *SemiCentralizedDB) DeleteShards(key string, check func(*StoreRequest) error) (int, error) {
+	var size int
+	err := sdb.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		size, err = sdb.deleteShardsTx(tx, key, check)
+		return err
+	})
+	if err != nil {
+		log.Errorf("DeleteShards error: %v", err)
+		return 0, err
+	}
+	return size, nil
+}
+
+func (sdb *SemiCentralizedDB) deleteShardsTx(tx *bolt.Tx, key string, check func(*StoreRequest) error) (int, error) {
+	b := tx.Bucket(sdb.shardBucket)
+	size := 0
+	var keys [][]byte
+	err := sdb.forShards(tx, key, func(k []byte, sr *StoreRequest) error {
+		if err := check(sr); err != nil {
+			return err
+		}
+		n := len(b.Get(k)) + int(sr.Size)
+		if err := sdb.writers.ReleaseTx(tx, sr.Owner, int64(n)); err != nil {
+			return err
+		}
+		if err := sdb.removePendingTx(tx, sr); err != nil {
+			return err
+		}
+		size += n
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, errors.New("Key does not exist")
+	}
+	root, err := hex.DecodeString(key)
+	if err != nil {
+		return 0, err
+	}
+	if err = sdb.pruneReadsTx(tx, root); err != nil {
+		return 0, err
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return 0, err
+		}
+		k := k
+		tx.OnCommit(func() { sdb.dropBlob(sdb.shardBucket, k) })
+	}
+	return size, nil
+}
+
+// ListShards returns the indices of the shards of some data held by this
+// server.
+func (s *Service) ListShards(req *ListShardsRequest) (*ListShardsReply, error) {
+	shards, err := s.db.GetShards(req.Key)
+	if err != nil {
+		log.Errorf("ListShards error: %v", err)
+		return nil, err
+	}
+	reply := &ListShardsReply{}
+	for _, sr := range shards {
+		reply.Indices = append(reply.Indices, sr.ShardIndex)
+	}
+	return reply, nil
+}
+
+// GetShard returns one shard of some data, together with its layout.
+func (s *Service) GetShard(req *GetShardRequest) (*GetShardReply, error) {
+	shards, err := s.db.GetShards(req.Key)
+	if err != nil {
+		log.Errorf("GetShard error: %v", err)
+		return nil, err
+	}
+	for _, sr := range shards {
+		if sr.ShardIndex == req.Index {
+			return &GetShardReply{Data: sr.Data, Layout: sr.Shard}, nil
+		}
+	}
+	return nil, fmt.Errorf("Shard %d does not exist", req.Index)
+}
+
+// shardNode returns the roster member that stores shard i in the first
+// place.
+func (scCl *SCClient) shardNode(i int) *network.ServerIdentity {
+	list := scCl.BcClient.Roster.List
+	return list[i%len(list)]
+}
+
+// StoreShardedData erasure codes the encrypted data of wd, which has to be
+// created with util.CreateShardedWriteData, and stores shard i on member
+// i modulo the size of the roster. Every member keeps the copy of the key
+// that is encrypted to it, if there is one.
+func (scCl *SCClient) StoreShardedData(wd *util.WriteData) error {
+	if wd.Layout == nil {
+		return errors.New("Write data is not erasure coded")
+	}
+	if len(scCl.BcClient.Roster.List) == 0 {
+		return errors.New("Empty roster")
+	}
+	shards, sl, err := util.EncodeShards(wd.Data, wd.Layout.K, wd.Layout.N)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sl.Root(), wd.DataHash) {
+		return errors.New("Data hash is not the root of the shards")
+	}
+	sr, err := scCl.newStoreRequest(wd)
+	if err != nil {
+		return err
+	}
+	sr.TTL = 0
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i := range shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := *sr
+			req.Data = shards[i]
+			req.Shard = sl
+			req.ShardIndex = i
+			if errs[i] = signStore(&req, wd.WriterSk); errs[i] != nil {
+				return
+			}
+			errs[i] = scCl.c.SendProtobuf(scCl.shardNode(i), &req, &StoreReply{})
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			log.Errorf("Storing shard %d failed: %v", i, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// shardMap is the result of asking every member of the roster for its
+// shards of some data.
+type shardMap struct {
+	layout  *util.ShardLayout
+	shards  [][]byte
+	holders map[int][]*network.ServerIdentity
+	alive   []*network.ServerIdentity
+}
+
+// collectShards asks every member of the roster which shards of the data
+// stored under key it holds, and fetches and verifies K of them.
+func (scCl *SCClient) collectShards(key string) (*shardMap, error) {
+	root, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	sm := &shardMap{holders: make(map[int][]*network.ServerIdentity)}
+	have := 0
+	for _, si := range scCl.BcClient.Roster.List {
+		list := &ListShardsReply{}
+		if err := scCl.c.SendProtobuf(si, &ListShardsRequest{Key: key}, list); err != nil {
+			log.Lvlf2("Replica %v failed: %v", si, err)
+			continue
+		}
+		sm.alive = append(sm.alive, si)
+		for _, i := range list.Indices {
+			sm.holders[i] = append(sm.holders[i], si)
+			if sm.layout != nil && (have == sm.layout.K || i < 0 || i >= sm.layout.N || sm.shards[i] != nil) {
+				continue
+			}
+			reply := &GetShardReply{}
+			if err := scCl.c.SendProtobuf(si, &GetShardRequest{Key: key, Index: i}, reply); err != nil {
+				log.Lvlf2("Replica %v failed: %v", si, err)
+				continue
+			}
+			if sm.layout == nil {
+				if reply.Layout == nil || reply.Layout.Check() != nil || !bytes.Equal(reply.Layout.Root(), root) {
+					log.Lvlf2("Replica %v returned an invalid layout", si)
+					continue
+				}
+				sm.layout = reply.Layout
+				sm.shards = make([][]byte, sm.layout.N)
+			}
+			if i < 0 || i >= sm.layout.N {
+				continue
+			}
+			if err := sm.layout.VerifyShard(i, reply.Data); err != nil {
+				log.Lvlf2("Replica %v returned an invalid shard: %v", si, err)
+				continue
+			}
+			sm.shards[i] = reply.Data
+			have++
+		}
+	}
+	if sm.layout == nil {
+		return nil, errors.New("No shards found")
+	}
+	if have < sm.layout.K {
+		return nil, fmt.Errorf("Need %d shards, only %d are available", sm.layout.K, have)
+	}
+	return sm, nil
+}
+
+// FetchShardedData reconstructs the encrypted data stored under key from
+// any K of its shards.
+func (scCl *SCClient) FetchShardedData(key string) ([]byte, error) {
+	sm, err := scCl.collectShards(key)
+	if err != nil {
+		log.Errorf("Fetching sharded data failed: %v", err)
+		return nil, err
+	}
+	return util.JoinShards(sm.layout, sm.shards)
+}
+
+// RepairShards rebuilds the shards of the data stored under key that no
+// reachable member of the roster holds anymore, and stores each of them on
+// a reachable member that does not hold it yet. writerSk signs the new
+// shards if writers have to be registered, and can be nil otherwise. It
+// returns the number of shards that were rebuilt.
+func (scCl *SCClient) RepairShards(key string, writerSk kyber.Scalar) (int, error) {
+	sm, err := scCl.collectShards(key)
+	if err != nil {
+		log.Errorf("Repairing shards failed: %v", err)
+		return 0, err
+	}
+	var missing []int
+	for i := 0; i < sm.layout.N; i++ {
+		if len(sm.holders[i]) == 0 {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	if err = util.RepairShards(sm.layout, sm.shards); err != nil {
+		log.Errorf("Repairing shards failed: %v", err)
+		return 0, err
+	}
+	wd := &util.WriteData{DataHash: sm.layout.Root(), WriterSk: writerSk}
+	sr, err := scCl.newStoreRequest(wd)
+	if err != nil {
+		return 0, err
+	}
+	load := make(map[network.ServerIdentityID]int)
+	for _, holders := range sm.holders {
+		for _, si := range holders {
+			load[si.ID]++
+		}
+	}
+	repaired := 0
+	for _, i := range missing {
+		req := *sr
+		req.Data = sm.shards[i]
+		req.Shard = sm.layout
+		req.ShardIndex = i
+		if err = signStore(&req, writerSk); err != nil {
+			return repaired, err
+		}
+		var stored bool
+		for _, si := range leastLoaded(sm.alive, load) {
+			if err = scCl.c.SendProtobuf(si, &req, &StoreReply{}); err != nil {
+				log.Lvlf2("Storing shard %d on %v failed: %v", i, si, err)
+				continue
+			}
+			load[si.ID]++
+			stored = true
+			break
+		}
+		if !stored {
+			return repaired, fmt.Errorf("Could not store shard %d: %v", i, err)
+		}
+		repaired++
+	}
+	return repaired, nil
+}
+
+// leastLoaded returns the nodes sorted by the number of shards they hold.
+func leastLoaded(nodes []*network.ServerIdentity, load map[network.ServerIdentityID]int) []*network.ServerIdentity {
+	sorted := append([]*network.ServerIdentity{}, nodes...)
+	for i := 1; i < len(sorted); i++ {
+		for j := i; j > 0 && load[sorted[j].ID] < load[sorted[j-1].ID]; j-- {
+			sorted[j], sorted[j-1] = sorted[j-1], sorted[j]
+		}
+	}
+	return sorted
+}
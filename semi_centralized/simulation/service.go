@@ -9,6 +9,7 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	sc "github.com/ceyhunalp/calypso_experiments/semi_centralized"
@@ -40,6 +41,9 @@ type SimulationService struct {
 	NumBlocks            int
 	BlockInterval        int
 	BlockWait            int
+	// Async submits the decrypt requests of the multi-client simulation as
+	// jobs and polls for their results.
+	Async bool
 }
 
 func init() {
@@ -662,7 +666,7 @@ func (s *SimulationService) runMultiClientSimulation(config *onet.SimulationConf
 		for i := 0; i < s.NumTransactions; i++ {
 			byzCl := byzcoin.NewClient(scCl.BcClient.ID, scCl.BcClient.Roster)
 			go func(idx int, cl *byzcoin.Client) {
-				err := decrypt(idx, cl, wdList[idx], wrProofList[idx], reader, wDarc, dList[idx], s.BlockWait)
+				err := decrypt(idx, cl, wdList[idx], wrProofList[idx], reader, wDarc, dList[idx], s.BlockWait, s.Async)
 				if err != nil {
 					log.Errorf("goroutine %d error: %v", idx, err)
 				}
@@ -670,11 +674,23 @@ func (s *SimulationService) runMultiClientSimulation(config *onet.SimulationConf
 		}
 		wg.Wait()
 		log.Info("goroutines are finished")
+		if s.Async {
+			stats, err := scCl.DecryptStats(config.Roster.List[0])
+			if err != nil {
+				return err
+			}
+			log.Infof("Decrypt jobs: %d submitted, %d rejected, at most %d queued", stats.Submitted, stats.Rejected, stats.MaxQueued)
+		}
+		cache, err := scCl.ProofCacheStats(config.Roster.List[0])
+		if err != nil {
+			return err
+		}
+		log.Infof("Proof cache: %d hits, %d misses, hit rate %.2f", cache.Hits, cache.Misses, cache.HitRate())
 	}
 	return nil
 }
 
-func decrypt(idx int, bc *byzcoin.Client, wd *util.WriteData, wrProof *byzcoin.Proof, reader darc.Signer, wDarc *darc.Darc, d []byte, wait int) error {
+func decrypt(idx int, bc *byzcoin.Client, wd *util.WriteData, wrProof *byzcoin.Proof, reader darc.Signer, wDarc *darc.Darc, d []byte, wait int, async bool) error {
 	defer wg.Done()
 	scCl := sc.NewClient(bc)
 	label := fmt.Sprintf("Client_%d_read", idx+1)
@@ -700,7 +716,17 @@ func decrypt(idx int, bc *byzcoin.Client, wd *util.WriteData, wrProof *byzcoin.P
 	label = fmt.Sprintf("Client_%d_decrypt", idx+1)
 
 	decMonitor := monitor.NewTimeMeasure(label)
-	dr, err := scCl.Decrypt(wrProof, &rProof, wd.StoredKey, reader.Ed25519.Secret)
+	var dr *sc.DecryptReply
+	if async {
+		var job *sc.DecryptJob
+		job, err = scCl.SubmitDecrypt(wrProof, &rProof, wd.StoredKey, reader.Ed25519.Secret)
+		if err != nil {
+			return err
+		}
+		dr, err = scCl.WaitDecrypt(job, 50*time.Millisecond)
+	} else {
+		dr, err = scCl.Decrypt(wrProof, &rProof, wd.StoredKey, reader.Ed25519.Secret)
+	}
 	if err != nil {
 		return err
 	}
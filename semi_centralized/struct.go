@@ -1,6 +1,9 @@
 package semicentralized
 
 import (
+	"sync"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
 	bolt "github.com/coreos/bbolt"
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/skipchain"
@@ -10,18 +13,388 @@ import (
 type SemiCentralizedDB struct {
 	*bolt.DB
 	bucketName []byte
+	// expiryBucket indexes the entries that have a TTL by ExpireTime.
+	expiryBucket []byte
+	// shardBucket holds the shards of erasure coded data, under the
+	// DataHash followed by the index of the shard.
+	shardBucket []byte
+	// pendingBucket indexes the data that waits for its write on byzcoin
+	// by Deadline, and writesBucket holds the DataHashes of the writes
+	// found on byzcoin. scanBucket holds the last block of every skipchain
+	// that was scanned for writes.
+	pendingBucket []byte
+	writesBucket  []byte
+	scanBucket    []byte
+	// readsBucket holds the reads that were used, if they can be used
+	// only once.
+	readsBucket []byte
+	// blobs holds the stored data and shards. claimed holds the keys of
+	// the blobs that are being stored or deleted.
+	blobs    util.BlobStore
+	blobLock sync.Mutex
+	claimed  map[string]bool
+	// chunks holds the data that was uploaded in chunks.
+	chunks *util.ChunkStore
+	// writers holds the registered writers and their quotas.
+	writers *util.WriterStore
 }
 
 type StoreRequest struct {
 	Data     []byte
 	DataHash []byte
+	// Owner is the public key that can delete the data. If it is nil, the
+	// data can only expire.
+	Owner kyber.Point
+	// TTL is the number of seconds the data is kept. If it is 0, the data
+	// is kept until the owner deletes it. ExpireTime is set by the server.
+	TTL        int64
+	ExpireTime int64
+	// Chunked is set by the server if Data was uploaded in chunks and is
+	// stored separately.
+	Chunked bool
+	// Timestamp and Sig authenticate the request by Owner, see StoreDigest
+	// and util.WriteMessage. They are required once writers are registered.
+	Timestamp int64
+	Sig       []byte
+	// Replicas is set when the data is stored on several servers. Every
+	// server keeps the entry encrypted to its own key as Key, and uses it
+	// instead of K and C of the write on byzcoin.
+	Replicas []*util.ReplicaKey
+	Key      *util.ReplicaKey
+	// Shard is set if Data is the shard with index ShardIndex of erasure
+	// coded data. DataHash is then the root of the layout.
+	Shard      *util.ShardLayout
+	ShardIndex int
+	// SCID is the skipchain the write of the data is expected on. If it is
+	// set, the data is removed if no write refers to it by Deadline, which
+	// is set by the server.
+	SCID     skipchain.SkipBlockID
+	Deadline int64
+	// Size is the length of Data. It is set by the server, which keeps
+	// Data in its blob store.
+	Size int64
+}
+
+// StoreDigest returns the digest of the store request that its owner
+// signs, which covers all of it but Sig.
+func StoreDigest(sr *StoreRequest) ([]byte, error) {
+	req := *sr
+	req.Sig = nil
+	return util.RequestDigest(&req)
 }
 
+// StoreReply holds the key the data is stored under. Root is the Merkle
+// root of the chunks of the data, which the server answers challenges
+// against, see util.VerifyChunks.
 type StoreReply struct {
 	StoredKey string
+	Root      []byte
+}
+
+// DeleteRequest removes stored data. Sig is the signature of the owner over
+// DeleteMessage, and Timestamp is a unix time in seconds.
+type DeleteRequest struct {
+	Key       string
+	Timestamp int64
+	Sig       []byte
+}
+
+type DeleteReply struct{}
+
+// ListShardsRequest asks which shards of the erasure coded data with the
+// given DataHash a server holds.
+type ListShardsRequest struct {
+	Key string
+}
+
+type ListShardsReply struct {
+	Indices []int
+}
+
+// GetShardRequest asks for one shard of erasure coded data.
+type GetShardRequest struct {
+	Key   string
+	Index int
+}
+
+type GetShardReply struct {
+	Data   []byte
+	Layout *util.ShardLayout
+}
+
+// SetWriterRequest registers Writer with the given quota, or removes it.
+// Version is the version of the writers of the server the request applies
+// to, see GetWriterReply. Sig is the signature of the identity key of the
+// conode over util.AdminMessage with util.WriterData.
+type SetWriterRequest struct {
+	Writer    kyber.Point
+	Quota     util.Quota
+	Remove    bool
+	Version   int64
+	Timestamp int64
+	Sig       []byte
+}
+
+// SetWriterReply holds the number of bytes the writer has stored.
+type SetWriterReply struct {
+	Used int64
+}
+
+// GetWriterRequest asks for the registration of Writer.
+type GetWriterRequest struct {
+	Writer kyber.Point
+}
+
+// GetWriterReply holds the quota of the writer and the bytes it has stored,
+// if it is Registered, and the version of the writers of the server, which
+// increases with every SetWriterRequest.
+type GetWriterReply struct {
+	Registered bool
+	Quota      util.Quota
+	Used       int64
+	Version    int64
+}
+
+// BeginUploadRequest starts the upload of Size bytes of data in chunks of
+// util.ChunkSize. ChunkHashes are the sha256 hashes of the chunks. Store
+// is the signed store request that the data is stored with, whose DataHash
+// has to be the Merkle root of the chunks. It authenticates the upload.
+type BeginUploadRequest struct {
+	Size        int64
+	ChunkHashes [][]byte
+	Store       *StoreRequest
+}
+
+type BeginUploadReply struct {
+	SessionID string
+}
+
+// UploadChunkRequest sends the chunk with the given index.
+type UploadChunkRequest struct {
+	SessionID string
+	Index     int
+	Data      []byte
+	// Sig is the signature of the writer over util.ChunkMessage. It is
+	// required once writers are registered.
+	Sig []byte
+}
+
+type UploadChunkReply struct{}
+
+// UploadStatusRequest asks which chunks of an upload are still missing, so
+// that an interrupted upload can be resumed.
+type UploadStatusRequest struct {
+	SessionID string
+}
+
+type UploadStatusReply struct {
+	Missing []int
+}
+
+// FinishUploadRequest stores the data of a complete upload. The Data of
+// Store is empty and its DataHash is the Merkle root of the chunks.
+type FinishUploadRequest struct {
+	SessionID string
+	Store     *StoreRequest
+}
+
+// GetChunkInfoRequest asks for the size and the chunk hashes of the data
+// stored under Key.
+type GetChunkInfoRequest struct {
+	Key string
+}
+
+type GetChunkInfoReply struct {
+	Size        int64
+	ChunkHashes [][]byte
+}
+
+// GetChunkRequest asks for one chunk of the data stored under Key.
+type GetChunkRequest struct {
+	Key   string
+	Index int
+}
+
+// GetChunkReply holds the chunk together with its Merkle path and the size
+// of the data, see util.VerifyChunk.
+type GetChunkReply struct {
+	Data []byte
+	Path [][]byte
+	Size int64
 }
 
+// GetKeyRequest asks the server for its current encryption key.
+type GetKeyRequest struct{}
+
+// GetKeyReply holds the encryption key of the server and the signature of
+// its identity key over util.KeyMessage. Retired are the keys that were
+// rotated out, which still decrypt older writes, and RetiredSig is the
+// signature of the identity key over RetiredKeysMessage.
+type GetKeyReply struct {
+	Public     kyber.Point
+	Sig        []byte
+	Retired    []kyber.Point
+	RetiredSig []byte
+}
+
+// RotateKeyRequest makes the server replace its encryption key. Sig is the
+// signature of the identity key of the server over util.AdminMessage, with
+// the current encryption key as data, so that the request cannot be
+// replayed after the rotation.
+type RotateKeyRequest struct {
+	Timestamp int64
+	Sig       []byte
+}
+
+type RotateKeyReply struct {
+	Public kyber.Point
+}
+
+// DecryptRequest asks for the key of a write to be re-encrypted to the
+// reader. If Strict is set, Sig is the signature of the reader over
+// DecryptMessage, else over the key.
 type DecryptRequest struct {
+	Write  *byzcoin.Proof
+	Read   *byzcoin.Proof
+	SCID   skipchain.SkipBlockID
+	Key    string
+	Sig    []byte
+	Strict bool
+}
+
+// DecryptReply holds the stored data and the key re-encrypted to the
+// reader. Proof shows that K and C hold the same key as the write on
+// byzcoin, encrypted to ServerKey, see util.VerifyReencryption. Clients
+// only accept a ServerKey that the server signed in GetKeyReply.
+type DecryptReply struct {
+	Data      []byte
+	DataHash  []byte
+	K         kyber.Point
+	C         kyber.Point
+	ServerKey kyber.Point
+	Proof     *util.ReencryptProof
+	// Replica is the copy of the key that was re-encrypted, if it is not
+	// the one of the write on byzcoin.
+	Replica *util.ReplicaKey
+}
+
+// DecryptPolicy configures how decrypt requests are checked. If Strict is
+// set, every request has to be signed over DecryptMessage. If SingleUse is
+// set, every read can be used only once on a server. As the servers do not
+// share the used reads, a read can still be used once on every server that
+// stores the data.
+type DecryptPolicy struct {
+	Strict    bool
+	SingleUse bool
+}
+
+// SetDecryptPolicyRequest changes the decrypt policy of a server. Version
+// is the version of the policy it replaces. Sig is the signature of the
+// identity key of the conode, see util.AdminMessage, which covers the
+// version so that the request cannot be replayed once the policy changed.
+type SetDecryptPolicyRequest struct {
+	Policy    DecryptPolicy
+	Version   int
+	Timestamp int64
+	Sig       []byte
+}
+
+// SetDecryptPolicyReply holds the version of the new policy.
+type SetDecryptPolicyReply struct {
+	Version int
+}
+
+// GetDecryptPolicyRequest asks for the decrypt policy of a server.
+type GetDecryptPolicyRequest struct{}
+
+// GetDecryptPolicyReply holds the decrypt policy of the server and its
+// version, which increases with every change.
+type GetDecryptPolicyReply struct {
+	Policy  DecryptPolicy
+	Version int
+}
+
+// SubmitDecryptRequest queues a decrypt request on the server, which
+// returns the ID of the job.
+type SubmitDecryptRequest struct {
+	Decrypt *DecryptRequest
+}
+
+type SubmitDecryptReply struct {
+	JobID string
+}
+
+// PollDecryptRequest asks for the state of a decrypt job. Once the job is
+// finished, the result is returned and the job is removed.
+type PollDecryptRequest struct {
+	JobID string
+}
+
+// PollDecryptReply holds the status of the job, see JobQueued and the
+// following, and its reply or error once it is finished.
+type PollDecryptReply struct {
+	Status int
+	Reply  *DecryptReply
+	Error  string
+}
+
+// CancelDecryptRequest removes a decrypt job. A job that is running is
+// finished, but its result is dropped.
+type CancelDecryptRequest struct {
+	JobID string
+}
+
+type CancelDecryptReply struct{}
+
+// DecryptStatsRequest asks for the statistics of the decrypt jobs.
+type DecryptStatsRequest struct{}
+
+// DecryptStatsReply holds the current number of queued, running and
+// finished jobs, and the counters since the service started.
+type DecryptStatsReply struct {
+	Workers   int
+	Capacity  int
+	Queued    int
+	Running   int
+	Finished  int
+	MaxQueued int
+	Submitted int64
+	Rejected  int64
+	Succeeded int64
+	Failed    int64
+	Cancelled int64
+}
+
+// ProofCacheStatsRequest asks for the statistics of the cache of verified
+// skipblocks.
+type ProofCacheStatsRequest struct{}
+
+// ProofCacheStatsReply holds the number of cached chains and blocks. Hits
+// is the number of links that were found in the cache, Misses the number
+// of links that had to be verified.
+type ProofCacheStatsReply struct {
+	Chains int
+	Blocks int
+	Hits   int64
+	Misses int64
+}
+
+// ChallengeRequest asks a server to prove that it still stores the data
+// under Key, by returning Samples chunks picked with Nonce.
+type ChallengeRequest struct {
+	Key     string
+	Nonce   []byte
+	Samples int
+}
+
+// ChallengeReply holds the sampled chunks with their Merkle paths.
+type ChallengeReply struct {
+	Proofs []*util.ChunkProof
+}
+
+// ReleaseRequest asks for the encrypted data of a threshold write, which
+// is a calypso write whose key is held by the LTS of the roster.
+type ReleaseRequest struct {
 	Write *byzcoin.Proof
 	Read  *byzcoin.Proof
 	SCID  skipchain.SkipBlockID
@@ -29,11 +402,10 @@ type DecryptRequest struct {
 	Sig   []byte
 }
 
-type DecryptReply struct {
-	Data     []byte
-	DataHash []byte
-	K        kyber.Point
-	C        kyber.Point
+// ReleaseReply holds the encrypted data. The key has to be fetched from
+// calypso with DecryptKey.
+type ReleaseReply struct {
+	Data []byte
 }
 
 type TransactionReply struct {
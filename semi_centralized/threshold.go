@@ -0,0 +1,194 @@
+package semicentralized
+
+/*
+The threshold.go keeps the data off-chain while the symmetric key is held
+by the long-term secret (LTS) of the roster, as in calypso. The key is
+encrypted to the collective key X in a calypso write whose ExtraData is the
+DataHash, so no single conode can read it. After the read is on byzcoin, a
+storage server releases the encrypted data and a threshold of the roster
+re-encrypts the key with calypso's DecryptKey.
+*/
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// CreateThresholdWrite encrypts data with a fresh symmetric key and returns
+// the data to store together with the calypso write that encrypts the key
+// to the LTS. The write only holds the DataHash, not the data.
+func CreateThresholdWrite(data []byte, lts *calypso.CreateLTSReply, writeDarc darc.ID) (*util.WriteData, *calypso.Write, error) {
+	encData, symKey, err := util.EncryptData(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataHash := util.DataHash(encData)
+	write := calypso.NewWrite(cothority.Suite, lts.LTSID, writeDarc, lts.X, symKey)
+	write.ExtraData = dataHash
+	wd := &util.WriteData{
+		Data:     encData,
+		DataHash: dataHash,
+	}
+	return wd, write, nil
+}
+
+// AddThresholdWriteTransaction spawns the calypso write on byzcoin.
+func (scCl *SCClient) AddThresholdWriteTransaction(write *calypso.Write, signer darc.Signer, darc darc.Darc, wait int) (*TransactionReply, error) {
+	writeBuf, err := protobuf.Encode(write)
+	if err != nil {
+		log.Errorf("Adding threshold write transaction failed: %v", err)
+		return nil, err
+	}
+	ctx := byzcoin.ClientTransaction{
+		Instructions: byzcoin.Instructions{{
+			InstanceID: byzcoin.NewInstanceID(darc.GetBaseID()),
+			Nonce:      byzcoin.Nonce{},
+			Index:      0,
+			Length:     1,
+			Spawn: &byzcoin.Spawn{
+				ContractID: calypso.ContractWriteID,
+				Args: byzcoin.Arguments{{
+					Name: "write", Value: writeBuf}},
+			},
+		}},
+	}
+	err = ctx.Instructions[0].SignBy(darc.GetID(), signer)
+	if err != nil {
+		log.Errorf("Adding threshold write transaction failed: %v", err)
+		return nil, err
+	}
+	reply := &TransactionReply{}
+	reply.InstanceID = ctx.Instructions[0].DeriveID("")
+	reply.AddTxResponse, err = scCl.BcClient.AddTransactionAndWait(ctx, wait)
+	if err != nil {
+		log.Errorf("Adding threshold write transaction failed: %v", err)
+		return nil, err
+	}
+	return reply, nil
+}
+
+// ReleaseData returns the encrypted data of a threshold write to the reader
+// of a read that points to it. The server never sees the key.
+func (s *Service) ReleaseData(req *ReleaseRequest) (*ReleaseReply, error) {
+	storedData, err := s.db.GetStoredData(req.Key)
+	if err != nil {
+		log.Errorf("ReleaseData error: %v", err)
+		return nil, err
+	}
+	if storedData.Chunked || storedData.Shard != nil {
+		return nil, errors.New("Only whole data can be released")
+	}
+	if err = verifyReleaseRequest(req, storedData, s.proofs); err != nil {
+		log.Errorf("ReleaseData error: %v", err)
+		return nil, err
+	}
+	return &ReleaseReply{Data: storedData.Data}, nil
+}
+
+func verifyReleaseRequest(req *ReleaseRequest, storedData *StoreRequest, pc *proofCache) error {
+	var read calypso.Read
+	if err := req.Read.ContractValue(cothority.Suite, calypso.ContractReadID, &read); err != nil {
+		return errors.New("didn't get a read instance: " + err.Error())
+	}
+	var write calypso.Write
+	if err := req.Write.ContractValue(cothority.Suite, calypso.ContractWriteID, &write); err != nil {
+		return errors.New("didn't get a write instance: " + err.Error())
+	}
+	if !read.Write.Equal(byzcoin.NewInstanceID(req.Write.InclusionProof.Key)) {
+		return errors.New("read doesn't point to passed write")
+	}
+	if err := pc.Verify(req.Read, req.SCID); err != nil {
+		return errors.New("read proof cannot be verified to come from scID: " + err.Error())
+	}
+	if err := pc.Verify(req.Write, req.SCID); err != nil {
+		return errors.New("write proof cannot be verified to come from scID: " + err.Error())
+	}
+	keyBytes, err := hex.DecodeString(req.Key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(keyBytes, storedData.DataHash) || !bytes.Equal(write.ExtraData, storedData.DataHash) {
+		return errors.New("Stored data does not belong to the write")
+	}
+	if !util.VerifyDataHash(storedData.Data, write.ExtraData) {
+		return errors.New("Stored data does not match its hash")
+	}
+	return schnorr.Verify(cothority.Suite, read.Xc, keyBytes, req.Sig)
+}
+
+// FetchThresholdData fetches the encrypted data of a threshold write from
+// any member of the roster that stores it. sk is the private key of the
+// reader.
+func (scCl *SCClient) FetchThresholdData(wrProof *byzcoin.Proof, rProof *byzcoin.Proof, key string, sk kyber.Scalar) ([]byte, error) {
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil {
+		log.Errorf("Fetching threshold data failed: %v", err)
+		return nil, err
+	}
+	sig, err := schnorr.Sign(cothority.Suite, sk, keyBytes)
+	if err != nil {
+		log.Errorf("Fetching threshold data failed: %v", err)
+		return nil, err
+	}
+	var write calypso.Write
+	if err = wrProof.ContractValue(cothority.Suite, calypso.ContractWriteID, &write); err != nil {
+		log.Errorf("Fetching threshold data failed: %v", err)
+		return nil, err
+	}
+	req := &ReleaseRequest{
+		Write: wrProof,
+		Read:  rProof,
+		SCID:  scCl.BcClient.ID,
+		Key:   key,
+		Sig:   sig,
+	}
+	var data []byte
+	err = scCl.tryAll(func(si *network.ServerIdentity) error {
+		reply := &ReleaseReply{}
+		if err := scCl.c.SendProtobuf(si, req, reply); err != nil {
+			return err
+		}
+		if !util.VerifyDataHash(reply.Data, write.ExtraData) {
+			return errors.New("Data does not match the write")
+		}
+		data = reply.Data
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Fetching threshold data failed: %v", err)
+		return nil, err
+	}
+	return data, nil
+}
+
+// DecryptThreshold fetches the encrypted data of a threshold write, has the
+// LTS re-encrypt its key to the reader and returns the decrypted data.
+func (scCl *SCClient) DecryptThreshold(wrProof *byzcoin.Proof, rProof *byzcoin.Proof, key string, sk kyber.Scalar) ([]byte, error) {
+	encData, err := scCl.FetchThresholdData(wrProof, rProof, key, sk)
+	if err != nil {
+		return nil, err
+	}
+	dk, err := calypso.NewClient(scCl.BcClient).DecryptKey(&calypso.DecryptKey{Read: *rProof, Write: *wrProof})
+	if err != nil {
+		log.Errorf("DecryptKey failed: %v", err)
+		return nil, err
+	}
+	symKey, err := calypso.DecodeKey(cothority.Suite, dk.X, dk.Cs, dk.XhatEnc, sk)
+	if err != nil {
+		log.Errorf("DecodeKey failed: %v", err)
+		return nil, err
+	}
+	return util.AeadOpen(symKey, encData)
+}
@@ -0,0 +1,298 @@
+package semicentralized
+
+/*
+The upload.go lets clients upload and download large data in chunks of
+util.ChunkSize, so that it does not have to fit in one message.
+*/
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ceyhunalp/calypso_experiments/util"
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// uploadRetries is how often an upload is resumed before it is given up.
+const uploadRetries = 3
+
+// BeginUpload starts a new upload session.
+func (s *Service) BeginUpload(req *BeginUploadRequest) (*BeginUploadReply, error) {
+	if req.Store == nil {
+		return nil, errors.New("Missing store request")
+	}
+	if !bytes.Equal(req.Store.DataHash, util.MerkleRoot(req.ChunkHashes)) {
+		return nil, errors.New("Data hash is not the root of the chunks")
+	}
+	err := s.authStore(req.Store, req.Size, time.Now())
+	if err != nil {
+		log.Errorf("BeginUpload error: %v", err)
+		return nil, err
+	}
+	id, err := s.db.chunks.BeginUpload(req.Size, req.ChunkHashes, req.Store.Owner, time.Now())
+	if err != nil {
+		log.Errorf("BeginUpload error: %v", err)
+		return nil, err
+	}
+	return &BeginUploadReply{SessionID: id}, nil
+}
+
+// UploadChunk stores one chunk of an upload session.
+func (s *Service) UploadChunk(req *UploadChunkRequest) (*UploadChunkReply, error) {
+	if err := s.db.chunks.PutChunk(req.SessionID, req.Index, req.Data, req.Sig); err != nil {
+		return nil, err
+	}
+	return &UploadChunkReply{}, nil
+}
+
+// UploadStatus returns the chunks that are missing in an upload session.
+func (s *Service) UploadStatus(req *UploadStatusRequest) (*UploadStatusReply, error) {
+	missing, err := s.db.chunks.MissingChunks(req.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadStatusReply{Missing: missing}, nil
+}
+
+// FinishUpload stores the data of a complete upload session.
+func (s *Service) FinishUpload(req *FinishUploadRequest) (*StoreReply, error) {
+	if req.Store == nil {
+		return nil, errors.New("Missing store request")
+	}
+	sr := req.Store
+	// The bytes reserved by BeginUpload are already charged, only the
+	// rest has to fit in the quota.
+	size, reserved, err := s.db.chunks.SessionSize(req.SessionID)
+	if err != nil {
+		log.Errorf("FinishUpload error: %v", err)
+		return nil, err
+	}
+	if err = s.authStore(sr, size-reserved, time.Now()); err != nil {
+		log.Errorf("FinishUpload error: %v", err)
+		return nil, err
+	}
+	if err = s.pickReplicaKey(sr); err != nil {
+		log.Errorf("FinishUpload error: %v", err)
+		return nil, err
+	}
+	storedKey, err := s.db.StoreChunkedData(req.Store, req.SessionID)
+	if err != nil {
+		log.Errorf("FinishUpload error: %v", err)
+		return nil, err
+	}
+	return &StoreReply{StoredKey: storedKey, Root: sr.DataHash}, nil
+}
+
+// GetChunkInfo returns the size and the chunk hashes of stored data.
+func (s *Service) GetChunkInfo(req *GetChunkInfoRequest) (*GetChunkInfoReply, error) {
+	sr, key, err := s.storedChunks(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	if !sr.Chunked {
+		return &GetChunkInfoReply{Size: int64(len(sr.Data)), ChunkHashes: util.ChunkHashes(sr.Data)}, nil
+	}
+	cd, err := s.db.chunks.GetChunkedData(key)
+	if err != nil {
+		log.Errorf("GetChunkInfo error: %v", err)
+		return nil, err
+	}
+	return &GetChunkInfoReply{Size: cd.Size, ChunkHashes: cd.ChunkHashes}, nil
+}
+
+// GetChunk returns one chunk of stored data with its Merkle path.
+func (s *Service) GetChunk(req *GetChunkRequest) (*GetChunkReply, error) {
+	sr, key, err := s.storedChunks(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	if !sr.Chunked {
+		if req.Index < 0 || req.Index >= util.NumChunks(int64(len(sr.Data))) {
+			return nil, fmt.Errorf("Invalid chunk index %d", req.Index)
+		}
+		return &GetChunkReply{Data: util.DataChunk(sr.Data, req.Index),
+			Path: util.MerklePath(util.ChunkHashes(sr.Data), req.Index), Size: int64(len(sr.Data))}, nil
+	}
+	cd, err := s.db.chunks.GetChunkedData(key)
+	if err != nil {
+		log.Errorf("GetChunk error: %v", err)
+		return nil, err
+	}
+	chunk, err := s.db.chunks.GetChunk(key, req.Index)
+	if err != nil {
+		log.Errorf("GetChunk error: %v", err)
+		return nil, err
+	}
+	return &GetChunkReply{Data: chunk, Path: util.MerklePath(cd.ChunkHashes, req.Index), Size: cd.Size}, nil
+}
+
+// storedChunks returns the data stored under key, if it has not expired.
+func (s *Service) storedChunks(key string) (*StoreRequest, []byte, error) {
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	sr, err := s.db.GetStoredData(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sr.expired(time.Now()) {
+		return nil, nil, errors.New("Data has expired")
+	}
+	return sr, keyBytes, nil
+}
+
+// StoreChunkedData uploads the encrypted data of wd in chunks to all store
+// nodes and stores it, together with its owner and TTL. The DataHash of wd
+// is replaced by the Merkle root of the chunks, so it has to be called
+// before the write transaction is created.
+func (scCl *SCClient) StoreChunkedData(wd *util.WriteData) (*StoreReply, error) {
+	hashes := util.ChunkHashes(wd.Data)
+	wd.DataHash = util.MerkleRoot(hashes)
+	sr, err := scCl.newStoreRequest(wd)
+	if err != nil {
+		log.Errorf("Storing chunked data failed: %v", err)
+		return nil, err
+	}
+	sr.Data = nil
+	if err = signStore(sr, wd.WriterSk); err != nil {
+		log.Errorf("Storing chunked data failed: %v", err)
+		return nil, err
+	}
+	reply, err := scCl.storeAll(func(si *network.ServerIdentity) (interface{}, error) {
+		return scCl.storeChunked(si, sr, hashes, wd.Data, wd.WriterSk)
+	})
+	if err != nil {
+		log.Errorf("Storing chunked data failed: %v", err)
+		return nil, err
+	}
+	return reply.(*StoreReply), nil
+}
+
+// storeChunked uploads data to si and stores it with sr. The chunks are
+// signed with sk, if it is not nil.
+func (scCl *SCClient) storeChunked(si *network.ServerIdentity, sr *StoreRequest, hashes [][]byte, data []byte, sk kyber.Scalar) (*StoreReply, error) {
+	begin := &BeginUploadReply{}
+	err := scCl.c.SendProtobuf(si, &BeginUploadRequest{Size: int64(len(data)), ChunkHashes: hashes, Store: sr}, begin)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; ; i++ {
+		err = scCl.ResumeUpload(si, begin.SessionID, data, sk)
+		if err == nil {
+			break
+		}
+		if i == uploadRetries {
+			return nil, err
+		}
+		log.Lvlf2("Upload to %v interrupted, resuming: %v", si, err)
+	}
+	reply := &StoreReply{}
+	err = scCl.c.SendProtobuf(si, &FinishUploadRequest{SessionID: begin.SessionID, Store: sr}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// ResumeUpload sends the chunks of data that si has not received yet in the
+// upload session. If sk is not nil, the chunks are signed with it.
+func (scCl *SCClient) ResumeUpload(si *network.ServerIdentity, sessionID string, data []byte, sk kyber.Scalar) error {
+	status := &UploadStatusReply{}
+	err := scCl.c.SendProtobuf(si, &UploadStatusRequest{SessionID: sessionID}, status)
+	if err != nil {
+		return err
+	}
+	for _, i := range status.Missing {
+		req := &UploadChunkRequest{SessionID: sessionID, Index: i, Data: util.DataChunk(data, i)}
+		if req.Sig, err = util.SignChunk(sk, sessionID, i, req.Data); err != nil {
+			return err
+		}
+		if err = scCl.c.SendProtobuf(si, req, &UploadChunkReply{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DownloadData fetches the data stored under key chunk by chunk, verifies
+// it against the key and writes it to w. If a replica fails before anything
+// was written, the next one is tried.
+func (scCl *SCClient) DownloadData(key string, w io.Writer) error {
+	root, err := hex.DecodeString(key)
+	if err != nil {
+		return err
+	}
+	cw := &countWriter{w: w}
+	var partial error
+	err = scCl.tryAll(func(si *network.ServerIdentity) error {
+		if partial != nil {
+			return partial
+		}
+		info := &GetChunkInfoReply{}
+		err := scCl.c.SendProtobuf(si, &GetChunkInfoRequest{Key: key}, info)
+		if err != nil {
+			return err
+		}
+		err = util.DownloadChunks(root, info.ChunkHashes, func(i int) ([]byte, error) {
+			reply := &GetChunkReply{}
+			err := scCl.c.SendProtobuf(si, &GetChunkRequest{Key: key, Index: i}, reply)
+			return reply.Data, err
+		}, cw)
+		if err != nil && cw.n > 0 {
+			partial = err
+		}
+		return err
+	})
+	if err != nil {
+		log.Errorf("Downloading data failed: %v", err)
+	}
+	return err
+}
+
+// ReadChunk fetches the chunk with the given index of the data stored
+// under key, and verifies it against the key with its Merkle path, so that
+// a part of the data can be read without downloading all of it.
+func (scCl *SCClient) ReadChunk(key string, index int) ([]byte, error) {
+	root, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	var chunk []byte
+	err = scCl.tryAll(func(si *network.ServerIdentity) error {
+		reply := &GetChunkReply{}
+		err := scCl.c.SendProtobuf(si, &GetChunkRequest{Key: key, Index: index}, reply)
+		if err != nil {
+			return err
+		}
+		err = util.VerifyChunk(root, reply.Size, index, &util.ChunkProof{Chunk: reply.Data, Path: reply.Path})
+		if err != nil {
+			return err
+		}
+		chunk = reply.Data
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Reading chunk failed: %v", err)
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"time"
 
+	"github.com/ceyhunalp/calypso_experiments/util"
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/darc"
 	"github.com/dedis/kyber/util/random"
@@ -78,6 +79,21 @@ func (byzd *ByzcoinData) GetProof(id byzcoin.InstanceID) (*byzcoin.GetProofRespo
 	return pr, err
 }
 
+// ProofBlocks is the number of block intervals WaitForInstance waits for
+// an instance.
+const ProofBlocks = 10
+
+// WaitForInstance waits for the instance to be on byzcoin and returns its
+// verified proof, see util.WaitForInstance.
+func (byzd *ByzcoinData) WaitForInstance(id byzcoin.InstanceID) (*byzcoin.Proof, error) {
+	proof, err := util.WaitForInstance(byzd.Cl, id, ProofBlocks*byzd.GMsg.BlockInterval)
+	if err != nil {
+		log.Errorf("WaitForInstance error: %v", err)
+		return nil, err
+	}
+	return proof, nil
+}
+
 func (byzd *ByzcoinData) AddSecretTransaction(ld *LotteryData, wait int) (*TransactionReply, error) {
 	//commit := &Commit{
 	//SecretHash: ld.Digest,
@@ -46,15 +46,11 @@ func runTournamentLottery(r *onet.Roster, byzd *tournament.ByzcoinData, numParti
 
 		commitProofList := make([]byzcoin.Proof, numParticipantLeft)
 		for i := 0; i < numParticipantLeft; i++ {
-			commitProofResp, err := byzd.Cl.GetProof(commitTxnList[i].InstanceID.Slice())
+			proof, err := byzd.WaitForInstance(commitTxnList[i].InstanceID)
 			if err != nil {
-				log.Errorf("GetProof(Commit) failed: %v", err)
 				return err
 			}
-			if !commitProofResp.Proof.InclusionProof.Match() {
-				return errors.New("Commit inclusion proof does not match")
-			}
-			commitProofList[i] = commitProofResp.Proof
+			commitProofList[i] = *proof
 		}
 
 		secretTxnList := make([]*tournament.TransactionReply, numParticipantLeft)
@@ -73,15 +69,11 @@ func runTournamentLottery(r *onet.Roster, byzd *tournament.ByzcoinData, numParti
 
 		secretProofList := make([]byzcoin.Proof, numParticipantLeft)
 		for i := 0; i < numParticipantLeft; i++ {
-			secretProofResp, err := byzd.Cl.GetProof(secretTxnList[i].InstanceID.Slice())
+			proof, err := byzd.WaitForInstance(secretTxnList[i].InstanceID)
 			if err != nil {
-				log.Errorf("GetProof(Secret) failed: %v", err)
 				return err
 			}
-			if !secretProofResp.Proof.InclusionProof.Match() {
-				return errors.New("Secret inclusion proof does not match")
-			}
-			secretProofList[i] = secretProofResp.Proof
+			secretProofList[i] = *proof
 		}
 
 		revealedCommitList := make([]tournament.DataStore, numParticipantLeft)
@@ -0,0 +1,100 @@
+package util
+
+import (
+	"errors"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/onet/log"
+)
+
+// ErrBlobNotFound is returned if there is no blob under a key.
+var ErrBlobNotFound = errors.New("Blob does not exist")
+
+// BlobStore holds the payloads of the stored data under binary keys.
+// Putting a blob under an existing key replaces it.
+type BlobStore interface {
+	Put(key []byte, data []byte) error
+	Get(key []byte) ([]byte, error)
+	Delete(key []byte) error
+	// Stat returns the size of the blob under key.
+	Stat(key []byte) (int64, error)
+	// Iterate calls f for every blob, until f returns an error.
+	Iterate(f func(key []byte, size int64) error) error
+}
+
+// BoltBlobStore keeps the blobs in a bucket of a bolt database. It must not
+// be used within a transaction of the same database.
+type BoltBlobStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+// NewBoltBlobStore creates the bucket of the blob store, using bn as prefix
+// for its name.
+func NewBoltBlobStore(db *bolt.DB, bn []byte) (*BoltBlobStore, error) {
+	bs := &BoltBlobStore{db: db, bucket: append(append([]byte{}, bn...), []byte("_blobs")...)}
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bs.bucket)
+		return err
+	})
+	if err != nil {
+		log.Errorf("NewBoltBlobStore error: %v", err)
+		return nil, err
+	}
+	return bs, nil
+}
+
+// Put stores data under key.
+func (bs *BoltBlobStore) Put(key []byte, data []byte) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bs.bucket).Put(key, data)
+	})
+}
+
+// Get returns the blob under key.
+func (bs *BoltBlobStore) Get(key []byte) ([]byte, error) {
+	var data []byte
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bs.bucket).Get(key)
+		if v == nil {
+			return ErrBlobNotFound
+		}
+		data = append([]byte{}, v...)
+		return nil
+	})
+	return data, err
+}
+
+// Delete removes the blob under key.
+func (bs *BoltBlobStore) Delete(key []byte) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bs.bucket)
+		if b.Get(key) == nil {
+			return ErrBlobNotFound
+		}
+		return b.Delete(key)
+	})
+}
+
+// Stat returns the size of the blob under key.
+func (bs *BoltBlobStore) Stat(key []byte) (int64, error) {
+	var size int64
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bs.bucket).Get(key)
+		if v == nil {
+			return ErrBlobNotFound
+		}
+		size = int64(len(v))
+		return nil
+	})
+	return size, err
+}
+
+// Iterate calls f for every blob in the order of the keys.
+func (bs *BoltBlobStore) Iterate(f func(key []byte, size int64) error) error {
+	return bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bs.bucket).ForEach(func(k, v []byte) error {
+			return f(append([]byte{}, k...), int64(len(v)))
+		})
+	})
+}
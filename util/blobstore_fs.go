@@ -0,0 +1,125 @@
+package util
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FSBlobStore keeps every blob in a file of a directory. The file of a
+// blob is named by the hex encoding of its key, in subdirectories named by
+// the first two and the next two characters of that name, so that a
+// directory does not grow too large.
+type FSBlobStore struct {
+	dir string
+}
+
+// NewFSBlobStore returns a blob store in dir, which is created if it does
+// not exist.
+func NewFSBlobStore(dir string) (*FSBlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FSBlobStore{dir: dir}, nil
+}
+
+func (fs *FSBlobStore) path(key []byte) (string, error) {
+	if len(key) < 2 {
+		return "", errors.New("Blob key is too short")
+	}
+	name := hex.EncodeToString(key)
+	return filepath.Join(fs.dir, name[:2], name[2:4], name), nil
+}
+
+// Put stores data under key. The data is written to a temporary file that
+// is renamed, so that readers never see a partial blob.
+func (fs *FSBlobStore) Put(key []byte, data []byte) error {
+	p, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Get returns the blob under key.
+func (fs *FSBlobStore) Get(key []byte) ([]byte, error) {
+	p, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+// Delete removes the blob under key.
+func (fs *FSBlobStore) Delete(key []byte) error {
+	p, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+// Stat returns the size of the blob under key.
+func (fs *FSBlobStore) Stat(key []byte) (int64, error) {
+	p, err := fs.path(key)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return 0, ErrBlobNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Iterate calls f for every blob in the order of the keys. Files that are
+// not named like blobs, such as unfinished temporary files, are skipped.
+func (fs *FSBlobStore) Iterate(f func(key []byte, size int64) error) error {
+	return filepath.Walk(fs.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		key, err := hex.DecodeString(fi.Name())
+		if err != nil {
+			return nil
+		}
+		if want, _ := fs.path(key); want != p {
+			return nil
+		}
+		return f(key, fi.Size())
+	})
+}
@@ -0,0 +1,240 @@
+package util
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Timeout is the timeout of a request to an S3 endpoint.
+var S3Timeout = 30 * time.Second
+
+// S3Config describes a bucket of an S3 compatible API. Endpoint is the URL
+// of the API, e.g. http://127.0.0.1:9000, and buckets are addressed in the
+// path. The object of a blob is named by Prefix followed by the hex
+// encoding of its key.
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3BlobStore keeps the blobs as objects of an S3 bucket. The requests are
+// signed with AWS signature version 4.
+type S3BlobStore struct {
+	cfg    S3Config
+	client *http.Client
+	// now returns the time requests are signed with.
+	now func() time.Time
+}
+
+// NewS3BlobStore returns a blob store in the bucket of cfg. The bucket has
+// to exist.
+func NewS3BlobStore(cfg S3Config) (*S3BlobStore, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("Missing S3 endpoint or bucket")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+	return &S3BlobStore{cfg: cfg, client: &http.Client{Timeout: S3Timeout}, now: time.Now}, nil
+}
+
+func (s3 *S3BlobStore) object(key []byte) string {
+	return s3.cfg.Prefix + hex.EncodeToString(key)
+}
+
+// Put stores data under key.
+func (s3 *S3BlobStore) Put(key []byte, data []byte) error {
+	_, _, err := s3.do("PUT", s3.object(key), nil, data)
+	return err
+}
+
+// Get returns the blob under key.
+func (s3 *S3BlobStore) Get(key []byte) ([]byte, error) {
+	body, _, err := s3.do("GET", s3.object(key), nil, nil)
+	return body, err
+}
+
+// Delete removes the blob under key. As S3 does not tell whether an
+// object existed, it is looked up first.
+func (s3 *S3BlobStore) Delete(key []byte) error {
+	if _, err := s3.Stat(key); err != nil {
+		return err
+	}
+	_, _, err := s3.do("DELETE", s3.object(key), nil, nil)
+	return err
+}
+
+// Stat returns the size of the blob under key.
+func (s3 *S3BlobStore) Stat(key []byte) (int64, error) {
+	_, h, err := s3.do("HEAD", s3.object(key), nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+}
+
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key  string
+		Size int64
+	}
+}
+
+// Iterate calls f for every blob in the order of the keys. Objects under
+// the prefix that are not named like blobs are skipped.
+func (s3 *S3BlobStore) Iterate(f func(key []byte, size int64) error) error {
+	token := ""
+	for {
+		query := map[string]string{"list-type": "2", "prefix": s3.cfg.Prefix}
+		if token != "" {
+			query["continuation-token"] = token
+		}
+		body, _, err := s3.do("GET", "", query, nil)
+		if err != nil {
+			return err
+		}
+		var res s3ListResult
+		if err = xml.Unmarshal(body, &res); err != nil {
+			return err
+		}
+		for _, c := range res.Contents {
+			key, err := hex.DecodeString(strings.TrimPrefix(c.Key, s3.cfg.Prefix))
+			if err != nil {
+				continue
+			}
+			if err = f(key, c.Size); err != nil {
+				return err
+			}
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// do sends a signed request for the object of the bucket, or for the
+// bucket itself if object is empty. It returns ErrBlobNotFound if the
+// object does not exist.
+func (s3 *S3BlobStore) do(method, object string, query map[string]string, body []byte) ([]byte, http.Header, error) {
+	path := "/" + s3Escape(s3.cfg.Bucket, false)
+	if object != "" {
+		path += "/" + s3Escape(object, false)
+	}
+	rawQuery := s3Query(query)
+	url := s3.cfg.Endpoint + path
+	if rawQuery != "" {
+		url += "?" + rawQuery
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.ContentLength = int64(len(body))
+	s3.sign(req, path, rawQuery, body)
+	resp, err := s3.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && object != "" {
+		return nil, nil, ErrBlobNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, fmt.Errorf("S3 %s %s failed: %s %s", method, path, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, resp.Header, nil
+}
+
+// sign adds the headers of AWS signature version 4 to req.
+func (s3 *S3BlobStore) sign(req *http.Request, path, rawQuery string, body []byte) {
+	now := s3.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		rawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s3.cfg.Region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := s3HMAC([]byte("AWS4"+s3.cfg.SecretKey), day)
+	key = s3HMAC(key, s3.cfg.Region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	sig := hex.EncodeToString(s3HMAC(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s3.cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+sig)
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Query returns the query sorted by name and encoded as the signature
+// expects it.
+func s3Query(query map[string]string) string {
+	names := make([]string, 0, len(query))
+	for n := range query {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, n := range names {
+		parts[i] = s3Escape(n, true) + "=" + s3Escape(query[n], true)
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes all but the unreserved characters of s. The
+// slash is kept unless slash is set.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !slash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
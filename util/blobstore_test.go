@@ -0,0 +1,196 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+// testBlobStore runs the same checks against every backend.
+func testBlobStore(t *testing.T, bs BlobStore) {
+	keys := [][]byte{{1, 2, 3, 4}, {1, 2, 3, 5}, {0xff, 0, 0x10}}
+	for i, k := range keys {
+		if err := bs.Put(k, bytes.Repeat([]byte{byte(i)}, 10*(i+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := bs.Get(keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, bytes.Repeat([]byte{1}, 20)) {
+		t.Fatal("Got wrong blob")
+	}
+	if size, err := bs.Stat(keys[2]); err != nil || size != 30 {
+		t.Fatalf("Wrong size %d: %v", size, err)
+	}
+	if err = bs.Put(keys[0], []byte("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ = bs.Get(keys[0]); string(data) != "replaced" {
+		t.Fatal("Blob was not replaced")
+	}
+
+	var seen []string
+	err = bs.Iterate(func(k []byte, size int64) error {
+		seen = append(seen, hex.EncodeToString(k)+":"+strconv.FormatInt(size, 10))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(seen, ",") != "01020304:8,01020305:20,ff0010:30" {
+		t.Fatalf("Wrong blobs: %v", seen)
+	}
+
+	if err = bs.Delete(keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bs.Get(keys[1]); err != ErrBlobNotFound {
+		t.Fatalf("Expected ErrBlobNotFound, got %v", err)
+	}
+	if _, err = bs.Stat(keys[1]); err != ErrBlobNotFound {
+		t.Fatalf("Expected ErrBlobNotFound, got %v", err)
+	}
+	if err = bs.Delete(keys[1]); err != ErrBlobNotFound {
+		t.Fatalf("Expected ErrBlobNotFound, got %v", err)
+	}
+}
+
+func TestBoltBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bs, err := NewBoltBlobStore(db, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, bs)
+}
+
+func TestFSBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bs, err := NewFSBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, bs)
+	if _, err = os.Stat(filepath.Join(dir, "ff", "00", "ff0010")); err != nil {
+		t.Fatal("Blob is not in its directory:", err)
+	}
+}
+
+// fakeS3 is an in-memory stand-in for an S3 bucket. It pages the listing
+// after two objects to exercise the continuation tokens.
+type fakeS3 struct {
+	sync.Mutex
+	t       *testing.T
+	bucket  string
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		f.t.Error("Wrong payload hash")
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if len(parts) == 1 {
+		f.list(w, r)
+		return
+	}
+	name := parts[1]
+	switch r.Method {
+	case "PUT":
+		f.objects[name] = body
+	case "GET", "HEAD":
+		data, ok := f.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	case "DELETE":
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	for n := range f.objects {
+		if strings.HasPrefix(n, r.URL.Query().Get("prefix")) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	var res s3ListResult
+	for i := start; i < len(names) && i < start+2; i++ {
+		res.Contents = append(res.Contents, struct {
+			Key  string
+			Size int64
+		}{names[i], int64(len(f.objects[names[i]]))})
+	}
+	if start+2 < len(names) {
+		res.IsTruncated = true
+		res.NextContinuationToken = strconv.Itoa(start + 2)
+	}
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		s3ListResult
+	}{s3ListResult: res})
+}
+
+func TestS3BlobStore(t *testing.T) {
+	fake := &fakeS3{t: t, bucket: "calypso", objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	fake.objects["blobs/other"] = []byte("not a blob")
+	fake.objects["unrelated"] = []byte("outside the prefix")
+	bs, err := NewS3BlobStore(S3Config{Endpoint: srv.URL, Bucket: "calypso", Prefix: "blobs/",
+		AccessKey: "access", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, bs)
+	if _, ok := fake.objects["blobs/ff0010"]; !ok {
+		t.Fatal("Blob is not stored under its prefix")
+	}
+}
@@ -0,0 +1,456 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/util/random"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/protobuf"
+)
+
+// MaxUploadSize is the largest payload that can be uploaded in chunks.
+const MaxUploadSize = 1 << 32
+
+// UploadTimeout is how long an unfinished upload session is kept.
+var UploadTimeout = 24 * time.Hour
+
+// UploadSession is an upload of a payload in chunks that has not been
+// finished yet. If writers are registered, Writer is the writer that began
+// the upload and has to sign its chunks, and Reserved is the number of
+// bytes of its quota that are held for the upload.
+type UploadSession struct {
+	Size        int64
+	ChunkHashes [][]byte
+	Expire      int64
+	Writer      kyber.Point
+	Reserved    int64
+}
+
+// ChunkedData describes a payload that is stored in chunks.
+type ChunkedData struct {
+	Size        int64
+	ChunkHashes [][]byte
+}
+
+// ChunkStore keeps upload sessions and the chunks of stored payloads in a
+// bolt database. The chunks of a payload are stored under its Merkle root.
+type ChunkStore struct {
+	// Writers, if set, holds the quotas that uploads are charged to.
+	Writers       *WriterStore
+	db            *bolt.DB
+	sessionBucket []byte
+	uploadBucket  []byte
+	metaBucket    []byte
+	dataBucket    []byte
+}
+
+// NewChunkStore creates the buckets of the chunk store, using bn as prefix
+// for their names.
+func NewChunkStore(db *bolt.DB, bn []byte) (*ChunkStore, error) {
+	cs := &ChunkStore{
+		db:            db,
+		sessionBucket: append(append([]byte{}, bn...), []byte("_sessions")...),
+		uploadBucket:  append(append([]byte{}, bn...), []byte("_uploads")...),
+		metaBucket:    append(append([]byte{}, bn...), []byte("_chunkmeta")...),
+		dataBucket:    append(append([]byte{}, bn...), []byte("_chunks")...),
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{cs.sessionBucket, cs.uploadBucket, cs.metaBucket, cs.dataBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("NewChunkStore error: %v", err)
+		return nil, err
+	}
+	return cs, nil
+}
+
+func chunkKey(prefix []byte, index int) []byte {
+	key := make([]byte, len(prefix)+8)
+	copy(key, prefix)
+	binary.BigEndian.PutUint64(key[len(prefix):], uint64(index))
+	return key
+}
+
+func chunkLen(size int64, index int) int {
+	if index < NumChunks(size)-1 {
+		return ChunkSize
+	}
+	return int(size - int64(index)*ChunkSize)
+}
+
+// ChunkMessage returns the message the writer of an upload session signs to
+// upload the chunk with the given index and hash.
+func ChunkMessage(sessionID string, index int, hash []byte) []byte {
+	return AdminMessage("chunk", int64(index), append([]byte(sessionID), hash...))
+}
+
+// SignChunk signs the chunk with the given index of an upload session with
+// the key of the writer. It returns nil if sk is nil.
+func SignChunk(sk kyber.Scalar, sessionID string, index int, chunk []byte) ([]byte, error) {
+	if sk == nil {
+		return nil, nil
+	}
+	h := sha256.Sum256(chunk)
+	return schnorr.Sign(cothority.Suite, sk, ChunkMessage(sessionID, index, h[:]))
+}
+
+// BeginUpload starts an upload session of writer for a payload of size
+// bytes whose chunks have the given hashes, and returns the ID of the
+// session. If writers are registered, size bytes of the quota of writer
+// are reserved until the upload is finished or the session expires.
+func (cs *ChunkStore) BeginUpload(size int64, hashes [][]byte, writer kyber.Point, now time.Time) (string, error) {
+	if size <= 0 || size > MaxUploadSize {
+		return "", fmt.Errorf("Invalid upload size %d", size)
+	}
+	if len(hashes) != NumChunks(size) {
+		return "", errors.New("Wrong number of chunk hashes")
+	}
+	for _, h := range hashes {
+		if len(h) != sha256.Size {
+			return "", errors.New("Invalid chunk hash")
+		}
+	}
+	us := &UploadSession{
+		Size:        size,
+		ChunkHashes: hashes,
+		Expire:      now.Add(UploadTimeout).Unix(),
+	}
+	id := random.Bits(128, true, random.New())
+	err := cs.db.Update(func(tx *bolt.Tx) error {
+		if cs.Writers != nil && cs.Writers.EnabledTx(tx) {
+			if err := cs.Writers.ChargeTx(tx, writer, size); err != nil {
+				return err
+			}
+			us.Writer = writer
+			us.Reserved = size
+		}
+		buf, err := protobuf.Encode(us)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(cs.sessionBucket).Put(id, buf)
+	})
+	if err != nil {
+		log.Errorf("BeginUpload error: %v", err)
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (cs *ChunkStore) getSessionTx(tx *bolt.Tx, id []byte) (*UploadSession, error) {
+	val := tx.Bucket(cs.sessionBucket).Get(id)
+	if val == nil {
+		return nil, errors.New("Upload session does not exist")
+	}
+	s := &UploadSession{}
+	if err := protobuf.Decode(val, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// PutChunk stores one chunk of an upload session. Chunks can be sent again,
+// e.g. after a disconnect. If the session has a writer, sig has to be its
+// signature over ChunkMessage.
+func (cs *ChunkStore) PutChunk(sessionID string, index int, data []byte, sig []byte) error {
+	id, err := hex.DecodeString(sessionID)
+	if err != nil {
+		return err
+	}
+	err = cs.db.Update(func(tx *bolt.Tx) error {
+		s, err := cs.getSessionTx(tx, id)
+		if err != nil {
+			return err
+		}
+		if index < 0 || index >= len(s.ChunkHashes) {
+			return fmt.Errorf("Invalid chunk index %d", index)
+		}
+		if len(data) != chunkLen(s.Size, index) {
+			return fmt.Errorf("Chunk %d has a wrong length", index)
+		}
+		h := sha256.Sum256(data)
+		if !bytes.Equal(h[:], s.ChunkHashes[index]) {
+			return fmt.Errorf("Chunk %d does not match its hash", index)
+		}
+		if s.Writer != nil {
+			err := schnorr.Verify(cothority.Suite, s.Writer, ChunkMessage(sessionID, index, h[:]), sig)
+			if err != nil {
+				return &QuotaError{ErrUnauthenticated, "invalid chunk signature"}
+			}
+		}
+		return tx.Bucket(cs.uploadBucket).Put(chunkKey(id, index), data)
+	})
+	if err != nil {
+		log.Errorf("PutChunk error: %v", err)
+	}
+	return err
+}
+
+// MissingChunks returns the indexes of the chunks of an upload session that
+// have not been received yet.
+func (cs *ChunkStore) MissingChunks(sessionID string) ([]int, error) {
+	id, err := hex.DecodeString(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	var missing []int
+	err = cs.db.View(func(tx *bolt.Tx) error {
+		s, err := cs.getSessionTx(tx, id)
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket(cs.uploadBucket)
+		for i := range s.ChunkHashes {
+			if b.Get(chunkKey(id, i)) == nil {
+				missing = append(missing, i)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("MissingChunks error: %v", err)
+		return nil, err
+	}
+	return missing, nil
+}
+
+// SessionSize returns the size of the payload of an upload session and the
+// number of bytes that were reserved for it when it began.
+func (cs *ChunkStore) SessionSize(sessionID string) (int64, int64, error) {
+	id, err := hex.DecodeString(sessionID)
+	if err != nil {
+		return 0, 0, err
+	}
+	var size, reserved int64
+	err = cs.db.View(func(tx *bolt.Tx) error {
+		s, err := cs.getSessionTx(tx, id)
+		if err != nil {
+			return err
+		}
+		size, reserved = s.Size, s.Reserved
+		return nil
+	})
+	return size, reserved, err
+}
+
+// SessionRoot returns the Merkle root of the payload of an upload session.
+func (cs *ChunkStore) SessionRoot(sessionID string) ([]byte, error) {
+	id, err := hex.DecodeString(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	var root []byte
+	err = cs.db.View(func(tx *bolt.Tx) error {
+		s, err := cs.getSessionTx(tx, id)
+		if err != nil {
+			return err
+		}
+		root = MerkleRoot(s.ChunkHashes)
+		return nil
+	})
+	return root, err
+}
+
+// FinishUploadTx moves the chunks of a complete upload session to the
+// payload with the given root and removes the session. It fails if chunks
+// are missing, if root is not the Merkle root of the session or if the
+// session was begun by another writer. The bytes reserved for the session
+// are charged to writer for good, and the remaining ones, which are
+// returned, have to be charged by the caller.
+func (cs *ChunkStore) FinishUploadTx(tx *bolt.Tx, sessionID string, root []byte, writer kyber.Point) (*ChunkedData, int64, error) {
+	id, err := hex.DecodeString(sessionID)
+	if err != nil {
+		return nil, 0, err
+	}
+	s, err := cs.getSessionTx(tx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(MerkleRoot(s.ChunkHashes), root) {
+		return nil, 0, errors.New("Data hash is not the root of the uploaded chunks")
+	}
+	if s.Writer != nil && (writer == nil || !s.Writer.Equal(writer)) {
+		return nil, 0, &QuotaError{ErrUnauthenticated, "upload was begun by another writer"}
+	}
+	if tx.Bucket(cs.metaBucket).Get(root) != nil {
+		return nil, 0, errors.New("Data already exists")
+	}
+	ub := tx.Bucket(cs.uploadBucket)
+	db := tx.Bucket(cs.dataBucket)
+	for i := range s.ChunkHashes {
+		chunk := ub.Get(chunkKey(id, i))
+		if chunk == nil {
+			return nil, 0, fmt.Errorf("Chunk %d is missing", i)
+		}
+		if err = db.Put(chunkKey(root, i), append([]byte{}, chunk...)); err != nil {
+			return nil, 0, err
+		}
+		if err = ub.Delete(chunkKey(id, i)); err != nil {
+			return nil, 0, err
+		}
+	}
+	cd := &ChunkedData{Size: s.Size, ChunkHashes: s.ChunkHashes}
+	buf, err := protobuf.Encode(cd)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = tx.Bucket(cs.metaBucket).Put(root, buf); err != nil {
+		return nil, 0, err
+	}
+	return cd, s.Size - s.Reserved, tx.Bucket(cs.sessionBucket).Delete(id)
+}
+
+// GetChunkedData returns the description of the payload with the given
+// root.
+func (cs *ChunkStore) GetChunkedData(root []byte) (*ChunkedData, error) {
+	cd := &ChunkedData{}
+	err := cs.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(cs.metaBucket).Get(root)
+		if val == nil {
+			return errors.New("Data does not exist")
+		}
+		return protobuf.Decode(append([]byte{}, val...), cd)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cd, nil
+}
+
+// GetChunk returns one chunk of the payload with the given root.
+func (cs *ChunkStore) GetChunk(root []byte, index int) ([]byte, error) {
+	var chunk []byte
+	err := cs.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(cs.dataBucket).Get(chunkKey(root, index))
+		if val == nil {
+			return fmt.Errorf("Chunk %d does not exist", index)
+		}
+		chunk = append([]byte{}, val...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// DeleteTx removes the payload with the given root, if it is stored in
+// chunks, and returns the number of bytes freed.
+func (cs *ChunkStore) DeleteTx(tx *bolt.Tx, root []byte) (int, error) {
+	mb := tx.Bucket(cs.metaBucket)
+	val := mb.Get(root)
+	if val == nil {
+		return 0, nil
+	}
+	cd := &ChunkedData{}
+	if err := protobuf.Decode(append([]byte{}, val...), cd); err != nil {
+		return 0, err
+	}
+	db := tx.Bucket(cs.dataBucket)
+	for i := range cd.ChunkHashes {
+		if err := db.Delete(chunkKey(root, i)); err != nil {
+			return 0, err
+		}
+	}
+	return int(cd.Size), mb.Delete(root)
+}
+
+// PurgeSessions removes the upload sessions that expired before now,
+// together with their chunks, and releases the bytes reserved for them. It
+// returns the number of sessions removed.
+func (cs *ChunkStore) PurgeSessions(now time.Time) (int, error) {
+	count := 0
+	err := cs.db.Update(func(tx *bolt.Tx) error {
+		sb := tx.Bucket(cs.sessionBucket)
+		var expired [][]byte
+		var sessions []*UploadSession
+		err := sb.ForEach(func(k, v []byte) error {
+			s := &UploadSession{}
+			if err := protobuf.Decode(append([]byte{}, v...), s); err != nil {
+				return err
+			}
+			if now.Unix() >= s.Expire {
+				expired = append(expired, append([]byte{}, k...))
+				sessions = append(sessions, s)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		ub := tx.Bucket(cs.uploadBucket)
+		for i, id := range expired {
+			if cs.Writers != nil && sessions[i].Reserved > 0 {
+				err := cs.Writers.ReleaseTx(tx, sessions[i].Writer, sessions[i].Reserved)
+				if err != nil {
+					return err
+				}
+			}
+			for j := range sessions[i].ChunkHashes {
+				if err := ub.Delete(chunkKey(id, j)); err != nil {
+					return err
+				}
+			}
+			if err := sb.Delete(id); err != nil {
+				return err
+			}
+		}
+		count = len(expired)
+		return nil
+	})
+	if err != nil {
+		log.Errorf("PurgeSessions error: %v", err)
+		return 0, err
+	}
+	return count, nil
+}
+
+// DownloadChunks fetches the chunks of the payload with the given root one
+// after the other with get and writes them to w. The hashes of the chunks
+// are checked against root, and every chunk against its hash, before it is
+// written.
+func DownloadChunks(root []byte, hashes [][]byte, get func(index int) ([]byte, error), w io.Writer) error {
+	if !bytes.Equal(MerkleRoot(hashes), root) {
+		return errors.New("Chunk hashes do not match the data hash")
+	}
+	for i, ch := range hashes {
+		chunk, err := get(i)
+		if err != nil {
+			return err
+		}
+		h := sha256.Sum256(chunk)
+		if !bytes.Equal(h[:], ch) {
+			return fmt.Errorf("Chunk %d does not match its hash", i)
+		}
+		if _, err = w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DataChunk returns the chunk of data with the given index.
+func DataChunk(data []byte, index int) []byte {
+	start := index * ChunkSize
+	end := start + ChunkSize
+	if end > len(data) {
+		end = len(data)
+	}
+	return data[start:end]
+}
@@ -0,0 +1,288 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MaxShards is the largest number of shards a payload can be split into.
+const MaxShards = 256
+
+// ShardLayout describes a payload of Size bytes that is erasure coded into
+// N shards, any K of which reconstruct it. Hashes are the sha256 hashes of
+// the shards.
+type ShardLayout struct {
+	K      int
+	N      int
+	Size   int64
+	Hashes [][]byte
+}
+
+// Root returns the hash that commits to the layout and to all shards. It is
+// used as the DataHash of an erasure coded write.
+func (sl *ShardLayout) Root() []byte {
+	var buf [24]byte
+	binary.LittleEndian.PutUint64(buf[0:], uint64(sl.K))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(sl.N))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(sl.Size))
+	h := sha256.New()
+	h.Write([]byte("shards"))
+	h.Write(buf[:])
+	h.Write(MerkleRoot(sl.Hashes))
+	return h.Sum(nil)
+}
+
+// Check makes sure the parameters of the layout are valid.
+func (sl *ShardLayout) Check() error {
+	if sl.K < 1 || sl.N < sl.K || sl.N > MaxShards {
+		return fmt.Errorf("Invalid erasure code %d out of %d", sl.K, sl.N)
+	}
+	if sl.Size < 0 || sl.Size > MaxUploadSize {
+		return fmt.Errorf("Invalid size %d", sl.Size)
+	}
+	if len(sl.Hashes) != sl.N {
+		return errors.New("Wrong number of shard hashes")
+	}
+	return nil
+}
+
+// VerifyShard checks that shard is the shard with the given index.
+func (sl *ShardLayout) VerifyShard(index int, shard []byte) error {
+	if index < 0 || index >= len(sl.Hashes) {
+		return fmt.Errorf("Invalid shard index %d", index)
+	}
+	if int64(len(shard)) != shardSize(sl.Size, sl.K) {
+		return errors.New("Wrong shard size")
+	}
+	h := sha256.Sum256(shard)
+	if !bytes.Equal(h[:], sl.Hashes[index]) {
+		return errors.New("Shard does not match its hash")
+	}
+	return nil
+}
+
+func shardSize(size int64, k int) int64 {
+	s := (size + int64(k) - 1) / int64(k)
+	if s == 0 {
+		s = 1
+	}
+	return s
+}
+
+// EncodeShards splits data into n shards with a Reed-Solomon code, so that
+// any k of them reconstruct it. The first k shards hold the data itself.
+func EncodeShards(data []byte, k, n int) ([][]byte, *ShardLayout, error) {
+	sl := &ShardLayout{K: k, N: n, Size: int64(len(data)), Hashes: make([][]byte, n)}
+	if k < 1 || n < k || n > MaxShards {
+		return nil, nil, fmt.Errorf("Invalid erasure code %d out of %d", k, n)
+	}
+	size := shardSize(sl.Size, k)
+	shards := make([][]byte, n)
+	for i := 0; i < k; i++ {
+		shards[i] = make([]byte, size)
+		start := int64(i) * size
+		if start < sl.Size {
+			copy(shards[i], data[start:])
+		}
+	}
+	m := encodeMatrix(k, n)
+	for i := k; i < n; i++ {
+		shards[i] = make([]byte, size)
+		for j := 0; j < k; j++ {
+			gfMulAdd(shards[i], shards[j], m[i][j])
+		}
+	}
+	for i, s := range shards {
+		h := sha256.Sum256(s)
+		sl.Hashes[i] = h[:]
+	}
+	return shards, sl, nil
+}
+
+// RepairShards rebuilds the missing shards, which are nil, from at least K
+// shards that are present. The shards that are present have to be
+// verified against the layout before.
+func RepairShards(sl *ShardLayout, shards [][]byte) error {
+	if err := sl.Check(); err != nil {
+		return err
+	}
+	if len(shards) != sl.N {
+		return errors.New("Wrong number of shards")
+	}
+	var have []int
+	for i, s := range shards {
+		if s != nil {
+			have = append(have, i)
+		}
+	}
+	if len(have) < sl.K {
+		return fmt.Errorf("Need %d shards, only %d are available", sl.K, len(have))
+	}
+	have = have[:sl.K]
+	m := encodeMatrix(sl.K, sl.N)
+	sub := make([][]byte, sl.K)
+	for i, idx := range have {
+		sub[i] = m[idx]
+	}
+	inv, err := gfInvert(sub)
+	if err != nil {
+		return err
+	}
+	size := shardSize(sl.Size, sl.K)
+	data := make([][]byte, sl.K)
+	for i := 0; i < sl.K; i++ {
+		if shards[i] != nil {
+			data[i] = shards[i]
+			continue
+		}
+		data[i] = make([]byte, size)
+		for j, idx := range have {
+			gfMulAdd(data[i], shards[idx], inv[i][j])
+		}
+	}
+	for i := range shards {
+		if shards[i] != nil {
+			continue
+		}
+		if i < sl.K {
+			shards[i] = data[i]
+			continue
+		}
+		shards[i] = make([]byte, size)
+		for j := 0; j < sl.K; j++ {
+			gfMulAdd(shards[i], data[j], m[i][j])
+		}
+	}
+	return nil
+}
+
+// JoinShards reconstructs the payload from the shards, of which at least K
+// have to be present, and checks it against the layout.
+func JoinShards(sl *ShardLayout, shards [][]byte) ([]byte, error) {
+	if err := RepairShards(sl, shards); err != nil {
+		return nil, err
+	}
+	for i, s := range shards {
+		if err := sl.VerifyShard(i, s); err != nil {
+			return nil, err
+		}
+	}
+	data := make([]byte, 0, shardSize(sl.Size, sl.K)*int64(sl.K))
+	for _, s := range shards[:sl.K] {
+		data = append(data, s...)
+	}
+	return data[:sl.Size], nil
+}
+
+// Arithmetic in GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1.
+var gfExp [510]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// gfMulAdd adds c*src to dst.
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	for i, b := range src {
+		dst[i] ^= gfMul(c, b)
+	}
+}
+
+// encodeMatrix returns the n x k matrix of a systematic Reed-Solomon code:
+// a Vandermonde matrix multiplied with the inverse of its top k rows, so
+// that any k of its rows are invertible and the top k rows are the
+// identity.
+func encodeMatrix(k, n int) [][]byte {
+	v := make([][]byte, n)
+	for r := 0; r < n; r++ {
+		v[r] = make([]byte, k)
+		x := byte(1)
+		for c := 0; c < k; c++ {
+			v[r][c] = x
+			x = gfMul(x, byte(r))
+		}
+	}
+	top, err := gfInvert(v[:k])
+	if err != nil {
+		// The top rows of a Vandermonde matrix with distinct points are
+		// always invertible.
+		panic(err)
+	}
+	m := make([][]byte, n)
+	for r := 0; r < n; r++ {
+		m[r] = make([]byte, k)
+		for c := 0; c < k; c++ {
+			var sum byte
+			for i := 0; i < k; i++ {
+				sum ^= gfMul(v[r][i], top[i][c])
+			}
+			m[r][c] = sum
+		}
+	}
+	return m
+}
+
+// gfInvert returns the inverse of the square matrix a, using Gauss-Jordan
+// elimination.
+func gfInvert(a [][]byte) ([][]byte, error) {
+	k := len(a)
+	work := make([][]byte, k)
+	for i := range a {
+		work[i] = make([]byte, 2*k)
+		copy(work[i], a[i])
+		work[i][k+i] = 1
+	}
+	for c := 0; c < k; c++ {
+		p := c
+		for p < k && work[p][c] == 0 {
+			p++
+		}
+		if p == k {
+			return nil, errors.New("Singular matrix")
+		}
+		work[c], work[p] = work[p], work[c]
+		inv := gfInv(work[c][c])
+		for j := range work[c] {
+			work[c][j] = gfMul(work[c][j], inv)
+		}
+		for r := 0; r < k; r++ {
+			if r != c && work[r][c] != 0 {
+				gfMulAdd(work[r], work[c], work[r][c])
+			}
+		}
+	}
+	inv := make([][]byte, k)
+	for i := range work {
+		inv[i] = work[i][k:]
+	}
+	return inv, nil
+}
@@ -0,0 +1,138 @@
+package util
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestGFInvert(t *testing.T) {
+	for _, k := range []int{1, 2, 3, 5, 16} {
+		m := encodeMatrix(k, k+4)
+		// Any k rows of the encoding matrix are invertible.
+		rows := rand.New(rand.NewSource(int64(k))).Perm(k + 4)[:k]
+		sub := make([][]byte, k)
+		for i, r := range rows {
+			sub[i] = m[r]
+		}
+		inv, err := gfInvert(sub)
+		if err != nil {
+			t.Fatalf("k=%d: %v", k, err)
+		}
+		for i := 0; i < k; i++ {
+			for j := 0; j < k; j++ {
+				var sum byte
+				for l := 0; l < k; l++ {
+					sum ^= gfMul(sub[i][l], inv[l][j])
+				}
+				if (i == j && sum != 1) || (i != j && sum != 0) {
+					t.Fatalf("k=%d: product is not the identity at %d,%d", k, i, j)
+				}
+			}
+		}
+	}
+	if _, err := gfInvert([][]byte{{1, 2}, {2, 4}}); err == nil {
+		t.Fatal("Singular matrix was inverted")
+	}
+	for a := 1; a < 256; a++ {
+		if gfMul(byte(a), gfInv(byte(a))) != 1 {
+			t.Fatalf("Wrong inverse of %d", a)
+		}
+	}
+}
+
+func TestShards(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name   string
+		size   int
+		k, n   int
+		erased []int
+		ok     bool
+	}{
+		{"no erasure", 1000, 3, 5, nil, true},
+		{"data shards erased", 1000, 3, 5, []int{0, 2}, true},
+		{"parity shards erased", 1000, 3, 5, []int{3, 4}, true},
+		{"mixed erasures", 1001, 4, 8, []int{1, 2, 5, 7}, true},
+		{"uneven size", 7, 3, 4, []int{0}, true},
+		{"empty data", 0, 2, 3, []int{1}, true},
+		{"replication", 100, 1, 3, []int{0, 1}, true},
+		{"many shards", 5000, 10, 256, []int{0, 3, 9, 100, 255}, true},
+		{"too many erasures", 1000, 3, 5, []int{0, 1, 4}, false},
+	}
+	for _, tt := range tests {
+		data := make([]byte, tt.size)
+		rnd.Read(data)
+		shards, sl, err := EncodeShards(data, tt.k, tt.n)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err = sl.Check(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for i, s := range shards {
+			if err = sl.VerifyShard(i, s); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		orig := make([][]byte, len(shards))
+		copy(orig, shards)
+		for _, i := range tt.erased {
+			shards[i] = nil
+		}
+		joined, err := JoinShards(sl, shards)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: data was joined", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(joined, data) {
+			t.Errorf("%s: wrong data", tt.name)
+		}
+		for i := range shards {
+			if !bytes.Equal(shards[i], orig[i]) {
+				t.Errorf("%s: shard %d was not repaired", tt.name, i)
+			}
+		}
+	}
+}
+
+func TestShardErrors(t *testing.T) {
+	data := bytes.Repeat([]byte("data"), 100)
+	shards, sl, err := EncodeShards(data, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range [][2]int{{0, 1}, {2, 1}, {5, 4}, {1, MaxShards + 1}} {
+		if _, _, err = EncodeShards(data, c[0], c[1]); err == nil {
+			t.Errorf("Code %d out of %d was accepted", c[0], c[1])
+		}
+	}
+	bad := append([]byte{}, shards[1]...)
+	bad[0] ^= 1
+	if err = sl.VerifyShard(1, bad); err == nil {
+		t.Error("Changed shard was accepted")
+	}
+	if err = sl.VerifyShard(1, shards[1][1:]); err == nil {
+		t.Error("Short shard was accepted")
+	}
+	if err = sl.VerifyShard(4, shards[1]); err == nil {
+		t.Error("Shard with an invalid index was accepted")
+	}
+	// A corrupted shard that is used for the repair is detected.
+	if _, err = JoinShards(sl, [][]byte{nil, bad, shards[2], nil}); err == nil {
+		t.Error("Data was joined from a changed shard")
+	}
+	if err = RepairShards(sl, shards[:3]); err == nil {
+		t.Error("Wrong number of shards was accepted")
+	}
+	other := *sl
+	other.Size++
+	if other.Root() == nil || bytes.Equal(other.Root(), sl.Root()) {
+		t.Error("Root does not commit to the size")
+	}
+}
@@ -0,0 +1,100 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/util/encoding"
+	"github.com/dedis/onet/app"
+	"github.com/dedis/onet/log"
+)
+
+// AdminWindow is how far the timestamp of an administrative request, such
+// as a key rotation, may be from the time of the server.
+const AdminWindow = 5 * time.Minute
+
+// AdminMessage returns the message that is signed with the identity key of
+// a server to authorize action on it at time ts.
+func AdminMessage(action string, ts int64, data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(action))
+	binary.Write(h, binary.LittleEndian, ts)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// VerifyAdminRequest checks that an administrative request is fresh and
+// signed with the identity key pub of the server.
+func VerifyAdminRequest(pub kyber.Point, action string, ts int64, data []byte, sig []byte, now time.Time) error {
+	t := time.Unix(ts, 0)
+	if t.Before(now.Add(-AdminWindow)) || t.After(now.Add(AdminWindow)) {
+		return errors.New("Admin request timestamp is outside of the window")
+	}
+	return schnorr.Verify(cothority.Suite, pub, AdminMessage(action, ts, data), sig)
+}
+
+// KeyMessage returns the message a server signs with its identity key to
+// publish its encryption key.
+func KeyMessage(pub kyber.Point) ([]byte, error) {
+	buf, err := pub.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return AdminMessage("enckey", 0, buf), nil
+}
+
+// WriteServerKey writes the encryption key of a server to fname, in the
+// format read by GetServerKey.
+func WriteServerKey(fname string, pk kyber.Point) error {
+	str, err := encoding.PointToStringHex(cothority.Suite, pk)
+	if err != nil {
+		log.Errorf("WriteServerKey error: %v", err)
+		return err
+	}
+	tmp := fname + ".tmp"
+	err = writeFile(tmp, []byte(str+"\n"))
+	if err != nil {
+		log.Errorf("WriteServerKey error: %v", err)
+		return err
+	}
+	if err = os.Rename(tmp, fname); err != nil {
+		log.Errorf("WriteServerKey error: %v", err)
+		return err
+	}
+	return nil
+}
+
+func writeFile(fname string, data []byte) error {
+	fh, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	if _, err = fh.Write(data); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// ReadPrivateKey returns the identity key of a conode from its
+// private.toml file.
+func ReadPrivateKey(fname string) (kyber.Scalar, error) {
+	conf, err := app.LoadCothority(fname)
+	if err != nil {
+		log.Errorf("ReadPrivateKey error: %v", err)
+		return nil, err
+	}
+	sk, err := encoding.StringHexToScalar(cothority.Suite, conf.Private)
+	if err != nil {
+		log.Errorf("ReadPrivateKey error: %v", err)
+		return nil, fmt.Errorf("invalid private key in %s: %v", fname, err)
+	}
+	return sk, nil
+}
@@ -0,0 +1,126 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// ChunkSize is the size of the chunks large payloads are split into. All
+// chunks but the last one have this size.
+const ChunkSize = 256 * 1024
+
+// NumChunks returns the number of chunks of a payload of size bytes.
+func NumChunks(size int64) int {
+	return int((size + ChunkSize - 1) / ChunkSize)
+}
+
+// ChunkHashes splits data into chunks of ChunkSize and returns the hash of
+// every chunk.
+func ChunkHashes(data []byte) [][]byte {
+	var hashes [][]byte
+	for start := 0; start < len(data); start += ChunkSize {
+		end := start + ChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha256.Sum256(data[start:end])
+		hashes = append(hashes, h[:])
+	}
+	return hashes
+}
+
+// MerkleRoot returns the root of the Merkle tree over the hashes of the
+// chunks. Inner nodes are the hash of 0x01 followed by their children, and
+// a node without sibling is moved up unchanged. The root of a single chunk
+// is its hash, so that the root of a payload of at most ChunkSize bytes is
+// its sha256 hash.
+func MerkleRoot(hashes [][]byte) []byte {
+	if len(hashes) == 0 {
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+	level := hashes
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// DataHash returns the hash data is stored under, which is the Merkle root
+// of its chunks. Every chunk can then be verified on its own with its path,
+// see MerklePath.
+func DataHash(data []byte) []byte {
+	return MerkleRoot(ChunkHashes(data))
+}
+
+// VerifyDataHash returns true if hash is the DataHash of data. For data of
+// at most ChunkSize bytes, this is the sha256 hash of the data, which older
+// writes used. The sha256 hash of larger data is not accepted, as it does
+// not allow to verify the chunks.
+func VerifyDataHash(data []byte, hash []byte) bool {
+	return bytes.Equal(DataHash(data), hash)
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// MerklePath returns the siblings on the path from the chunk with the given
+// index to the root of the Merkle tree over hashes, starting at the bottom.
+func MerklePath(hashes [][]byte, index int) [][]byte {
+	var path [][]byte
+	level := hashes
+	for len(level) > 1 {
+		if sib := index ^ 1; sib < len(level) {
+			path = append(path, level[sib])
+		}
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+		level = next
+		index /= 2
+	}
+	return path
+}
+
+// VerifyMerklePath checks that leaf is the hash of the chunk with the given
+// index out of n chunks under root, using the path of MerklePath.
+func VerifyMerklePath(root []byte, leaf []byte, index int, n int, path [][]byte) bool {
+	if index < 0 || index >= n {
+		return false
+	}
+	h := leaf
+	for n > 1 {
+		if sib := index ^ 1; sib < n {
+			if len(path) == 0 {
+				return false
+			}
+			if index%2 == 0 {
+				h = merkleNode(h, path[0])
+			} else {
+				h = merkleNode(path[0], h)
+			}
+			path = path[1:]
+		}
+		index /= 2
+		n = (n + 1) / 2
+	}
+	return len(path) == 0 && bytes.Equal(h, root)
+}
@@ -0,0 +1,93 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// testHashes returns the hashes of n different chunks.
+func testHashes(n int) [][]byte {
+	hashes := make([][]byte, n)
+	for i := range hashes {
+		h := sha256.Sum256([]byte{byte(i), byte(i >> 8)})
+		hashes[i] = h[:]
+	}
+	return hashes
+}
+
+func TestMerklePath(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 5, 6, 7, 8, 9, 13, 31, 33, 100} {
+		hashes := testHashes(n)
+		root := MerkleRoot(hashes)
+		for i := 0; i < n; i++ {
+			path := MerklePath(hashes, i)
+			if !VerifyMerklePath(root, hashes[i], i, n, path) {
+				t.Fatalf("n=%d: path of chunk %d is not accepted", n, i)
+			}
+			if VerifyMerklePath(root, hashes[(i+1)%n], i, n, path) && n > 1 {
+				t.Fatalf("n=%d: path of chunk %d accepts another chunk", n, i)
+			}
+			if n > 1 && VerifyMerklePath(root, hashes[i], i^1, n, path) {
+				t.Fatalf("n=%d: path of chunk %d is accepted for another index", n, i)
+			}
+			if len(path) > 0 && VerifyMerklePath(root, hashes[i], i, n, path[:len(path)-1]) {
+				t.Fatalf("n=%d: short path of chunk %d is accepted", n, i)
+			}
+			if VerifyMerklePath(root, hashes[i], i, n, append(path, root)) {
+				t.Fatalf("n=%d: long path of chunk %d is accepted", n, i)
+			}
+		}
+		if VerifyMerklePath(root, hashes[0], n, n, nil) || VerifyMerklePath(root, hashes[0], -1, n, nil) {
+			t.Fatalf("n=%d: invalid index is accepted", n)
+		}
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	hashes := testHashes(3)
+	tests := []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		{"one chunk", MerkleRoot(hashes[:1]), hashes[0]},
+		{"two chunks", MerkleRoot(hashes[:2]), merkleNode(hashes[0], hashes[1])},
+		{"odd chunk moves up", MerkleRoot(hashes), merkleNode(merkleNode(hashes[0], hashes[1]), hashes[2])},
+	}
+	for _, tt := range tests {
+		if !bytes.Equal(tt.got, tt.want) {
+			t.Errorf("%s: wrong root", tt.name)
+		}
+	}
+	// The root depends on the order and number of the chunks.
+	if bytes.Equal(MerkleRoot([][]byte{hashes[1], hashes[0]}), MerkleRoot(hashes[:2])) {
+		t.Error("Root does not depend on the order")
+	}
+	if bytes.Equal(MerkleRoot(append(hashes, hashes[2])), MerkleRoot(hashes)) {
+		t.Error("Root does not depend on the number of chunks")
+	}
+}
+
+func TestDataHash(t *testing.T) {
+	for _, size := range []int{0, 1, ChunkSize, ChunkSize + 1, 3*ChunkSize - 1} {
+		data := bytes.Repeat([]byte{7}, size)
+		hash := DataHash(data)
+		if NumChunks(int64(size)) != len(ChunkHashes(data)) {
+			t.Fatalf("size=%d: wrong number of chunks", size)
+		}
+		if !VerifyDataHash(data, hash) {
+			t.Fatalf("size=%d: hash is not accepted", size)
+		}
+		if VerifyDataHash(append(data, 0), hash) {
+			t.Fatalf("size=%d: hash of other data is accepted", size)
+		}
+		h := sha256.Sum256(data)
+		if size <= ChunkSize && !bytes.Equal(h[:], hash) {
+			t.Fatalf("size=%d: hash of a single chunk is not its sha256", size)
+		}
+		if size > ChunkSize && VerifyDataHash(data, h[:]) {
+			t.Fatalf("size=%d: sha256 of the whole data is accepted", size)
+		}
+	}
+}
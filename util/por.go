@@ -0,0 +1,84 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ChallengeIndices returns the indices of the chunks a storage server has
+// to return for the challenge nonce, out of n chunks. The same index can be
+// sampled more than once.
+func ChallengeIndices(nonce []byte, n int, samples int) []int {
+	if n <= 0 {
+		return nil
+	}
+	indices := make([]int, samples)
+	var buf [4]byte
+	for i := range indices {
+		binary.LittleEndian.PutUint32(buf[:], uint32(i))
+		h := sha256.New()
+		h.Write(nonce)
+		h.Write(buf[:])
+		indices[i] = int(binary.LittleEndian.Uint64(h.Sum(nil)) % uint64(n))
+	}
+	return indices
+}
+
+// ChunkProof is a chunk together with its Merkle path.
+type ChunkProof struct {
+	Chunk []byte
+	Path  [][]byte
+}
+
+// ProveChunks answers the challenge nonce for a payload of size bytes. hashes
+// are the hashes of its chunks and get returns the chunk with the given
+// index.
+func ProveChunks(nonce []byte, samples int, size int64, hashes [][]byte, get func(int) ([]byte, error)) ([]*ChunkProof, error) {
+	var proofs []*ChunkProof
+	for _, i := range ChallengeIndices(nonce, len(hashes), samples) {
+		chunk, err := get(i)
+		if err != nil {
+			return nil, err
+		}
+		proofs = append(proofs, &ChunkProof{Chunk: chunk, Path: MerklePath(hashes, i)})
+	}
+	return proofs, nil
+}
+
+// VerifyChunks checks the answer to the challenge nonce against the Merkle
+// root and the size of the payload, which the verifier has to know.
+func VerifyChunks(root []byte, size int64, nonce []byte, samples int, proofs []*ChunkProof) error {
+	n := NumChunks(size)
+	indices := ChallengeIndices(nonce, n, samples)
+	if len(proofs) != len(indices) {
+		return errors.New("Wrong number of chunks")
+	}
+	for j, i := range indices {
+		if proofs[j] == nil {
+			return fmt.Errorf("Chunk %d is missing", i)
+		}
+		if err := VerifyChunk(root, size, i, proofs[j]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyChunk checks that p holds the chunk with the given index of a
+// payload of size bytes with the given Merkle root.
+func VerifyChunk(root []byte, size int64, index int, p *ChunkProof) error {
+	n := NumChunks(size)
+	if index < 0 || index >= n {
+		return fmt.Errorf("Invalid chunk index %d", index)
+	}
+	if len(p.Chunk) != chunkLen(size, index) {
+		return fmt.Errorf("Chunk %d has the wrong size", index)
+	}
+	h := sha256.Sum256(p.Chunk)
+	if !VerifyMerklePath(root, h[:], index, n, p.Path) {
+		return fmt.Errorf("Chunk %d does not match the root", index)
+	}
+	return nil
+}
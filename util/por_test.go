@@ -0,0 +1,92 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChallengeIndices(t *testing.T) {
+	a := ChallengeIndices([]byte("nonce"), 5, 20)
+	if len(a) != 20 {
+		t.Fatalf("Got %d indices", len(a))
+	}
+	for _, i := range a {
+		if i < 0 || i >= 5 {
+			t.Fatalf("Index %d is out of range", i)
+		}
+	}
+	b := ChallengeIndices([]byte("nonce"), 5, 20)
+	c := ChallengeIndices([]byte("other"), 5, 20)
+	same, other := true, false
+	for i := range a {
+		same = same && a[i] == b[i]
+		other = other || a[i] != c[i]
+	}
+	if !same || !other {
+		t.Fatal("Indices do not depend on the nonce only")
+	}
+	if ChallengeIndices([]byte("nonce"), 0, 20) != nil {
+		t.Fatal("Got indices without chunks")
+	}
+}
+
+func TestProveChunks(t *testing.T) {
+	data := append(bytes.Repeat([]byte("0123456789"), ChunkSize/2), "tail"...)
+	size := int64(len(data))
+	hashes := ChunkHashes(data)
+	root := MerkleRoot(hashes)
+	get := func(i int) ([]byte, error) {
+		return data[i*ChunkSize : i*ChunkSize+chunkLen(size, i)], nil
+	}
+	nonce := []byte("nonce")
+	proofs, err := ProveChunks(nonce, 8, size, hashes, get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyChunks(root, size, nonce, 8, proofs); err != nil {
+		t.Fatal(err)
+	}
+
+	// copyProofs returns a copy of the proofs that can be changed.
+	copyProofs := func() []*ChunkProof {
+		c := make([]*ChunkProof, len(proofs))
+		for i, p := range proofs {
+			c[i] = &ChunkProof{Chunk: append([]byte{}, p.Chunk...), Path: append([][]byte{}, p.Path...)}
+		}
+		return c
+	}
+	tests := []struct {
+		name   string
+		root   []byte
+		size   int64
+		nonce  []byte
+		proofs func() []*ChunkProof
+	}{
+		{"other nonce", root, size, []byte("other"), copyProofs},
+		{"other root", DataHash([]byte("other")), size, nonce, copyProofs},
+		{"other size", root, size + 1, nonce, copyProofs},
+		{"changed chunk", root, size, nonce, func() []*ChunkProof {
+			p := copyProofs()
+			p[3].Chunk[0] ^= 1
+			return p
+		}},
+		{"short path", root, size, nonce, func() []*ChunkProof {
+			p := copyProofs()
+			p[0].Path = p[0].Path[1:]
+			return p
+		}},
+		{"missing proof", root, size, nonce, func() []*ChunkProof {
+			p := copyProofs()
+			p[2] = nil
+			return p
+		}},
+		{"too few proofs", root, size, nonce, func() []*ChunkProof {
+			return copyProofs()[1:]
+		}},
+	}
+	for _, tt := range tests {
+		if err := VerifyChunks(tt.root, tt.size, tt.nonce, 8, tt.proofs()); err == nil {
+			t.Errorf("%s: proofs were accepted", tt.name)
+		}
+	}
+}
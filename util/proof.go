@@ -0,0 +1,90 @@
+package util
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/random"
+)
+
+// proofBase returns the second generator used by the write proofs of the
+// server with the given key. Its discrete logarithm is unknown.
+func proofBase(serverKey kyber.Point) (kyber.Point, error) {
+	buf, err := serverKey.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	seed := append([]byte("calypso_experiments write proof"), buf...)
+	return cothority.Suite.Point().Pick(cothority.Suite.XOF(seed)), nil
+}
+
+// proofChallenge hashes the ciphertext, the commitments and the data the
+// proof is bound to into the challenge of the proof.
+func proofChallenge(K, C, Ubar, W, Wbar, reader kyber.Point, dataHash []byte) (kyber.Scalar, error) {
+	h := cothority.Suite.Hash()
+	for _, p := range []kyber.Point{K, C, Ubar, W, Wbar} {
+		if _, err := p.MarshalTo(h); err != nil {
+			return nil, err
+		}
+	}
+	if reader != nil {
+		if _, err := reader.MarshalTo(h); err != nil {
+			return nil, err
+		}
+	}
+	h.Write(dataHash)
+	return cothority.Suite.Scalar().SetBytes(h.Sum(nil)), nil
+}
+
+// EncryptWithProof ElGamal-encrypts msg to serverKey like ElGamalEncrypt,
+// and adds a non-interactive proof that the writer knows the randomness r
+// of K = r*G, as in the writes of calypso. The proof shows that K and
+// Ubar = r*gBar have the same discrete logarithm and is bound to the reader
+// and to the hash of the data, so that the ciphertext cannot be reused in
+// another write.
+func EncryptWithProof(serverKey kyber.Point, msg []byte, reader kyber.Point, dataHash []byte) (*ReplicaKey, error) {
+	gBar, err := proofBase(serverKey)
+	if err != nil {
+		return nil, err
+	}
+	M := cothority.Suite.Point().Embed(msg, random.New())
+	r := cothority.Suite.Scalar().Pick(random.New())
+	K := cothority.Suite.Point().Mul(r, nil)
+	C := cothority.Suite.Point().Mul(r, serverKey)
+	C.Add(C, M)
+	Ubar := cothority.Suite.Point().Mul(r, gBar)
+
+	w := cothority.Suite.Scalar().Pick(random.New())
+	W := cothority.Suite.Point().Mul(w, nil)
+	Wbar := cothority.Suite.Point().Mul(w, gBar)
+	E, err := proofChallenge(K, C, Ubar, W, Wbar, reader, dataHash)
+	if err != nil {
+		return nil, err
+	}
+	F := cothority.Suite.Scalar().Add(w, cothority.Suite.Scalar().Mul(E, r))
+	return &ReplicaKey{Server: serverKey, K: K, C: C, Ubar: Ubar, E: E, F: F}, nil
+}
+
+// VerifyWriteProof checks the proof of a ciphertext created by
+// EncryptWithProof.
+func VerifyWriteProof(serverKey, K, C, Ubar kyber.Point, E, F kyber.Scalar, reader kyber.Point, dataHash []byte) error {
+	if K == nil || C == nil || Ubar == nil || E == nil || F == nil {
+		return errors.New("Missing write proof")
+	}
+	gBar, err := proofBase(serverKey)
+	if err != nil {
+		return err
+	}
+	// W = F*G - E*K and Wbar = F*gBar - E*Ubar
+	W := cothority.Suite.Point().Sub(cothority.Suite.Point().Mul(F, nil), cothority.Suite.Point().Mul(E, K))
+	Wbar := cothority.Suite.Point().Sub(cothority.Suite.Point().Mul(F, gBar), cothority.Suite.Point().Mul(E, Ubar))
+	e, err := proofChallenge(K, C, Ubar, W, Wbar, reader, dataHash)
+	if err != nil {
+		return err
+	}
+	if !e.Equal(E) {
+		return errors.New("Invalid write proof")
+	}
+	return nil
+}
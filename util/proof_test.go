@@ -0,0 +1,53 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/key"
+)
+
+// writeProofArgs are the arguments of VerifyWriteProof.
+type writeProofArgs struct {
+	server, K, C, Ubar kyber.Point
+	E, F               kyber.Scalar
+	reader             kyber.Point
+	dataHash           []byte
+}
+
+func TestVerifyWriteProof(t *testing.T) {
+	server := key.NewKeyPair(cothority.Suite).Public
+	reader := key.NewKeyPair(cothority.Suite).Public
+	other := key.NewKeyPair(cothority.Suite).Public
+	dataHash := DataHash([]byte("data"))
+	rk, err := EncryptWithProof(server, []byte("symmetric key"), reader, dataHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		change func(a *writeProofArgs)
+		ok     bool
+	}{
+		{"valid", func(a *writeProofArgs) {}, true},
+		{"other server", func(a *writeProofArgs) { a.server = other }, false},
+		{"other reader", func(a *writeProofArgs) { a.reader = other }, false},
+		{"no reader", func(a *writeProofArgs) { a.reader = nil }, false},
+		{"other data", func(a *writeProofArgs) { a.dataHash = DataHash([]byte("other")) }, false},
+		{"other K", func(a *writeProofArgs) { a.K = other }, false},
+		{"other C", func(a *writeProofArgs) { a.C = other }, false},
+		{"other Ubar", func(a *writeProofArgs) { a.Ubar = other }, false},
+		{"other F", func(a *writeProofArgs) { a.F = cothority.Suite.Scalar().Add(a.F, cothority.Suite.Scalar().One()) }, false},
+		{"missing proof", func(a *writeProofArgs) { a.E = nil }, false},
+		{"missing ciphertext", func(a *writeProofArgs) { a.C = nil }, false},
+	}
+	for _, tt := range tests {
+		a := &writeProofArgs{server, rk.K, rk.C, rk.Ubar, rk.E, rk.F, reader, dataHash}
+		tt.change(a)
+		err := VerifyWriteProof(a.server, a.K, a.C, a.Ubar, a.E, a.F, a.reader, a.dataHash)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+}
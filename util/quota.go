@@ -0,0 +1,428 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/protobuf"
+)
+
+// WriterAction is the admin action that registers, changes or removes a
+// writer.
+const WriterAction = "writer"
+
+// Codes of a QuotaError. They are part of the error message, so that
+// clients can find them with QuotaErrorCode.
+const (
+	ErrUnauthenticated = "UNAUTHENTICATED"
+	ErrUnknownWriter   = "UNKNOWN_WRITER"
+	ErrStorageQuota    = "STORAGE_QUOTA_EXCEEDED"
+	ErrRateLimit       = "RATE_LIMITED"
+)
+
+// QuotaError is returned when a write is rejected because the writer is not
+// authenticated or over one of its limits.
+type QuotaError struct {
+	Code string
+	Msg  string
+}
+
+func (e *QuotaError) Error() string {
+	return e.Code + ": " + e.Msg
+}
+
+// QuotaErrorCode returns the code of the QuotaError in the message of err,
+// which may have been passed on by a server, or "" if there is none.
+func QuotaErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, code := range []string{ErrUnauthenticated, ErrUnknownWriter, ErrStorageQuota, ErrRateLimit} {
+		if strings.Contains(err.Error(), code+": ") {
+			return code
+		}
+	}
+	return ""
+}
+
+// Quota holds the limits of a writer. A limit of 0 means unlimited.
+type Quota struct {
+	// MaxBytes is the number of bytes the writer can have stored.
+	MaxBytes int64
+	// Rate is the number of write requests per second, and Burst the
+	// number of requests that can be made at once. If Burst is 0, it is
+	// Rate rounded up.
+	Rate  float64
+	Burst int
+	// ByteRate is the number of bytes per second the writer can send. A
+	// request may use up more than the bytes available, as long as there
+	// are some left, and the following requests wait for the debt to be
+	// paid off.
+	ByteRate float64
+}
+
+// WriterInfo is what a server stores about a registered writer.
+type WriterInfo struct {
+	Quota Quota
+	Used  int64
+}
+
+// WriteMessage returns the message a writer signs at time ts to store a
+// request with the given digest, see RequestDigest.
+func WriteMessage(ts int64, digest []byte) []byte {
+	return AdminMessage("write", ts, digest)
+}
+
+// RequestDigest returns the hash of the protobuf encoding of req. The
+// signature of req has to be cleared, so that it covers all other fields.
+func RequestDigest(req interface{}) ([]byte, error) {
+	buf, err := protobuf.Encode(req)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(buf)
+	return h[:], nil
+}
+
+// SignWrite signs the request with the given digest at time ts with the key
+// of the writer.
+func SignWrite(sk kyber.Scalar, ts int64, digest []byte) ([]byte, error) {
+	return schnorr.Sign(cothority.Suite, sk, WriteMessage(ts, digest))
+}
+
+// WriterData returns the data of the admin message that sets the quota of
+// writer, or removes it, when the writers of the server are at version, see
+// WriterStore.Version.
+func WriterData(writer kyber.Point, q Quota, remove bool, version int64) ([]byte, error) {
+	if writer == nil {
+		return nil, errors.New("Missing writer")
+	}
+	buf, err := writer.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	var tail [41]byte
+	binary.LittleEndian.PutUint64(tail[0:], uint64(q.MaxBytes))
+	binary.LittleEndian.PutUint64(tail[8:], math.Float64bits(q.Rate))
+	binary.LittleEndian.PutUint64(tail[16:], uint64(q.Burst))
+	binary.LittleEndian.PutUint64(tail[24:], math.Float64bits(q.ByteRate))
+	if remove {
+		tail[32] = 1
+	}
+	binary.LittleEndian.PutUint64(tail[33:], uint64(version))
+	return append(buf, tail[:]...), nil
+}
+
+// tokenBucket limits the request rate and the byte rate of one writer.
+type tokenBucket struct {
+	tokens float64
+	bytes  float64
+	last   time.Time
+}
+
+// WriterStore keeps the registered writers and their usage in a bolt
+// database. As long as no writer is registered, all writes are accepted.
+type WriterStore struct {
+	db     *bolt.DB
+	bucket []byte
+	// versionBucket holds the number of changes of the writers.
+	versionBucket []byte
+	sync.Mutex
+	limits map[string]*tokenBucket
+}
+
+// NewWriterStore creates the bucket of the writers, using bn as prefix for
+// its name.
+func NewWriterStore(db *bolt.DB, bn []byte) (*WriterStore, error) {
+	ws := &WriterStore{
+		db:            db,
+		bucket:        append(append([]byte{}, bn...), []byte("_writers")...),
+		versionBucket: append(append([]byte{}, bn...), []byte("_writersversion")...),
+		limits:        make(map[string]*tokenBucket),
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{ws.bucket, ws.versionBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("NewWriterStore error: %v", err)
+		return nil, err
+	}
+	return ws, nil
+}
+
+func writerKey(pub kyber.Point) ([]byte, error) {
+	if pub == nil {
+		return nil, &QuotaError{ErrUnauthenticated, "missing writer key"}
+	}
+	return pub.MarshalBinary()
+}
+
+func (ws *WriterStore) getTx(tx *bolt.Tx, key []byte) (*WriterInfo, error) {
+	val := tx.Bucket(ws.bucket).Get(key)
+	if val == nil {
+		return nil, nil
+	}
+	wi := &WriterInfo{}
+	if err := protobuf.Decode(append([]byte{}, val...), wi); err != nil {
+		return nil, err
+	}
+	return wi, nil
+}
+
+func (ws *WriterStore) putTx(tx *bolt.Tx, key []byte, wi *WriterInfo) error {
+	buf, err := protobuf.Encode(wi)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(ws.bucket).Put(key, buf)
+}
+
+// EnabledTx returns true if at least one writer is registered.
+func (ws *WriterStore) EnabledTx(tx *bolt.Tx) bool {
+	k, _ := tx.Bucket(ws.bucket).Cursor().First()
+	return k != nil
+}
+
+var versionKey = []byte("version")
+
+func (ws *WriterStore) versionTx(tx *bolt.Tx) int64 {
+	val := tx.Bucket(ws.versionBucket).Get(versionKey)
+	if len(val) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(val))
+}
+
+// nextVersionTx checks that the writers are at version and counts the
+// change that is made to them.
+func (ws *WriterStore) nextVersionTx(tx *bolt.Tx, version int64) error {
+	if cur := ws.versionTx(tx); cur != version {
+		return fmt.Errorf("Writer version %d does not match %d", version, cur)
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(version+1))
+	return tx.Bucket(ws.versionBucket).Put(versionKey, buf)
+}
+
+// GetWriter returns what is stored about pub, or nil if it is not
+// registered, and the version of the writers. Every change of the writers
+// has to be made at the current version, so that an admin request cannot
+// be applied again after a later change.
+func (ws *WriterStore) GetWriter(pub kyber.Point) (*WriterInfo, int64, error) {
+	key, err := writerKey(pub)
+	if err != nil {
+		return nil, 0, err
+	}
+	var wi *WriterInfo
+	var version int64
+	err = ws.db.View(func(tx *bolt.Tx) error {
+		version = ws.versionTx(tx)
+		wi, err = ws.getTx(tx, key)
+		return err
+	})
+	if err != nil {
+		log.Errorf("GetWriter error: %v", err)
+		return nil, 0, err
+	}
+	return wi, version, nil
+}
+
+// SetWriter registers pub with the quota q, or changes its quota, if the
+// writers are at version. The bytes used by the writer are kept.
+func (ws *WriterStore) SetWriter(pub kyber.Point, q Quota, version int64) (*WriterInfo, error) {
+	key, err := writerKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	if q.MaxBytes < 0 || q.Rate < 0 || q.Burst < 0 || q.ByteRate < 0 {
+		return nil, errors.New("Negative quota")
+	}
+	var wi *WriterInfo
+	err = ws.db.Update(func(tx *bolt.Tx) error {
+		if err := ws.nextVersionTx(tx, version); err != nil {
+			return err
+		}
+		wi, err = ws.getTx(tx, key)
+		if err != nil {
+			return err
+		}
+		if wi == nil {
+			wi = &WriterInfo{}
+		}
+		wi.Quota = q
+		return ws.putTx(tx, key, wi)
+	})
+	if err != nil {
+		log.Errorf("SetWriter error: %v", err)
+		return nil, err
+	}
+	ws.Lock()
+	delete(ws.limits, string(key))
+	ws.Unlock()
+	return wi, nil
+}
+
+// RemoveWriter removes the registration of pub, if the writers are at
+// version. Its stored data is kept.
+func (ws *WriterStore) RemoveWriter(pub kyber.Point, version int64) error {
+	key, err := writerKey(pub)
+	if err != nil {
+		return err
+	}
+	err = ws.db.Update(func(tx *bolt.Tx) error {
+		if err := ws.nextVersionTx(tx, version); err != nil {
+			return err
+		}
+		return tx.Bucket(ws.bucket).Delete(key)
+	})
+	if err != nil {
+		log.Errorf("RemoveWriter error: %v", err)
+		return err
+	}
+	ws.Lock()
+	delete(ws.limits, string(key))
+	ws.Unlock()
+	return nil
+}
+
+// Authenticate checks that the write request with the given digest is
+// signed by the registered writer pub, and that the writer is within its
+// request rate and has room for size more bytes.
+func (ws *WriterStore) Authenticate(pub kyber.Point, ts int64, digest []byte, sig []byte, size int64, now time.Time) error {
+	var wi *WriterInfo
+	var key []byte
+	err := ws.db.View(func(tx *bolt.Tx) error {
+		if !ws.EnabledTx(tx) {
+			return nil
+		}
+		var err error
+		if key, err = writerKey(pub); err != nil {
+			return err
+		}
+		if wi, err = ws.getTx(tx, key); err != nil {
+			return err
+		}
+		if wi == nil {
+			return &QuotaError{ErrUnknownWriter, "writer is not registered"}
+		}
+		return nil
+	})
+	if err != nil || wi == nil {
+		return err
+	}
+	t := time.Unix(ts, 0)
+	if t.Before(now.Add(-AdminWindow)) || t.After(now.Add(AdminWindow)) {
+		return &QuotaError{ErrUnauthenticated, "write timestamp is outside of the window"}
+	}
+	if err = schnorr.Verify(cothority.Suite, pub, WriteMessage(ts, digest), sig); err != nil {
+		return &QuotaError{ErrUnauthenticated, "invalid writer signature"}
+	}
+	if !ws.allow(string(key), wi.Quota, size, now) {
+		return &QuotaError{ErrRateLimit, "too many write requests"}
+	}
+	return checkSpace(wi, size)
+}
+
+func checkSpace(wi *WriterInfo, size int64) error {
+	if wi.Quota.MaxBytes > 0 && wi.Used+size > wi.Quota.MaxBytes {
+		return &QuotaError{ErrStorageQuota, "storage quota exceeded"}
+	}
+	return nil
+}
+
+// allow takes one token and size bytes from the bucket of the writer. The
+// bytes of one second of ByteRate can be sent at once.
+func (ws *WriterStore) allow(key string, q Quota, size int64, now time.Time) bool {
+	if q.Rate == 0 && q.ByteRate == 0 {
+		return true
+	}
+	burst := float64(q.Burst)
+	if burst == 0 {
+		burst = math.Ceil(q.Rate)
+	}
+	ws.Lock()
+	defer ws.Unlock()
+	tb, ok := ws.limits[key]
+	if !ok {
+		tb = &tokenBucket{tokens: burst, bytes: q.ByteRate, last: now}
+		ws.limits[key] = tb
+	}
+	elapsed := now.Sub(tb.last).Seconds()
+	tb.tokens = math.Min(burst, tb.tokens+elapsed*q.Rate)
+	tb.bytes = math.Min(q.ByteRate, tb.bytes+elapsed*q.ByteRate)
+	tb.last = now
+	if q.Rate > 0 && tb.tokens < 1 {
+		return false
+	}
+	if q.ByteRate > 0 && size > 0 && tb.bytes <= 0 {
+		return false
+	}
+	if q.Rate > 0 {
+		tb.tokens--
+	}
+	if q.ByteRate > 0 {
+		tb.bytes -= float64(size)
+	}
+	return true
+}
+
+// ChargeTx adds size bytes to the usage of the writer pub. It fails without
+// changing anything if the writer would go over its quota.
+func (ws *WriterStore) ChargeTx(tx *bolt.Tx, pub kyber.Point, size int64) error {
+	if !ws.EnabledTx(tx) {
+		return nil
+	}
+	key, err := writerKey(pub)
+	if err != nil {
+		return err
+	}
+	wi, err := ws.getTx(tx, key)
+	if err != nil {
+		return err
+	}
+	if wi == nil {
+		return &QuotaError{ErrUnknownWriter, "writer is not registered"}
+	}
+	if err = checkSpace(wi, size); err != nil {
+		return err
+	}
+	wi.Used += size
+	return ws.putTx(tx, key, wi)
+}
+
+// ReleaseTx removes size bytes from the usage of the writer pub, if it is
+// registered.
+func (ws *WriterStore) ReleaseTx(tx *bolt.Tx, pub kyber.Point, size int64) error {
+	if pub == nil {
+		return nil
+	}
+	key, err := pub.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	wi, err := ws.getTx(tx, key)
+	if err != nil || wi == nil {
+		return err
+	}
+	wi.Used -= size
+	if wi.Used < 0 {
+		wi.Used = 0
+	}
+	return ws.putTx(tx, key, wi)
+}
@@ -0,0 +1,204 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/key"
+)
+
+// newTestWriterStore returns a WriterStore in a temporary directory, and a
+// function that removes it.
+func newTestWriterStore(t *testing.T) (*WriterStore, func()) {
+	dir, err := ioutil.TempDir("", "writers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "db"), 0600, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	ws, err := NewWriterStore(db, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	type step struct {
+		after time.Duration
+		size  int64
+		ok    bool
+	}
+	tests := []struct {
+		name  string
+		quota Quota
+		steps []step
+	}{
+		{"unlimited", Quota{}, []step{{0, 1 << 30, true}, {0, 1 << 30, true}}},
+		{"request rate", Quota{Rate: 1}, []step{
+			{0, 0, true}, {0, 0, false}, {time.Second, 0, true}}},
+		{"burst", Quota{Rate: 1, Burst: 2}, []step{
+			{0, 0, true}, {0, 0, true}, {0, 0, false}, {time.Second, 0, true}, {0, 0, false}}},
+		{"refill is capped", Quota{Rate: 1, Burst: 2}, []step{
+			{0, 0, true}, {time.Hour, 0, true}, {0, 0, true}, {0, 0, false}}},
+		{"byte rate", Quota{ByteRate: 100}, []step{
+			{0, 60, true}, {0, 60, true}, {0, 1, false}, {time.Second, 60, true}}},
+		{"byte debt", Quota{ByteRate: 100}, []step{
+			{0, 1000, true}, {5 * time.Second, 1, false}, {5 * time.Second, 1, true}}},
+		{"empty requests pass the byte rate", Quota{ByteRate: 100}, []step{
+			{0, 1000, true}, {0, 0, true}}},
+	}
+	for _, tt := range tests {
+		ws := &WriterStore{limits: make(map[string]*tokenBucket)}
+		now := time.Now()
+		for i, s := range tt.steps {
+			now = now.Add(s.after)
+			if ok := ws.allow("writer", tt.quota, s.size, now); ok != s.ok {
+				t.Errorf("%s: step %d returned %v", tt.name, i, ok)
+			}
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ws, cleanup := newTestWriterStore(t)
+	defer cleanup()
+	writer := key.NewKeyPair(cothority.Suite)
+	other := key.NewKeyPair(cothority.Suite)
+	now := time.Now()
+	digest := DataHash([]byte("request"))
+	sign := func(kp *key.Pair, ts time.Time) []byte {
+		sig, err := SignWrite(kp.Private, ts.Unix(), digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+
+	// As long as no writer is registered, everything is accepted.
+	if err := ws.Authenticate(nil, 0, digest, nil, 1<<30, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ws.SetWriter(writer.Public, Quota{MaxBytes: 100}, 0); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		pub  kyber.Point
+		ts   time.Time
+		sig  []byte
+		size int64
+		code string
+	}{
+		{"valid", writer.Public, now, sign(writer, now), 100, ""},
+		{"missing writer", nil, now, sign(writer, now), 1, ErrUnauthenticated},
+		{"unknown writer", other.Public, now, sign(other, now), 1, ErrUnknownWriter},
+		{"signed by another key", writer.Public, now, sign(other, now), 1, ErrUnauthenticated},
+		{"old timestamp", writer.Public, now.Add(-2 * AdminWindow), sign(writer, now.Add(-2*AdminWindow)), 1, ErrUnauthenticated},
+		{"signed for another time", writer.Public, now.Add(time.Second), sign(writer, now), 1, ErrUnauthenticated},
+		{"over the quota", writer.Public, now, sign(writer, now), 101, ErrStorageQuota},
+	}
+	for _, tt := range tests {
+		err := ws.Authenticate(tt.pub, tt.ts.Unix(), digest, tt.sig, tt.size, now)
+		if code := QuotaErrorCode(err); code != tt.code || (tt.code == "" && err != nil) {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+	if err := ws.Authenticate(writer.Public, now.Unix(), DataHash([]byte("other")), sign(writer, now), 1, now); err == nil {
+		t.Fatal("Signature of another request was accepted")
+	}
+}
+
+func TestChargeRelease(t *testing.T) {
+	ws, cleanup := newTestWriterStore(t)
+	defer cleanup()
+	writer := key.NewKeyPair(cothority.Suite).Public
+	other := key.NewKeyPair(cothority.Suite).Public
+	if _, err := ws.SetWriter(writer, Quota{MaxBytes: 100}, 0); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		pub    kyber.Point
+		charge int64
+		code   string
+		used   int64
+	}{
+		{"charge", writer, 60, "", 60},
+		{"over the quota", writer, 41, ErrStorageQuota, 60},
+		{"up to the quota", writer, 40, "", 100},
+		{"release", writer, -30, "", 70},
+		{"release more than used", writer, -100, "", 0},
+		{"unknown writer", other, 1, ErrUnknownWriter, 0},
+	}
+	for i, tt := range tests {
+		err := ws.db.Update(func(tx *bolt.Tx) error {
+			if tt.charge < 0 {
+				return ws.ReleaseTx(tx, tt.pub, -tt.charge)
+			}
+			return ws.ChargeTx(tx, tt.pub, tt.charge)
+		})
+		if code := QuotaErrorCode(err); code != tt.code || (tt.code == "" && err != nil) {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+		// Changing the quota keeps the usage.
+		wi, err := ws.SetWriter(writer, Quota{MaxBytes: 100}, int64(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wi.Used != tt.used {
+			t.Errorf("%s: %d bytes used instead of %d", tt.name, wi.Used, tt.used)
+		}
+	}
+}
+
+func TestWriterVersion(t *testing.T) {
+	ws, cleanup := newTestWriterStore(t)
+	defer cleanup()
+	writer := key.NewKeyPair(cothority.Suite).Public
+	tests := []struct {
+		name    string
+		remove  bool
+		version int64
+		ok      bool
+	}{
+		{"register", false, 0, true},
+		{"replayed registration", false, 0, false},
+		{"change", false, 1, true},
+		{"remove", true, 2, true},
+		{"replayed change", false, 1, false},
+		{"replayed removal", true, 2, false},
+		{"future version", false, 4, false},
+		{"register again", false, 3, true},
+	}
+	for _, tt := range tests {
+		var err error
+		if tt.remove {
+			err = ws.RemoveWriter(writer, tt.version)
+		} else {
+			_, err = ws.SetWriter(writer, Quota{MaxBytes: 100}, tt.version)
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+	wi, version, err := ws.GetWriter(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wi == nil || version != 4 {
+		t.Fatalf("Writer is %+v at version %d", wi, version)
+	}
+}
@@ -6,11 +6,11 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/dedis/cothority"
 	"github.com/dedis/kyber"
@@ -31,6 +31,38 @@ type WriteData struct {
 	Reader    kyber.Point
 	EncReader []byte
 	StoredKey string
+	Replicas  []*ReplicaKey
+	Owner     kyber.Point
+	// TTL is how long the storage servers keep the data. If it is 0, the
+	// data is kept until the owner deletes it.
+	TTL time.Duration
+	// ServerKey is the key K and C are encrypted to.
+	ServerKey kyber.Point
+	// Ubar, E and F prove that the writer knows the randomness of K, see
+	// EncryptWithProof.
+	Ubar kyber.Point
+	E    kyber.Scalar
+	F    kyber.Scalar
+	// Layout describes the shards of an erasure coded write, see
+	// CreateShardedWriteData.
+	Layout *ShardLayout
+	// WriterSk is the key of a registered writer. If it is set, the write
+	// is signed with it, and Owner defaults to its public key.
+	WriterSk kyber.Scalar
+	// Chunked is set if the data is uploaded in chunks instead of being
+	// sent with the write, see CreateChunkedWriteData.
+	Chunked bool
+}
+
+// ReplicaKey holds the symmetric key of a write encrypted to the public key
+// of one storage server, together with the proof of the ciphertext.
+type ReplicaKey struct {
+	Server kyber.Point
+	K      kyber.Point
+	C      kyber.Point
+	Ubar   kyber.Point
+	E      kyber.Scalar
+	F      kyber.Scalar
 }
 
 func CompareKeys(readerPt kyber.Point, decReader []byte) (int, error) {
@@ -97,6 +129,103 @@ func RecoverData(encData []byte, sk kyber.Scalar, k kyber.Point, c kyber.Point)
 	return AeadOpen(recvKey, encData)
 }
 
+// ReencryptProof proves that a re-encrypted ciphertext holds the same point
+// as the original one, see Reencrypt.
+type ReencryptProof struct {
+	E  kyber.Scalar
+	Z1 kyber.Scalar
+	Z2 kyber.Scalar
+}
+
+// Reencrypt decrypts the ciphertext (K, C) with the server key sk and
+// encrypts the resulting point to reader. It returns the new ciphertext
+// together with a Chaum-Pedersen style proof that it holds the same point.
+func Reencrypt(sk kyber.Scalar, K, C, reader kyber.Point) (kyber.Point, kyber.Point, *ReencryptProof, error) {
+	suite := cothority.Suite
+	M := suite.Point().Sub(C, suite.Point().Mul(sk, K))
+	r := suite.Scalar().Pick(random.New())
+	K1 := suite.Point().Mul(r, nil)
+	C1 := suite.Point().Add(M, suite.Point().Mul(r, reader))
+
+	a := suite.Scalar().Pick(random.New())
+	b := suite.Scalar().Pick(random.New())
+	T1 := suite.Point().Mul(a, nil)
+	T2 := suite.Point().Mul(b, nil)
+	T3 := suite.Point().Sub(suite.Point().Mul(b, reader), suite.Point().Mul(a, K))
+	X := suite.Point().Mul(sk, nil)
+	e, err := reencryptChallenge(X, K, C, reader, K1, C1, T1, T2, T3)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return K1, C1, &ReencryptProof{
+		E:  e,
+		Z1: suite.Scalar().Add(a, suite.Scalar().Mul(e, sk)),
+		Z2: suite.Scalar().Add(b, suite.Scalar().Mul(e, r)),
+	}, nil
+}
+
+// VerifyReencryption checks that (K1, C1) is the ciphertext (K, C) of the
+// server with key serverKey re-encrypted to reader, by checking that
+// K1 = r*G and C1 - C = r*reader - x*K where serverKey = x*G.
+func VerifyReencryption(serverKey, K, C, reader, K1, C1 kyber.Point, proof *ReencryptProof) error {
+	if proof == nil || proof.E == nil || proof.Z1 == nil || proof.Z2 == nil {
+		return errors.New("Missing re-encryption proof")
+	}
+	suite := cothority.Suite
+	e := proof.E
+	// T1 = Z1*G - E*X, T2 = Z2*G - E*K1,
+	// T3 = Z2*reader - Z1*K - E*(C1 - C)
+	T1 := suite.Point().Sub(suite.Point().Mul(proof.Z1, nil), suite.Point().Mul(e, serverKey))
+	T2 := suite.Point().Sub(suite.Point().Mul(proof.Z2, nil), suite.Point().Mul(e, K1))
+	T3 := suite.Point().Sub(suite.Point().Mul(proof.Z2, reader), suite.Point().Mul(proof.Z1, K))
+	T3.Sub(T3, suite.Point().Mul(e, suite.Point().Sub(C1, C)))
+	e2, err := reencryptChallenge(serverKey, K, C, reader, K1, C1, T1, T2, T3)
+	if err != nil {
+		return err
+	}
+	if !e2.Equal(e) {
+		return errors.New("Invalid re-encryption proof")
+	}
+	return nil
+}
+
+// Rewrap records that a server re-encrypted a stored ciphertext to its new
+// key Server, e.g. when it rotated its key. Proof shows that K and C hold
+// the same point as the ciphertext before.
+type Rewrap struct {
+	Server kyber.Point
+	K      kyber.Point
+	C      kyber.Point
+	Proof  *ReencryptProof
+}
+
+// VerifyRewraps follows the re-encryptions of the ciphertext (K, C) of the
+// server with key serverKey and returns the key and the ciphertext at the
+// end of the chain.
+func VerifyRewraps(serverKey, K, C kyber.Point, rewraps []*Rewrap) (kyber.Point, kyber.Point, kyber.Point, error) {
+	for _, rw := range rewraps {
+		if rw == nil || rw.Server == nil || rw.K == nil || rw.C == nil {
+			return nil, nil, nil, errors.New("Incomplete re-encryption")
+		}
+		err := VerifyReencryption(serverKey, K, C, rw.Server, rw.K, rw.C, rw.Proof)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		serverKey, K, C = rw.Server, rw.K, rw.C
+	}
+	return serverKey, K, C, nil
+}
+
+func reencryptChallenge(points ...kyber.Point) (kyber.Scalar, error) {
+	h := cothority.Suite.Hash()
+	for _, p := range points {
+		if _, err := p.MarshalTo(h); err != nil {
+			return nil, err
+		}
+	}
+	return cothority.Suite.Scalar().SetBytes(h.Sum(nil)), nil
+}
+
 func ElGamalDecrypt(sk kyber.Scalar, K kyber.Point, C kyber.Point) ([]byte, error) {
 	S := cothority.Suite.Point().Mul(sk, K)
 	M := cothority.Suite.Point().Sub(C, S)
@@ -128,33 +257,121 @@ func symEncrypt(msg []byte, key []byte) ([]byte, error) {
 	return encData, nil
 }
 
+// EncryptData encrypts data with a fresh symmetric key and returns the
+// ciphertext together with the key.
+func EncryptData(data []byte) ([]byte, []byte, error) {
+	symKey := make([]byte, 16)
+	random.Bytes(symKey, random.New())
+	encData, err := symEncrypt(data, symKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encData, symKey, nil
+}
+
 func CreateWriteData(data []byte, reader kyber.Point, serverKey kyber.Point, isSemi bool) (*WriteData, error) {
+	wd, err := createWriteData(data, reader, []kyber.Point{serverKey}, isSemi, merkleHash)
+	if err != nil {
+		log.Errorf("CreateWriteData error: %v", err)
+		return nil, err
+	}
+	wd.Replicas = nil
+	return wd, nil
+}
+
+// CreateReplicatedWriteData works like CreateWriteData but additionally
+// encrypts the symmetric key to every key in serverKeys, so that each of
+// these servers can re-encrypt it independently. K and C of the returned
+// WriteData are the ones for serverKeys[0].
+func CreateReplicatedWriteData(data []byte, reader kyber.Point, serverKeys []kyber.Point, isSemi bool) (*WriteData, error) {
+	wd, err := createWriteData(data, reader, serverKeys, isSemi, merkleHash)
+	if err != nil {
+		log.Errorf("CreateReplicatedWriteData error: %v", err)
+		return nil, err
+	}
+	return wd, nil
+}
+
+// CreateChunkedWriteData works like CreateReplicatedWriteData, but marks
+// the write data to be uploaded in chunks. As the DataHash of every write
+// is the Merkle root of the chunks of the encrypted data, any write data
+// can be uploaded in chunks by setting Chunked.
+func CreateChunkedWriteData(data []byte, reader kyber.Point, serverKeys []kyber.Point, isSemi bool) (*WriteData, error) {
+	wd, err := CreateReplicatedWriteData(data, reader, serverKeys, isSemi)
+	if err != nil {
+		return nil, err
+	}
+	wd.Chunked = true
+	return wd, nil
+}
+
+// CreateShardedWriteData works like CreateReplicatedWriteData for the
+// semi-centralized model, but the encrypted data is erasure coded into n
+// shards, any k of which reconstruct it. The DataHash is the root of the
+// layout of the shards, which is stored in Layout.
+func CreateShardedWriteData(data []byte, reader kyber.Point, serverKeys []kyber.Point, k, n int) (*WriteData, error) {
+	var layout *ShardLayout
+	wd, err := createWriteData(data, reader, serverKeys, true, func(encData []byte) ([]byte, error) {
+		var err error
+		_, layout, err = EncodeShards(encData, k, n)
+		if err != nil {
+			return nil, err
+		}
+		return layout.Root(), nil
+	})
+	if err != nil {
+		log.Errorf("CreateShardedWriteData error: %v", err)
+		return nil, err
+	}
+	wd.Layout = layout
+	return wd, nil
+}
+
+func merkleHash(data []byte) ([]byte, error) {
+	return DataHash(data), nil
+}
+
+// createWriteData encrypts data and the symmetric key to every server key.
+// hashData computes the DataHash of the encrypted data.
+func createWriteData(data []byte, reader kyber.Point, serverKeys []kyber.Point, isSemi bool, hashData func([]byte) ([]byte, error)) (*WriteData, error) {
+	if len(serverKeys) == 0 {
+		return nil, errors.New("no server keys")
+	}
 	var symKey [16]byte
 	random.Bytes(symKey[:], random.New())
 	encData, err := symEncrypt(data, symKey[:])
 	if err != nil {
-		log.Errorf("CreateWriteData error: %v", err)
 		return nil, err
 	}
-	k, c, _ := ElGamalEncrypt(serverKey, symKey[:])
-	dh := sha256.Sum256(encData)
+	dataHash, err := hashData(encData)
+	if err != nil {
+		return nil, err
+	}
 	wd := &WriteData{
 		Data:     encData,
-		DataHash: dh[:],
-		K:        k,
-		C:        c,
+		DataHash: dataHash,
 		Reader:   reader,
-		//EncReader: encReader,
 	}
+	for _, sk := range serverKeys {
+		rk, err := EncryptWithProof(sk, symKey[:], reader, dataHash)
+		if err != nil {
+			return nil, err
+		}
+		wd.Replicas = append(wd.Replicas, rk)
+	}
+	wd.K = wd.Replicas[0].K
+	wd.C = wd.Replicas[0].C
+	wd.Ubar = wd.Replicas[0].Ubar
+	wd.E = wd.Replicas[0].E
+	wd.F = wd.Replicas[0].F
+	wd.ServerKey = serverKeys[0]
 	if isSemi {
 		readerBytes, err := reader.MarshalBinary()
 		if err != nil {
-			log.Errorf("CreateWriteData error: %v", err)
 			return nil, err
 		}
 		encReader, err := symEncrypt(readerBytes, symKey[:])
 		if err != nil {
-			log.Errorf("CreateWriteData error: %v", err)
 			return nil, err
 		}
 		wd.EncReader = encReader
@@ -0,0 +1,113 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/key"
+)
+
+// reencryptArgs are the arguments of VerifyReencryption.
+type reencryptArgs struct {
+	server, K, C, reader, K1, C1 kyber.Point
+	proof                        *ReencryptProof
+}
+
+func TestReencrypt(t *testing.T) {
+	server := key.NewKeyPair(cothority.Suite)
+	reader := key.NewKeyPair(cothority.Suite)
+	other := key.NewKeyPair(cothority.Suite).Public
+	msg := []byte("symmetric key")
+	K, C, _ := ElGamalEncrypt(server.Public, msg)
+	K1, C1, proof, err := Reencrypt(server.Private, K, C, reader.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := ElGamalDecrypt(reader.Private, K1, C1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, msg) {
+		t.Fatal("Reader got the wrong key")
+	}
+	// A server that re-encrypts with another key than the one the writer
+	// encrypted to cannot prove it.
+	wrongK, wrongC, wrongProof, err := Reencrypt(key.NewKeyPair(cothority.Suite).Private, K, C, reader.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	one := cothority.Suite.Scalar().One()
+	tests := []struct {
+		name   string
+		change func(a *reencryptArgs)
+		ok     bool
+	}{
+		{"valid", func(a *reencryptArgs) {}, true},
+		{"wrong server key", func(a *reencryptArgs) {
+			a.K1, a.C1, a.proof = wrongK, wrongC, wrongProof
+		}, false},
+		{"claimed other server", func(a *reencryptArgs) { a.server = other }, false},
+		{"other reader", func(a *reencryptArgs) { a.reader = other }, false},
+		{"other ciphertext", func(a *reencryptArgs) { a.C = other }, false},
+		{"other K1", func(a *reencryptArgs) { a.K1 = other }, false},
+		{"other C1", func(a *reencryptArgs) { a.C1 = other }, false},
+		{"changed proof", func(a *reencryptArgs) {
+			a.proof = &ReencryptProof{E: proof.E, Z1: cothority.Suite.Scalar().Add(proof.Z1, one), Z2: proof.Z2}
+		}, false},
+		{"missing proof", func(a *reencryptArgs) { a.proof = nil }, false},
+	}
+	for _, tt := range tests {
+		a := &reencryptArgs{server.Public, K, C, reader.Public, K1, C1, proof}
+		tt.change(a)
+		err := VerifyReencryption(a.server, a.K, a.C, a.reader, a.K1, a.C1, a.proof)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+}
+
+func TestVerifyRewraps(t *testing.T) {
+	keys := []*key.Pair{key.NewKeyPair(cothority.Suite), key.NewKeyPair(cothority.Suite),
+		key.NewKeyPair(cothority.Suite)}
+	msg := []byte("symmetric key")
+	K, C, _ := ElGamalEncrypt(keys[0].Public, msg)
+	var rewraps []*Rewrap
+	k, c := K, C
+	for i := 1; i < len(keys); i++ {
+		k1, c1, proof, err := Reencrypt(keys[i-1].Private, k, c, keys[i].Public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rewraps = append(rewraps, &Rewrap{Server: keys[i].Public, K: k1, C: c1, Proof: proof})
+		k, c = k1, c1
+	}
+	server, k, c, err := VerifyRewraps(keys[0].Public, K, C, rewraps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.Equal(keys[2].Public) {
+		t.Fatal("Wrong key at the end of the chain")
+	}
+	if dec, err := ElGamalDecrypt(keys[2].Private, k, c); err != nil || !bytes.Equal(dec, msg) {
+		t.Fatal("Wrong ciphertext at the end of the chain")
+	}
+
+	tests := []struct {
+		name    string
+		rewraps []*Rewrap
+	}{
+		{"skipped step", rewraps[1:]},
+		{"swapped steps", []*Rewrap{rewraps[1], rewraps[0]}},
+		{"incomplete step", []*Rewrap{rewraps[0], {Server: keys[2].Public}}},
+		{"other server", []*Rewrap{rewraps[0], {Server: keys[0].Public, K: rewraps[1].K,
+			C: rewraps[1].C, Proof: rewraps[1].Proof}}},
+	}
+	for _, tt := range tests {
+		if _, _, _, err := VerifyRewraps(keys[0].Public, K, C, tt.rewraps); err == nil {
+			t.Errorf("%s: wrong chain was accepted", tt.name)
+		}
+	}
+}
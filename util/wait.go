@@ -0,0 +1,63 @@
+package util
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dedis/cothority/byzcoin"
+)
+
+// ProofBackoff is the first interval between two proof requests of
+// WaitForInstance. It doubles after every request, up to MaxProofBackoff.
+var ProofBackoff = 100 * time.Millisecond
+
+// MaxProofBackoff is the longest interval between two proof requests.
+var MaxProofBackoff = 2 * time.Second
+
+// TimeoutError is returned if an instance is not on byzcoin in time.
+type TimeoutError struct {
+	ID      byzcoin.InstanceID
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Instance %x is not on byzcoin after %v", e.ID.Slice(), e.Timeout)
+}
+
+// IsTimeout returns true if err is a TimeoutError.
+func IsTimeout(err error) bool {
+	_, ok := err.(*TimeoutError)
+	return ok
+}
+
+// WaitForInstance polls byzcoin until the instance with the given ID is in
+// the global state, and returns its proof after verifying it against the
+// skipchain of cl. It returns a TimeoutError if the instance does not show
+// up within timeout.
+func WaitForInstance(cl *byzcoin.Client, id byzcoin.InstanceID, timeout time.Duration) (*byzcoin.Proof, error) {
+	deadline := time.Now().Add(timeout)
+	backoff := ProofBackoff
+	for {
+		resp, err := cl.GetProof(id.Slice())
+		if err != nil {
+			return nil, err
+		}
+		if resp.Proof.InclusionProof.Match() {
+			if err = resp.Proof.Verify(cl.ID); err != nil {
+				return nil, err
+			}
+			return &resp.Proof, nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, &TimeoutError{ID: id, Timeout: timeout}
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > MaxProofBackoff {
+			backoff = MaxProofBackoff
+		}
+	}
+}